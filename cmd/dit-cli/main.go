@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,7 +27,9 @@ func main() {
 
 	// Actions
 	get := parser.NewCommand("get", "Get a parcel from a mirror")
-	getRepo := get.String("r", "repo", &argparse.Options{Required: true, Help: "Full path to the parcel. format: @author/repo/path"}) // TODO: change to positional argument
+	getRepoArg := get.StringPositional(&argparse.Options{Required: false, Help: "Full path to the parcel. format: @author/repo/path"})
+	getRepo := get.String("r", "repo", &argparse.Options{Required: false, Help: "Full path to the parcel, same as the positional argument", Default: ""})
+	getTag := get.String("t", "tag", &argparse.Options{Required: false, Help: "Get the snapshot with this tag instead of the latest", Default: ""})
 	getMirror := get.String("m", "mirror", &argparse.Options{Required: false, Help: "Mirror to get the parcel from, overrides the default mirror.", Default: ""})
 
 	status := parser.NewCommand("status", "Show the status of the directory")
@@ -36,6 +40,12 @@ func main() {
 	parcelSetRepo := parcelSet.String("r", "repo", &argparse.Options{Required: false, Help: "Path to the parcel. format: /repo/path"})
 	parcelSetAuthor := parcelSet.String("a", "author", &argparse.Options{Required: false, Help: "Author of the parcel"})
 	parcelSetMirror := parcelSet.String("m", "mirror", &argparse.Options{Required: false, Help: "Mirror for this parcel", Default: ""})
+	parcelSetVisibility := parcelSet.Selector("v", "visibility", []string{"private", "public"}, &argparse.Options{Required: false, Help: "Who can read the parcel on the mirror: private (owner and shared authors) or public (anyone)"})
+	parcelShare := parcelManage.NewCommand("share", "Share a private parcel with another author")
+	parcelShareAuthor := parcelShare.StringPositional(&argparse.Options{Required: true, Help: "Author to share the parcel with."})
+	parcelShareRemove := parcelShare.Flag("", "remove", &argparse.Options{Required: false, Help: "Stop sharing the parcel with the author"})
+	parcelEncrypt := parcelManage.NewCommand("encrypt", "Encrypt the files of a parcel that was not synced yet, only your devices can read it")
+	parcelRewrap := parcelManage.NewCommand("rewrap", "Let the current device keys read an encrypted parcel, run it after adding a device")
 
 	config := parser.NewCommand("config", "Configure dit")
 	configSet := config.NewCommand("set", "Set config values")
@@ -47,6 +57,10 @@ func main() {
 	sync := parser.NewCommand("sync", "Sync the directory")
 	syncUp := sync.NewCommand("up", "Sync the directory to the parcel mirror")
 	syncUpOnlyMaster := syncUp.Flag("", "only-master", &argparse.Options{Required: false, Help: "Only sync the master file (removing files from mirror if not present)", Default: false})
+	syncUpAllowSecrets := syncUp.Flag("", "allow-secrets", &argparse.Options{Required: false, Help: "Upload files even if they look like they contain secrets", Default: false})
+	syncUpForce := syncUp.Flag("f", "force", &argparse.Options{Required: false, Help: "Remove files from the mirror without asking, however many there are", Default: false})
+	syncUpMaxDeletes := syncUp.Int("", "max-deletes", &argparse.Options{Required: false, Help: "Ask before removing more than this many files from the mirror", Default: 20})
+	syncUpMaxDeletePercent := syncUp.Int("", "max-delete-percent", &argparse.Options{Required: false, Help: "Ask before removing more than this percentage of the parcel's files from the mirror", Default: 50})
 	syncDown := sync.NewCommand("down", "Sync the directory from the parcel mirror")
 
 	init := parser.NewCommand("init", "Initialize a directory")
@@ -59,12 +73,60 @@ func main() {
 	ignoreRemove := ignore.String("r", "remove", &argparse.Options{Required: false, Help: "Remove a pattern from the ignore list."})
 	ignoreList := ignore.Flag("l", "list", &argparse.Options{Required: false, Help: "List the ignore patterns."})
 
+	secrets := parser.NewCommand("secrets", "Manage exceptions to the secret scanner run before sync up")
+	secretsAdd := secrets.String("a", "add", &argparse.Options{Required: false, Help: "Allow paths matching a pattern to be synced even if they look like secrets. usage: dit secrets -a \"config/test.env\""})
+	secretsRemove := secrets.String("r", "remove", &argparse.Options{Required: false, Help: "Remove a pattern from the exceptions."})
+	secretsList := secrets.Flag("l", "list", &argparse.Options{Required: false, Help: "List the exception patterns."})
+	secretsScan := secrets.Flag("s", "scan", &argparse.Options{Required: false, Help: "Scan all parcel files for secrets without syncing."})
+
 	master := parser.NewCommand("master", "Manage the parcel master record")
 	masterClear := master.NewCommand("clear", "Remove all records from the master table")
 	masterRemove := master.NewCommand("rm", "Remove a file from the master record")
 	masterList := master.NewCommand("list", "List all files in the master record")
 	masterRemoveFile := masterRemove.StringPositional(&argparse.Options{Required: true, Help: "File to remove from the master record."})
 
+	tag := parser.NewCommand("tag", "Name snapshots of the parcel on the mirror")
+	tagCreate := tag.NewCommand("create", "Tag the latest snapshot")
+	tagCreateName := tagCreate.StringPositional(&argparse.Options{Required: true, Help: "Name of the tag, e.g. v1.3-assets"})
+	tagCreateSnapshot := tagCreate.Int("s", "snapshot", &argparse.Options{Required: false, Help: "Tag this snapshot instead of the latest", Default: 0})
+	tagList := tag.NewCommand("list", "List the tags of the parcel")
+	tagDelete := tag.NewCommand("delete", "Delete a tag, the snapshot may then be pruned")
+	tagDeleteName := tagDelete.StringPositional(&argparse.Options{Required: true, Help: "Name of the tag"})
+
+	versions := parser.NewCommand("versions", "Show and restore previous versions of a file kept on the mirror")
+	versionsList := versions.NewCommand("list", "List versions of a file, newest first")
+	versionsListFile := versionsList.StringPositional(&argparse.Options{Required: true, Help: "File to list versions of."})
+	versionsGet := versions.NewCommand("get", "Restore a version of a file")
+	versionsGetFile := versionsGet.StringPositional(&argparse.Options{Required: true, Help: "File to restore."})
+	versionsGetID := versionsGet.IntPositional(&argparse.Options{Required: true, Help: "Version to restore, see 'dit versions list'."})
+	versionsGetOutput := versionsGet.String("o", "output", &argparse.Options{Required: false, Help: "Write the version to this path instead of over the file", Default: ""})
+
+	trash := parser.NewCommand("trash", "Show and restore files deleted from the parcel on the mirror")
+	trash.NewCommand("list", "List deleted files the mirror still keeps")
+	trashRestore := trash.NewCommand("restore", "Restore a deleted file on the mirror and in this directory")
+	trashRestoreFile := trashRestore.StringPositional(&argparse.Options{Required: true, Help: "File to restore."})
+
+	keys := parser.NewCommand("keys", "Manage device keys")
+	keysMirror := keys.String("m", "mirror", &argparse.Options{Required: false, Help: "Mirror to manage keys on, overrides the default mirror.", Default: ""})
+	keysList := keys.NewCommand("list", "List device keys registered on the mirror")
+	keysShow := keys.NewCommand("show", "Show the key of this device")
+	keysAdd := keys.NewCommand("add", "Register a device key with the mirror, creates a key for this device if needed")
+	keysAddDevice := keysAdd.String("d", "device", &argparse.Options{Required: false, Help: "Device name, defaults to the hostname", Default: ""})
+	keysAddPublicKey := keysAdd.String("k", "public-key", &argparse.Options{Required: false, Help: "Register another device's public key (from 'dit keys show' on that device)", Default: ""})
+	keysAddToken := keysAdd.String("t", "token", &argparse.Options{Required: false, Help: "One-time token from the mirror administrator, needed for the first key of an author who already has parcels", Default: ""})
+	keysRevoke := keys.NewCommand("revoke", "Revoke a device key")
+	keysRevokeDevice := keysRevoke.StringPositional(&argparse.Options{Required: true, Help: "Device to revoke."})
+	keysRevokeForce := keysRevoke.Flag("f", "force", &argparse.Options{Required: false, Help: "Revoke the last active key, only an administrator can give access to your parcels again", Default: false})
+	keysLock := keys.NewCommand("lock", "Encrypt the device key with a passphrase")
+	keysUnlock := keys.NewCommand("unlock", "Remove the passphrase from the device key")
+
+	quota := parser.NewCommand("quota", "Show your storage usage and limits on the mirror")
+	quotaMirror := quota.String("m", "mirror", &argparse.Options{Required: false, Help: "Mirror to show usage on, overrides the default mirror.", Default: ""})
+
+	agent := parser.NewCommand("agent", "Unlock the device key once and sign for dit commands in this session")
+	agentTimeout := agent.String("t", "timeout", &argparse.Options{Required: false, Help: "How long the key stays unlocked", Default: "8h"})
+	agentStop := agent.Flag("", "stop", &argparse.Options{Required: false, Help: "Stop the running agent"})
+
 	PrintVersion := parser.NewCommand("version", "Print version")
 
 	err := parser.Parse(os.Args)
@@ -142,6 +204,19 @@ func main() {
 				wasSet = true
 				ditmaster.Stores.Manifest["mirror"] = *parcelSetMirror
 			}
+			if *parcelSetVisibility != "" {
+				parcel = ditmaster.GetParcelInfo(*OverrideCmdDir) // pick up changes to author, repo and mirror
+				err = ditclient.SetParcelVisibility(parcel, *parcelSetVisibility)
+				if err != nil {
+					color.HiRed("ERROR: Failed to set visibility: %s", err)
+					return
+				}
+				wasSet = true
+				ditmaster.Stores.Manifest["visibility"] = *parcelSetVisibility
+				if _, _, err := ditclient.LoadDevicePublicKey(); err != nil && *parcelSetVisibility == "private" {
+					color.HiYellow("Private parcels are only protected once you register a device key, use 'dit keys add'")
+				}
+			}
 			if !wasSet {
 				fmt.Println(color.HiYellowString("No values were set."))
 				fmt.Println(parcelSet.Usage(err))
@@ -153,6 +228,48 @@ func main() {
 			if err != nil {
 				log.Fatal(err)
 			}
+		} else if parcelShare.Happened() {
+			err = ditclient.ShareParcel(parcel, *parcelShareAuthor, *parcelShareRemove)
+			if err != nil {
+				color.HiRed("ERROR: Failed to update sharing: %s", err)
+				return
+			}
+			if *parcelShareRemove {
+				fmt.Println(color.CyanString("[-]"), "Stopped sharing with", color.YellowString(*parcelShareAuthor))
+			} else {
+				fmt.Println(color.CyanString("[-]"), "Shared with", color.YellowString(*parcelShareAuthor))
+			}
+			if parcel.Encrypted {
+				color.HiYellow("The parcel is encrypted, %s can list its files but not read them", *parcelShareAuthor)
+			}
+		} else if parcelEncrypt.Happened() {
+			if parcel.Encrypted {
+				color.HiYellow("The parcel is already encrypted.")
+				return
+			}
+			devices, err := ditclient.EncryptParcel(parcel)
+			if err != nil {
+				color.HiRed("ERROR: Failed to encrypt the parcel: %s", err)
+				return
+			}
+			parcel.SetEncrypted()
+			err = ditmaster.SyncStoresToDisk(*OverrideCmdDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(color.CyanString("[-]"), "Encrypted the parcel for devices", color.YellowString(strings.Join(devices, ", ")))
+			color.HiYellow("Run 'dit parcel rewrap' after adding a device so it can read the parcel")
+		} else if parcelRewrap.Happened() {
+			if !parcel.Encrypted {
+				color.HiYellow("The parcel is not encrypted, see 'dit parcel encrypt'.")
+				return
+			}
+			devices, err := ditclient.RewrapParcelKey(parcel)
+			if err != nil {
+				color.HiRed("ERROR: Failed to rewrap the parcel key: %s", err)
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Devices that can read the parcel:", color.YellowString(strings.Join(devices, ", ")))
 		}
 
 	case config.Happened():
@@ -191,9 +308,9 @@ func main() {
 		}
 
 		if syncUp.Happened() {
+			limits := ditclient.DeleteLimits{Force: *syncUpForce, MaxFiles: *syncUpMaxDeletes, MaxPercent: *syncUpMaxDeletePercent}
 			if *syncUpOnlyMaster {
-				ditclient.SyncMasterUp(parcel)
-				fmt.Println(color.CyanString("[-]"), "Synced master file to mirror.")
+				CommitAndPrint(parcel, limits)
 				return
 			}
 			sync_files := make([]ditsync.SyncFile, 0) // list over all possible files to sync
@@ -219,10 +336,22 @@ func main() {
 				}
 				sync_files = append(sync_files, curr)
 			}
-			ditclient.SyncMasterUp(parcel)
-			ditclient.SyncFilesUp(sync_files, parcel, true)
+
+			findings, err := ditsync.ScanSyncFiles(sync_files, parcel.SecretExceptions)
+			if err != nil {
+				log.Fatal("Failed to scan files for secrets: ", err)
+			}
+			if len(findings) > 0 && !*syncUpAllowSecrets {
+				PrintSecretFindings(findings)
+				color.HiYellow("Sync aborted. Use --allow-secrets to upload anyway, or 'dit secrets -a <pattern>' to allow a file.")
+				return
+			}
+			if !ditclient.SyncFilesUp(sync_files, parcel, true) {
+				return
+			}
+			CommitAndPrint(parcel, limits)
 		} else if syncDown.Happened() {
-			ditclient.SyncFilesDown(parcel, *OverrideCmdDir, []string{})
+			ditclient.SyncFilesDown(parcel, *OverrideCmdDir, []string{}, 0)
 			ditmaster.SyncStoresToDisk(*OverrideCmdDir) // save stores to disk
 		} else {
 			fmt.Println(parser.Usage(err))
@@ -293,12 +422,52 @@ func main() {
 			fmt.Println(parser.Usage(err))
 		}
 
+	case secrets.Happened():
+		if !hasDitParcel {
+			color.HiYellow("This directory is not a dit parcel.")
+			return
+		}
+
+		if *secretsAdd != "" {
+			parcel.AddSecretException(*secretsAdd)
+			ditmaster.SyncStoresToDisk(*OverrideCmdDir) // save stores to disk
+			fmt.Println(color.CyanString("[-]"), "Added exception", color.YellowString(*secretsAdd))
+		} else if *secretsRemove != "" {
+			parcel.RemoveSecretException(*secretsRemove)
+			ditmaster.SyncStoresToDisk(*OverrideCmdDir) // save stores to disk
+			fmt.Println(color.CyanString("[-]"), "Removed exception", color.YellowString(*secretsRemove))
+		} else if *secretsList {
+			PrintPreStatus(parcel, "secret exceptions")
+			for _, pattern := range parcel.SecretExceptions {
+				color.Magenta("\t%s ", pattern)
+			}
+		} else if *secretsScan {
+			PrintPreStatus(parcel, "secret scan")
+			all_files := make([]ditsync.SyncFile, 0, len(parcel_files))
+			for _, file := range parcel_files {
+				all_files = append(all_files, ditsync.SyncFile{FilePath: file, IsNew: true})
+			}
+			findings, err := ditsync.ScanSyncFiles(all_files, parcel.SecretExceptions)
+			if err != nil {
+				log.Fatal("Failed to scan files for secrets: ", err)
+			}
+			if len(findings) == 0 {
+				color.Green("\tNo secrets found")
+			}
+			PrintSecretFindings(findings)
+		} else {
+			fmt.Println(parser.Usage(err))
+		}
+
 	case get.Happened():
 		if hasDitParcel {
 			color.HiYellow("This directory is already a dit parcel. Use 'dit sync' to sync files.")
 			return
 		}
 		// parse full repo path
+		if *getRepo == "" {
+			*getRepo = *getRepoArg
+		}
 		author, repoPath := ditclient.ParseFullRepoPath(*getRepo)
 		repoPath = ditclient.CanonicalizeRepoPath(repoPath)
 		if author == "" || repoPath == "" {
@@ -315,7 +484,7 @@ func main() {
 		}
 
 		// get parcel info from mirror
-		netparcel, err := ditclient.GetParcelInfoFromMirror(author, repoPath, mirror)
+		netparcel, err := ditclient.GetParcelInfoFromMirror(author, repoPath, mirror, *getTag)
 		if err != nil {
 			log.Fatal("Failed to get parcel info from mirror: ", err)
 		}
@@ -334,7 +503,7 @@ func main() {
 		}
 
 		// sync files down
-		ditclient.SyncFilesDown(new_parcel, *OverrideCmdDir, files_to_get)
+		ditclient.SyncFilesDown(new_parcel, *OverrideCmdDir, files_to_get, netparcel.SnapshotID)
 		ditmaster.SyncStoresToDisk(*OverrideCmdDir) // save stores to disk
 
 	case master.Happened():
@@ -370,6 +539,298 @@ func main() {
 		} else {
 			fmt.Println(parser.Usage(err))
 		}
+
+	case tag.Happened():
+		if !hasDitParcel {
+			color.HiYellow("This directory is not a dit parcel.")
+			return
+		}
+		if tagCreate.Happened() {
+			snapshot, err := ditclient.CreateTag(parcel, *tagCreateName, int64(*tagCreateSnapshot))
+			if err != nil {
+				color.HiRed("ERROR: Failed to create tag: %s", err)
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Tagged snapshot", color.YellowString("#%d", snapshot), "as", color.GreenString(*tagCreateName))
+		} else if tagList.Happened() {
+			tags, err := ditclient.ListTags(parcel)
+			if err != nil {
+				color.HiRed("ERROR: Failed to list tags: %s", err)
+				return
+			}
+			PrintPreStatus(parcel, "tags")
+			if len(tags) == 0 {
+				color.HiYellow("\tNo tags")
+			}
+			for _, t := range tags {
+				fmt.Println(color.GreenString("\t%-24s", t.Name), color.YellowString("#%-6d", t.SnapshotID), t.Created)
+			}
+		} else if tagDelete.Happened() {
+			err = ditclient.DeleteTag(parcel, *tagDeleteName)
+			if err != nil {
+				color.HiRed("ERROR: Failed to delete tag: %s", err)
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Deleted tag", color.GreenString(*tagDeleteName))
+		}
+
+	case versions.Happened():
+		if !hasDitParcel {
+			color.HiYellow("This directory is not a dit parcel.")
+			return
+		}
+		file := *versionsListFile
+		if versionsGet.Happened() {
+			file = *versionsGetFile
+		}
+		file_path, err := filepath.Rel(*OverrideCmdDir, file)
+		if err != nil {
+			log.Fatal("Failed to get relative path: ", err)
+		}
+
+		if versionsList.Happened() {
+			file_versions, err := ditclient.ListFileVersions(parcel, file_path)
+			if err != nil {
+				color.HiRed("ERROR: Failed to list versions: %s", err)
+				return
+			}
+			PrintPreStatus(parcel, "versions of "+file_path)
+			if len(file_versions) == 0 {
+				color.HiYellow("	No versions on mirror")
+			}
+			current := ditmaster.Stores.Master[file_path]
+			if current != "" {
+				current, err = ditclient.BlobID(parcel, current) // versions of an encrypted parcel are listed by blob ID
+				if err != nil {
+					color.HiYellow("	Could not tell which version is synced: %s", err)
+				}
+			}
+			for _, v := range file_versions {
+				marker := ""
+				if v.Checksum == current {
+					marker = "(synced)"
+				}
+				device := v.Device
+				if device == "" {
+					device = "unknown device"
+				}
+				fmt.Println(color.YellowString("	%6d", v.ID), v.Created, FormatBytes(v.Size), color.CyanString(device), marker)
+			}
+		} else if versionsGet.Happened() {
+			data, err := ditclient.GetFileVersion(parcel, file_path, int64(*versionsGetID))
+			if err != nil {
+				color.HiRed("ERROR: Failed to get version: %s", err)
+				return
+			}
+			out := filepath.Join(*OverrideCmdDir, file_path)
+			if *versionsGetOutput != "" {
+				out = *versionsGetOutput
+			}
+			err = ditclient.WriteFileWithDir(out, data)
+			if err != nil {
+				log.Fatal("Failed to write file: ", err)
+			}
+			fmt.Println(color.CyanString("[-]"), "Restored version", *versionsGetID, "of", color.YellowString(file_path), "to", out)
+		}
+
+	case trash.Happened():
+		if !hasDitParcel {
+			color.HiYellow("This directory is not a dit parcel.")
+			return
+		}
+		if trashRestore.Happened() {
+			file_path, err := filepath.Rel(*OverrideCmdDir, *trashRestoreFile)
+			if err != nil {
+				log.Fatal("Failed to get relative path: ", err)
+			}
+			data, err := ditclient.RestoreFromTrash(parcel, file_path)
+			if err != nil {
+				color.HiRed("ERROR: Failed to restore file: %s", err)
+				return
+			}
+			out := filepath.Join(*OverrideCmdDir, file_path)
+			err = ditclient.WriteFileWithDir(out, data)
+			if err != nil {
+				log.Fatal("Failed to write file: ", err)
+			}
+			checksum, err := ditsync.GetFileChecksum(out)
+			if err != nil {
+				log.Fatal("Failed to get checksum: ", err)
+			}
+			ditmaster.Stores.Master[file_path] = checksum // so the next sync up keeps it
+			ditmaster.SyncStoresToDisk(*OverrideCmdDir)
+			fmt.Println(color.CyanString("[-]"), "Restored", color.YellowString(file_path), "from trash")
+		} else {
+			entries, err := ditclient.ListTrash(parcel)
+			if err != nil {
+				color.HiRed("ERROR: Failed to list trash: %s", err)
+				return
+			}
+			PrintPreStatus(parcel, "trash")
+			if len(entries) == 0 {
+				color.HiYellow("\tTrash is empty")
+			}
+			for _, e := range entries {
+				expires := "kept until restored"
+				if e.Expires != "" {
+					expires = "expires " + e.Expires
+				}
+				fmt.Println(color.YellowString("\t%s", e.Path), "deleted", e.Deleted, FormatBytes(e.Size), color.CyanString(expires))
+			}
+		}
+
+	case agent.Happened():
+		if *agentStop {
+			err = ditclient.StopAgent()
+			if err != nil {
+				color.HiRed("ERROR: %s", err)
+			}
+			return
+		}
+		timeout, err := time.ParseDuration(*agentTimeout)
+		if err != nil {
+			log.Fatal("Invalid timeout: ", err)
+		}
+		err = ditclient.RunAgent(timeout)
+		if err != nil {
+			color.HiRed("ERROR: %s", err)
+		}
+
+	case quota.Happened():
+		author := ditclient.GetDitFromConfig("author")
+		mirror := ditclient.GetDitFromConfig("mirror")
+		if *quotaMirror != "" { // override mirror
+			mirror = *quotaMirror
+		}
+		if author == "" || mirror == "" {
+			color.HiYellow("Author and/or mirror not set, please use 'dit config set'")
+			return
+		}
+		q, err := ditclient.GetQuota(author, mirror)
+		if err != nil {
+			color.HiRed("ERROR: Failed to get quota: %s", err)
+			return
+		}
+		fmt.Println(color.CyanString("[-]"), "Usage for", color.YellowString(author), "on", mirror)
+		PrintQuotaLine("Storage", q.UsedBytes, q.MaxBytes, FormatBytes)
+		PrintQuotaLine("Files", q.UsedFiles, q.MaxFiles, func(n int64) string { return strconv.FormatInt(n, 10) })
+
+	case keys.Happened():
+		if keysLock.Happened() {
+			passphrase, err := ditclient.ReadPassphrase("New passphrase: ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			confirm, err := ditclient.ReadPassphrase("Repeat passphrase: ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			if passphrase == "" || passphrase != confirm {
+				color.HiRed("ERROR: Passphrases are empty or do not match")
+				return
+			}
+			err = ditclient.LockDeviceKey(passphrase)
+			if err != nil {
+				color.HiRed("ERROR: Failed to lock key: %s", err)
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Device key locked, use 'dit agent' to unlock it for a session")
+			return
+		} else if keysUnlock.Happened() {
+			err = ditclient.UnlockDeviceKey()
+			if err != nil {
+				color.HiRed("ERROR: Failed to unlock key: %s", err)
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Removed passphrase from device key")
+			return
+		}
+
+		author := ditclient.GetDitFromConfig("author")
+		mirror := ditclient.GetDitFromConfig("mirror")
+		if *keysMirror != "" { // override mirror
+			mirror = *keysMirror
+		}
+		if author == "" || mirror == "" {
+			color.HiYellow("Author and/or mirror not set, please use 'dit config set'")
+			return
+		}
+
+		if keysShow.Happened() {
+			device, pub, err := ditclient.LoadDevicePublicKey()
+			if err != nil {
+				color.HiYellow(err.Error())
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Device", color.YellowString(device))
+			fmt.Println("   ", ditclient.EncodePublicKey(pub))
+		} else if keysList.Happened() {
+			device, _, _ := ditclient.LoadDevicePublicKey()
+			keys, err := ditclient.ListKeys(author, mirror)
+			if err != nil {
+				color.HiRed("ERROR: Failed to list keys: %s", err)
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Keys for", color.YellowString(author), "on", mirror)
+			for _, key := range keys {
+				current := ""
+				if key.Device == device {
+					current = "(this device)"
+				}
+				if key.Revoked != "" {
+					color.Red("\t%s revoked %s", key.Device, key.Revoked)
+				} else {
+					fmt.Println(color.GreenString("\t%s", key.Device), "added", key.Created, current)
+				}
+			}
+		} else if keysAdd.Happened() {
+			device := *keysAddDevice
+			var pub ed25519.PublicKey
+			if *keysAddPublicKey != "" { // register another device's key
+				if device == "" {
+					log.Fatal("Device name is required when adding a public key")
+				}
+				pub, err = ditclient.DecodePublicKey(*keysAddPublicKey)
+				if err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				current, current_pub, err := ditclient.LoadDevicePublicKey()
+				if err == nil && (device == "" || device == current) {
+					device = current
+					pub = current_pub
+				} else {
+					if device == "" {
+						device = ditclient.DefaultDeviceName()
+					}
+					pub, err = ditclient.CreateDeviceKey(device)
+					if err != nil {
+						log.Fatal("Failed to create device key: ", err)
+					}
+					fmt.Println(color.CyanString("[-]"), "Created key for device", color.YellowString(device))
+				}
+			}
+
+			err = ditclient.RegisterKey(author, mirror, device, pub, *keysAddToken)
+			if err != nil {
+				color.HiRed("ERROR: Failed to register key: %s", err)
+				if *keysAddPublicKey == "" {
+					color.HiYellow("If this author already has keys, run 'dit keys add -d %s -k %s' on an authorized device", device, ditclient.EncodePublicKey(pub))
+				}
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Registered key for device", color.YellowString(device), "on", mirror)
+			if *keysAddPublicKey != "" {
+				color.HiYellow("Run 'dit parcel rewrap' in your encrypted parcels so %s can read them", device)
+			}
+		} else if keysRevoke.Happened() {
+			err = ditclient.RevokeKey(author, mirror, *keysRevokeDevice, *keysRevokeForce)
+			if err != nil {
+				color.HiRed("ERROR: Failed to revoke key: %s", err)
+				return
+			}
+			fmt.Println(color.CyanString("[-]"), "Revoked key for device", color.YellowString(*keysRevokeDevice))
+		}
 	}
 }
 
@@ -378,3 +839,67 @@ func PrintPreStatus(parcel ditmaster.ParcelInfo, action string) {
 	color.Blue("           Mirror %s", parcel.Mirror)
 	fmt.Println("\n    " + action + ":")
 }
+
+func CommitAndPrint(parcel ditmaster.ParcelInfo, limits ditclient.DeleteLimits) {
+	preview, err := ditclient.PreviewCommit(parcel)
+	if err != nil {
+		color.HiRed("ERROR: Failed to publish changes to mirror: %s", err)
+		return
+	}
+	if limits.Exceeded(preview) {
+		color.HiYellow("This sync would remove %d of %d files from the mirror.", preview.Removed, preview.Before)
+		if !ditclient.Confirm("Remove them?") {
+			color.HiYellow("Sync aborted, no changes were published. Use --force to remove the files, or 'dit master list' to check the master record.")
+			return
+		}
+	}
+	snapshot, err := ditclient.CommitParcel(parcel, preview)
+	if err != nil {
+		color.HiRed("ERROR: Failed to publish changes to mirror: %s", err)
+		return
+	}
+	if snapshot.Removed > 0 {
+		color.HiGreen("Removed %d files from mirror", snapshot.Removed)
+	}
+	fmt.Println(color.CyanString("[-]"), "Published snapshot", color.YellowString("#%d", snapshot.ID), fmt.Sprintf("(%d files, %d changed)", snapshot.Files, snapshot.Changed))
+}
+
+func PrintSecretFindings(findings []ditsync.SecretFinding) {
+	for _, finding := range findings {
+		if finding.Line > 0 {
+			color.HiRed("\tSecret: %s:%d (%s)", finding.FilePath, finding.Line, finding.Rule)
+		} else {
+			color.HiRed("\tSecret: %s (%s)", finding.FilePath, finding.Rule)
+		}
+	}
+}
+
+func PrintQuotaLine(label string, used int64, max int64, format func(int64) string) {
+	if max == 0 {
+		fmt.Printf("\t%-8s %s (unlimited)\n", label+":", format(used))
+		return
+	}
+	percent := float64(used) / float64(max) * 100
+	line := fmt.Sprintf("\t%-8s %s of %s (%.0f%%)", label+":", format(used), format(max), percent)
+	if used >= max {
+		color.HiRed("%s", line)
+	} else if percent >= 90 {
+		color.HiYellow("%s", line)
+	} else {
+		fmt.Println(line)
+	}
+}
+
+func FormatBytes(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.2f %s", size, units[i])
+}
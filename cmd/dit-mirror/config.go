@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/TheVoxcraft/dit/pkg/ditmirror"
+	"github.com/akamensky/argparse"
+)
+
+// The config file given with --config is TOML, every key is the long name of a mirror flag:
+//
+//	db = "/var/lib/dit/dit.db"
+//	storage = "s3"
+//	s3-bucket = "dit"
+//	quota-bytes = "10GB"
+//	keep-snapshots = 50
+//	admin-secret = "..."
+//
+// A flag given on the command line overrides the file, settings missing from both keep the flag default.
+// On SIGHUP the file is read again and the settings in reloadableSettings take effect without a restart.
+
+var reloadableSettings = map[string]bool{
+	"quota-bytes": true, "quota-files": true, "keep-snapshots": true, "keep-versions": true, "trash-days": true,
+	"max-deletes": true, "max-delete-percent": true,
+	"replication-secret": true, "admin-secret": true, "log-level": true,
+}
+
+// SettingFlags holds the flag values Settings are built from
+type SettingFlags struct {
+	QuotaBytes        *string
+	QuotaFiles        *int
+	KeepSnapshots     *int
+	KeepVersions      *int
+	TrashDays         *int
+	MaxDeletes        *int
+	MaxDeletePercent  *int
+	ReplicationSecret *string
+	AdminSecret       *string
+	LogLevel          *string
+}
+
+// NewSettings validates the flag values, secrets fall back to the environment
+func NewSettings(flags SettingFlags) (ditmirror.Settings, slog.Level, error) {
+	var s ditmirror.Settings
+	maxBytes, err := ditmirror.ParseSize(*flags.QuotaBytes)
+	if err != nil || *flags.QuotaFiles < 0 {
+		return s, 0, fmt.Errorf("invalid default quota: %s %d", *flags.QuotaBytes, *flags.QuotaFiles)
+	}
+	if *flags.KeepVersions < 0 {
+		return s, 0, fmt.Errorf("invalid version retention: %d", *flags.KeepVersions)
+	}
+	if *flags.KeepSnapshots < 0 {
+		return s, 0, fmt.Errorf("invalid snapshot retention: %d", *flags.KeepSnapshots)
+	}
+	if *flags.TrashDays < 0 {
+		return s, 0, fmt.Errorf("invalid trash retention: %d", *flags.TrashDays)
+	}
+	if *flags.MaxDeletes < 0 || *flags.MaxDeletePercent < 0 || *flags.MaxDeletePercent > 100 {
+		return s, 0, fmt.Errorf("invalid deletion limit: %d files, %d%%", *flags.MaxDeletes, *flags.MaxDeletePercent)
+	}
+	level, err := ParseLogLevel(*flags.LogLevel)
+	if err != nil {
+		return s, 0, err
+	}
+	s = ditmirror.Settings{
+		DefaultQuota:      ditmirror.Quota{MaxBytes: maxBytes, MaxFiles: int64(*flags.QuotaFiles)},
+		VersionRetention:  *flags.KeepVersions,
+		SnapshotRetention: *flags.KeepSnapshots,
+		TrashRetention:    *flags.TrashDays,
+		MaxDeletes:        *flags.MaxDeletes,
+		MaxDeletePercent:  *flags.MaxDeletePercent,
+		ReplicationSecret: *flags.ReplicationSecret,
+		AdminSecret:       *flags.AdminSecret,
+	}
+	if s.ReplicationSecret == "" {
+		s.ReplicationSecret = os.Getenv("DIT_REPLICATION_SECRET")
+	}
+	if s.AdminSecret == "" {
+		s.AdminSecret = os.Getenv("DIT_ADMIN_SECRET")
+	}
+	return s, level, nil
+}
+
+// Config applies a config file to the flags of the commands it covers
+type Config struct {
+	Path  string
+	known map[string]bool         // every flag that can be set in the file
+	flags map[string]argparse.Arg // the ones not given on the command line
+}
+
+// NewConfig collects the flags of commands that can be set from a config file, without the ones given on the
+// command line
+func NewConfig(path string, commands ...*argparse.Command) *Config {
+	config := &Config{Path: path, known: make(map[string]bool), flags: make(map[string]argparse.Arg)}
+	for _, command := range commands {
+		for _, arg := range command.GetArgs() {
+			name := arg.GetLname()
+			if name == "" || name == "help" || name == "config" || arg.GetPositional() {
+				continue
+			}
+			config.known[name] = true
+			if !arg.GetParsed() {
+				config.flags[name] = arg
+			}
+		}
+	}
+	return config
+}
+
+// Load reads the config file and sets every flag that was not given on the command line, to the value from the
+// file or back to its default. It returns the names of the settings whose value changed.
+func (c *Config) Load() ([]string, error) {
+	values := make(map[string]interface{})
+	meta, err := toml.DecodeFile(c.Path, &values)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", c.Path, err)
+	}
+	problems := make([]string, 0)
+	for _, key := range meta.Keys() {
+		if len(key) > 1 {
+			continue // reported with its table
+		}
+		if !c.known[key[0]] {
+			problems = append(problems, fmt.Sprintf("unknown setting %q", key.String()))
+		}
+	}
+
+	converted := make(map[string]interface{})
+	for name, arg := range c.flags {
+		value, inFile := values[name]
+		if !inFile {
+			value = arg.GetOpts().Default
+			if value == nil {
+				continue
+			}
+		}
+		converted[name], err = flagValue(arg, value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("config %s: %s", c.Path, strings.Join(problems, ", "))
+	}
+
+	changed := make([]string, 0)
+	for name, value := range converted {
+		switch target := c.flags[name].GetResult().(type) {
+		case *string:
+			if *target != value.(string) {
+				changed = append(changed, name)
+			}
+			*target = value.(string)
+		case *int:
+			if *target != value.(int) {
+				changed = append(changed, name)
+			}
+			*target = value.(int)
+		case *bool:
+			if *target != value.(bool) {
+				changed = append(changed, name)
+			}
+			*target = value.(bool)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// flagValue converts a value from the config file to the type argparse returned for the flag
+func flagValue(arg argparse.Arg, value interface{}) (interface{}, error) {
+	switch arg.GetResult().(type) {
+	case *string:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, errors.New("must be a string")
+	case *int:
+		switch v := value.(type) {
+		case int64:
+			return int(v), nil
+		case int:
+			return v, nil
+		}
+		return nil, errors.New("must be an integer")
+	case *bool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.New("must be true or false")
+	}
+	return nil, errors.New("cannot be set in a config file")
+}
+
+// ReloadOnHangup reloads the config file on SIGHUP and applies the settings that can change while serving
+func ReloadOnHangup(config *Config, flags SettingFlags, server *ditmirror.Server) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if config == nil {
+			slog.Warn("ignoring SIGHUP, the mirror was started without --config")
+			continue
+		}
+		changed, err := config.Load()
+		if err != nil {
+			slog.Error("config reload failed, keeping the current settings", "err", err)
+			continue
+		}
+		s, level, err := NewSettings(flags)
+		if err != nil {
+			slog.Error("config reload failed, keeping the current settings", "err", err)
+			continue
+		}
+		server.SetSettings(s)
+		logLevel.Set(level)
+
+		restart := make([]string, 0)
+		for _, name := range changed {
+			if !reloadableSettings[name] {
+				restart = append(restart, name)
+			}
+		}
+		slog.Info("reloaded config", "path", config.Path, "changed", strings.Join(changed, ","))
+		if len(restart) > 0 {
+			slog.Warn("restart the mirror to apply the changed settings", "settings", strings.Join(restart, ","))
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// The mirror logs with log/slog to stderr, as text or JSON, one line per request plus startup, shutdown and
+// background work.
+
+var logLevel = new(slog.LevelVar) // changes on SIGHUP without replacing the handler
+
+// SetupLogging makes a logger writing format (text or json) to w the default
+func SetupLogging(format string, w io.Writer) error {
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, options)))
+	default:
+		return errors.New("invalid log format: " + format + ", use text or json")
+	}
+	return nil
+}
+
+// ParseLogLevel parses debug, info, warn or error
+func ParseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return l, errors.New("invalid log level: " + level + ", use debug, info, warn or error")
+	}
+	return l, nil
+}
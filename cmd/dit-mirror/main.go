@@ -1,19 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/TheVoxcraft/dit/pkg/ditmaster"
-	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditmirror"
 	"github.com/akamensky/argparse"
 	"github.com/fatih/color"
 	"github.com/mattn/go-sqlite3"
@@ -26,10 +24,102 @@ const (
 func main() {
 	parser := argparse.NewParser("dit-mirror", "Mirror server for dit clients")
 
-	port := parser.Int("p", "port", &argparse.Options{Required: false, Help: "Port to listen on", Default: 3216})
-	bind := parser.String("b", "bind", &argparse.Options{Required: false, Help: "Address to bind to", Default: "127.0.0.1"})
+	configPath := parser.String("c", "config", &argparse.Options{Required: false, Help: "TOML file with mirror settings, keyed by flag name, flags override it", Default: ""})
 	db_path := parser.String("d", "db", &argparse.Options{Required: false, Help: "Path to the database", Default: "./dit.db"})
-	err := parser.Parse(os.Args)
+	storage := parser.Selector("", "storage", []string{"fs", "s3"}, &argparse.Options{Required: false, Help: "Where to store file data: fs (directory) or s3 (S3-compatible bucket)", Default: "fs"})
+	blobs_path := parser.String("", "blobs", &argparse.Options{Required: false, Help: "Directory to store file data in (fs storage)", Default: "./blobs"})
+	s3Endpoint := parser.String("", "s3-endpoint", &argparse.Options{Required: false, Help: "S3 endpoint, e.g. http://localhost:9000", Default: ""})
+	s3Bucket := parser.String("", "s3-bucket", &argparse.Options{Required: false, Help: "S3 bucket for file data", Default: ""})
+	s3Region := parser.String("", "s3-region", &argparse.Options{Required: false, Help: "S3 region", Default: "us-east-1"})
+	s3Prefix := parser.String("", "s3-prefix", &argparse.Options{Required: false, Help: "Prefix for object keys in the bucket", Default: ""})
+	s3AccessKey := parser.String("", "s3-access-key", &argparse.Options{Required: false, Help: "S3 access key, defaults to $AWS_ACCESS_KEY_ID", Default: ""})
+	s3SecretKey := parser.String("", "s3-secret-key", &argparse.Options{Required: false, Help: "S3 secret key, defaults to $AWS_SECRET_ACCESS_KEY", Default: ""})
+	quotaBytes := parser.String("", "quota-bytes", &argparse.Options{Required: false, Help: "Default storage quota per author, e.g. 10GB, 0 for unlimited", Default: "0"})
+	quotaFiles := parser.Int("", "quota-files", &argparse.Options{Required: false, Help: "Default file count quota per author, 0 for unlimited", Default: 0})
+	keepSnapshots := parser.Int("", "keep-snapshots", &argparse.Options{Required: false, Help: "Number of snapshots to keep per parcel, 0 to keep all", Default: 20})
+	keepVersions := parser.Int("", "keep-versions", &argparse.Options{Required: false, Help: "Number of versions to keep per file, 0 to keep all", Default: 10})
+	trashDays := parser.Int("", "trash-days", &argparse.Options{Required: false, Help: "Days deleted files are kept in the trash, 0 to keep them until restored", Default: 30})
+	maxDeletes := parser.Int("", "max-deletes", &argparse.Options{Required: false, Help: "Files a sync from a client that does not confirm removals may remove from a parcel, 0 for no limit", Default: 20})
+	maxDeletePercent := parser.Int("", "max-delete-percent", &argparse.Options{Required: false, Help: "Percent of a parcel a sync from a client that does not confirm removals may remove, 0 for no limit", Default: 50})
+	logFormat := parser.Selector("", "log-format", []string{"text", "json"}, &argparse.Options{Required: false, Help: "Log format: text or json, logs go to stderr", Default: "text"})
+	logLevelFlag := parser.String("", "log-level", &argparse.Options{Required: false, Help: "Least important log level to write: debug, info, warn or error", Default: "info"})
+	gcGrace := parser.String("", "gc-grace", &argparse.Options{Required: false, Help: "Keep unreferenced file data younger than this, it may be staged for a commit", Default: "1h"})
+
+	serve := parser.NewCommand("serve", "Serve the mirror (default)")
+	port := serve.Int("p", "port", &argparse.Options{Required: false, Help: "Port to listen on", Default: 3216})
+	bind := serve.String("b", "bind", &argparse.Options{Required: false, Help: "Address to bind to", Default: "127.0.0.1"})
+	gcInterval := serve.String("", "gc-interval", &argparse.Options{Required: false, Help: "Collect garbage in the background this often, e.g. 24h, 0 to disable", Default: "0"})
+	replSecret := serve.String("", "replication-secret", &argparse.Options{Required: false, Help: "Secret shared with mirrors replicating from or to this one, defaults to $DIT_REPLICATION_SECRET. Requests are signed with it, but parcel data is sent unencrypted, replicate over a private network or a tunnel", Default: ""})
+	metricsAddr := serve.String("", "metrics", &argparse.Options{Required: false, Help: "Serve Prometheus metrics at /metrics and a health check at /health over HTTP at this address, e.g. 127.0.0.1:9216, disabled if empty", Default: ""})
+	shutdownTimeout := serve.String("", "shutdown-timeout", &argparse.Options{Required: false, Help: "How long requests in flight get to finish on SIGINT or SIGTERM", Default: "30s"})
+	replInterval := serve.String("", "replication-interval", &argparse.Options{Required: false, Help: "How often a follower pulls changes from its leader", Default: "5s"})
+	serveAdminSecret := serve.String("", "admin-secret", &argparse.Options{Required: false, Help: "Secret for dit-mirror admin --mirror, defaults to $DIT_ADMIN_SECRET, remote administration is disabled without one", Default: ""})
+
+	quota := parser.NewCommand("quota", "Manage storage quotas per author")
+	quota.NewCommand("list", "Show storage usage and quotas per author")
+	quotaSet := quota.NewCommand("set", "Set the quota of an author")
+	quotaSetAuthor := quotaSet.StringPositional(&argparse.Options{Required: true, Help: "Author to set the quota for"})
+	quotaSetBytes := quotaSet.String("b", "bytes", &argparse.Options{Required: false, Help: "Storage quota, e.g. 500MB, 0 for unlimited", Default: "0"})
+	quotaSetFiles := quotaSet.Int("f", "files", &argparse.Options{Required: false, Help: "File count quota, 0 for unlimited", Default: 0})
+
+	backup := parser.NewCommand("backup", "Write an archive of the database and file data, safe while the mirror is serving")
+	backupOut := backup.String("o", "out", &argparse.Options{Required: true, Help: "Archive to write, e.g. mirror-full.tar"})
+	backupBase := backup.String("i", "incremental", &argparse.Options{Required: false, Help: "Only include file data that is not in this earlier backup", Default: ""})
+
+	restore := parser.NewCommand("restore", "Rebuild a mirror at --db and --blobs from a backup archive")
+	restoreArchive := restore.StringPositional(&argparse.Options{Required: true, Help: "Archive to restore, the backups it is incremental to must be in the same directory"})
+	restoreDryRun := restore.Flag("n", "dry-run", &argparse.Options{Required: false, Help: "Only verify the archive and the backups it is incremental to"})
+
+	replication := parser.NewCommand("replication", "Follow another mirror, or show and change the replication role")
+	replication.NewCommand("status", "Show the role of this mirror and how far it is behind its leader")
+	replicationFollow := replication.NewCommand("follow", "Make this mirror a read-only follower of another mirror")
+	replicationFollowLeader := replicationFollow.StringPositional(&argparse.Options{Required: true, Help: "Address of the leader, e.g. mirror.example.com:3216"})
+	replicationPromote := replication.NewCommand("promote", "Stop following the leader and accept writes")
+
+	admin := parser.NewCommand("admin", "Inspect and repair authors and parcels, on the database or a running mirror")
+	adminMirror := admin.String("m", "mirror", &argparse.Options{Required: false, Help: "Run the command on a running mirror instead of the database, e.g. localhost:3216", Default: ""})
+	adminSecretFlag := admin.String("", "admin-secret", &argparse.Options{Required: false, Help: "Admin secret of the mirror, defaults to $DIT_ADMIN_SECRET", Default: ""})
+	adminAuthors := admin.NewCommand("authors", "List authors with their parcels, files, stored size and keys")
+	adminParcels := admin.NewCommand("parcels", "List parcels with their files, size and latest snapshot")
+	adminParcelsAuthor := adminParcels.String("a", "author", &argparse.Options{Required: false, Help: "Only list parcels of this author", Default: ""})
+	adminLargest := admin.NewCommand("largest", "Show the largest files on the mirror")
+	adminLargestAuthor := adminLargest.String("a", "author", &argparse.Options{Required: false, Help: "Only show files of this author", Default: ""})
+	adminLargestLimit := adminLargest.Int("n", "limit", &argparse.Options{Required: false, Help: "Number of files to show", Default: 20})
+	adminDelete := admin.NewCommand("delete-parcel", "Delete a parcel with its history, gc reclaims the file data")
+	adminDeleteParcel := adminDelete.StringPositional(&argparse.Options{Required: true, Help: "Parcel to delete, format: @author/repo/path"})
+	adminRename := admin.NewCommand("rename-parcel", "Give a parcel a new path")
+	adminRenameParcel := adminRename.StringPositional(&argparse.Options{Required: true, Help: "Parcel to rename, format: @author/repo/path"})
+	adminRenameTarget := adminRename.StringPositional(&argparse.Options{Required: true, Help: "New path, format: /repo/path/"})
+	adminMove := admin.NewCommand("move-parcel", "Move a parcel to another author")
+	adminMoveParcel := adminMove.StringPositional(&argparse.Options{Required: true, Help: "Parcel to move, format: @author/repo/path"})
+	adminMoveTarget := adminMove.StringPositional(&argparse.Options{Required: true, Help: "Author to move the parcel to"})
+	adminResetKeys := admin.NewCommand("reset-keys", "Remove every key of an author so they can register a new first key")
+	adminResetKeysAuthor := adminResetKeys.StringPositional(&argparse.Options{Required: true, Help: "Author whose keys to remove"})
+	adminKeyToken := admin.NewCommand("key-token", "Issue a one-time token an author with parcels but no keys needs to register a first key")
+	adminKeyTokenAuthor := adminKeyToken.StringPositional(&argparse.Options{Required: true, Help: "Author the token is for"})
+
+	gc := parser.NewCommand("gc", "Delete expired versions and snapshots and file data nothing references")
+	gcDryRun := gc.Flag("n", "dry-run", &argparse.Options{Required: false, Help: "Only report what would be deleted"})
+
+	migrate := parser.NewCommand("migrate", "Upgrade the database schema, this also happens on startup")
+	migrateDryRun := migrate.Flag("n", "dry-run", &argparse.Options{Required: false, Help: "Only show pending migrations"})
+
+	audit := parser.NewCommand("audit", "Query the audit log of mirror mutations")
+	auditAuthor := audit.String("a", "author", &argparse.Options{Required: false, Help: "Only show events for this author"})
+	auditParcel := audit.String("r", "parcel", &argparse.Options{Required: false, Help: "Only show events for this parcel. format: /repo/path/"})
+	auditPath := audit.String("f", "file", &argparse.Options{Required: false, Help: "Only show events for this file path"})
+	auditEvent := audit.String("e", "event", &argparse.Options{Required: false, Help: "Only show events of this type (sync, delete, key-add, key-revoke, auth-fail, visibility, share, unshare, tag, untag, restore, replicate, parcel-key, parcel-delete, parcel-move, key-reset, key-token)"})
+	auditSince := audit.String("s", "since", &argparse.Options{Required: false, Help: "Only show events since a duration ago (24h) or a date (2006-01-02)"})
+	auditLimit := audit.Int("n", "limit", &argparse.Options{Required: false, Help: "Maximum number of events to show, 0 for all", Default: 50})
+
+	args := os.Args
+	if i := commandIndex(parser, args); i > 1 {
+		// the parser only finds a command in the first position, global flags given before it go after it
+		args = append(append([]string{args[0]}, args[i:]...), args[1:i]...)
+	} else if i < 0 && !hasHelpFlag(args[1:]) {
+		args = append([]string{args[0], "serve"}, args[1:]...) // no command given, default to serve
+	}
+	err := parser.Parse(args)
 	if err != nil {
 		// In case of error print error and print usage
 		// This can also be done by passing -h or --help flags
@@ -37,289 +127,336 @@ func main() {
 		return
 	}
 
-	fmt.Println("dit-mirror version:", DITMIRROR_VERSION)
-	sqlite_version, _, _ := sqlite3.Version() // this is needed to import and initialize the sqlite3 package
-	fmt.Println("SQLite version:", sqlite_version)
-	ensureSQLiteDB(*db_path)
-
-	l, err := net.Listen("tcp", *bind+":"+strconv.Itoa(*port))
+	var config *Config
+	if *configPath != "" {
+		config = NewConfig(*configPath, &parser.Command, serve)
+		_, err = config.Load()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	settingFlags := SettingFlags{
+		QuotaBytes:        quotaBytes,
+		QuotaFiles:        quotaFiles,
+		KeepSnapshots:     keepSnapshots,
+		KeepVersions:      keepVersions,
+		TrashDays:         trashDays,
+		MaxDeletes:        maxDeletes,
+		MaxDeletePercent:  maxDeletePercent,
+		ReplicationSecret: replSecret,
+		AdminSecret:       serveAdminSecret,
+		LogLevel:          logLevelFlag,
+	}
+	initialSettings, level, err := NewSettings(settingFlags)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer l.Close()
-
-	fmt.Println("Loading database:", *db_path)
-	db, err := sql.Open("sqlite3", *db_path)
+	logLevel.Set(level)
+	err = SetupLogging(*logFormat, os.Stderr)
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		return
+	}
+	if *storage != "fs" && *storage != "s3" {
+		fmt.Println("invalid storage:", *storage+", use fs or s3")
+		return
 	}
-	defer db.Close()
-
-	color.Green("\n * Serving dit-mirror on port: %d", *port)
 
-	for {
-		c, err := l.Accept()
+	var adminCmd ditmirror.AdminCommand
+	if admin.Happened() {
+		switch {
+		case adminAuthors.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "authors"}
+		case adminParcels.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "parcels", Author: *adminParcelsAuthor}
+		case adminLargest.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "largest", Author: *adminLargestAuthor, Limit: *adminLargestLimit}
+		case adminDelete.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "delete-parcel"}
+			adminCmd.Author, adminCmd.Parcel, err = ditmirror.ParseParcelArg(*adminDeleteParcel)
+		case adminRename.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "rename-parcel"}
+			adminCmd.Author, adminCmd.Parcel, err = ditmirror.ParseParcelArg(*adminRenameParcel)
+			if err == nil {
+				adminCmd.Target, err = ditmirror.CanonicalParcelPath(*adminRenameTarget)
+			}
+		case adminMove.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "move-parcel", Target: strings.TrimPrefix(*adminMoveTarget, "@")}
+			adminCmd.Author, adminCmd.Parcel, err = ditmirror.ParseParcelArg(*adminMoveParcel)
+		case adminResetKeys.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "reset-keys", Author: strings.TrimPrefix(*adminResetKeysAuthor, "@")}
+		case adminKeyToken.Happened():
+			adminCmd = ditmirror.AdminCommand{Name: "key-token", Author: strings.TrimPrefix(*adminKeyTokenAuthor, "@")}
+		}
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		go handleConnection(c, db)
+		if *adminMirror != "" { // nothing local is touched
+			secret := *adminSecretFlag
+			if secret == "" {
+				secret = os.Getenv("DIT_ADMIN_SECRET")
+			}
+			out, err := ditmirror.SendAdminCommand(*adminMirror, secret, adminCmd)
+			if err != nil {
+				fmt.Println("admin error:", err)
+				return
+			}
+			fmt.Print(out)
+			return
+		}
 	}
-}
-
-func handleConnection(c net.Conn, db *sql.DB) {
-	fmt.Printf("connection from %s\n", c.RemoteAddr().String())
-	defer c.Close()
 
-	dec := gob.NewDecoder(c)
-	msg := &ditnet.ClientMessage{}
-	err := dec.Decode(msg)
+	var blobs ditmirror.BlobStore
+	if *storage == "s3" {
+		config := ditmirror.S3Config{
+			Endpoint:  *s3Endpoint,
+			Bucket:    *s3Bucket,
+			Region:    *s3Region,
+			Prefix:    *s3Prefix,
+			AccessKey: *s3AccessKey,
+			SecretKey: *s3SecretKey,
+		}
+		if config.AccessKey == "" {
+			config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if config.SecretKey == "" {
+			config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		blobs, err = ditmirror.NewS3BlobStore(config)
+	} else {
+		blobs, err = ditmirror.NewFSBlobStore(*blobs_path)
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "recv error:", err)
+		fmt.Println("Failed to open blob store:", err)
 		return
 	}
 
-	if msg.MessageType == ditnet.MSG_SYNC_FILE {
-		fmt.Println(color.YellowString("@"+msg.OriginAuthor)+msg.ParcelPath, "~", msg.Message)
-
-		SyncFileToDB(db, msg.OriginAuthor, msg.ParcelPath, msg.Message, msg.Message2, msg.Data, msg.IsGZIP)
-
-		success := ditnet.ServerMessage{
-			MessageType: ditnet.MSG_SUCCESS,
-			Message:     "OK",
-		}
-		enc := gob.NewEncoder(c)
-		err = enc.Encode(success)
+	if restore.Happened() { // before the database is opened, which would create it
+		restored, err := ditmirror.Restore(*restoreArchive, *db_path, blobs, *restoreDryRun)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "senc error:", err)
+			fmt.Println("restore failed:", err)
 			return
 		}
-	} else if msg.MessageType == ditnet.MSG_GET_PARCEL {
-		fmt.Println("GET_PARCEL", color.YellowString("@"+msg.OriginAuthor)+msg.ParcelPath)
-		netparcel, err := GetParcelFiles(db, msg.OriginAuthor, msg.ParcelPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "db error:", err)
+		if *restoreDryRun {
+			fmt.Println(color.CyanString("[restore]"), *restoreArchive, "is intact,", restored, "blobs verified")
 			return
 		}
+		fmt.Println(color.CyanString("[restore]"), "Restored database to", *db_path, "and", restored, "blobs")
+		return
+	}
+
+	db, err := sql.Open("sqlite3", *db_path)
+	if err != nil {
+		fmt.Println("Failed to open database:", err)
+		return
+	}
+	defer db.Close()
 
-		// gob encode nparcel to bytes
-		var parcelBytes bytes.Buffer
-		enc := gob.NewEncoder(&parcelBytes)
-		err = enc.Encode(netparcel)
+	if migrate.Happened() {
+		if *migrateDryRun {
+			err = ditmirror.PrintPendingMigrations(db)
+		} else {
+			err = ditmirror.MigrateDB(db, *db_path, blobs)
+		}
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "gob encode error:", err)
-			return
+			fmt.Println(err)
 		}
+		return
+	}
+	err = ditmirror.MigrateDB(db, *db_path, blobs)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-		parcel_msg := ditnet.ServerMessage{
-			MessageType: ditnet.MSG_PARCEL,
-			Message:     "@" + msg.OriginAuthor + msg.ParcelPath,
-			Data:        parcelBytes.Bytes(),
-		}
-		enc = gob.NewEncoder(c)
-		err = enc.Encode(parcel_msg)
+	if backup.Happened() {
+		report, err := ditmirror.Backup(db, blobs, *backupOut, *backupBase)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "send error:", err)
+			fmt.Println("backup failed:", err)
 			return
 		}
+		ditmirror.PrintBackupReport(report, *backupOut)
+		return
+	}
 
-	} else if msg.MessageType == ditnet.MSG_GET_FILE {
-		fmt.Println("GET_FILE", color.YellowString("@"+msg.OriginAuthor)+msg.ParcelPath, "["+msg.Message+"]")
-		filedata, gzip, err := GetFile(db, msg.OriginAuthor, msg.ParcelPath, msg.Message)
+	grace, err := time.ParseDuration(*gcGrace)
+	if err != nil || grace < 0 {
+		fmt.Println("invalid gc grace period:", *gcGrace)
+		return
+	}
+	if gc.Happened() {
+		report, err := ditmirror.RunGC(db, blobs, &initialSettings, grace, *gcDryRun)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "db error:", err)
+			fmt.Println("gc error:", err)
 			return
 		}
+		ditmirror.PrintGCReport(report, *gcDryRun)
+		return
+	}
 
-		file_msg := ditnet.ServerMessage{
-			MessageType: ditnet.MSG_FILE,
-			Message:     msg.Message,
-			Data:        filedata,
-			IsGZIP:      gzip,
-		}
-		enc := gob.NewEncoder(c)
-		err = enc.Encode(file_msg)
+	if audit.Happened() {
+		since, err := ditmirror.ParseSince(*auditSince)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "send error:", err)
+			fmt.Println(err)
 			return
 		}
-	} else if msg.MessageType == ditnet.MSG_SYNC_MASTER {
-		fmt.Println("SYNC_MASTER", color.YellowString("@"+msg.OriginAuthor)+msg.ParcelPath)
-		// decode to netmaster
-		var netmaster ditnet.NetMaster
-		dec := gob.NewDecoder(bytes.NewReader(msg.Data))
-		err := dec.Decode(&netmaster)
+		entries, err := ditmirror.QueryAudit(db, ditmirror.AuditFilter{
+			Author: *auditAuthor,
+			Parcel: *auditParcel,
+			Path:   *auditPath,
+			Event:  *auditEvent,
+			Since:  since,
+			Limit:  *auditLimit,
+		})
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "gob decode error:", err)
+			fmt.Println("audit query error:", err)
 			return
 		}
+		ditmirror.PrintAudit(entries)
+		return
+	}
 
-		removed := RemoveFilesNotInMaster(db, msg.OriginAuthor, msg.ParcelPath, netmaster.Master)
-		removed_str := strconv.Itoa(removed)
-		success := ditnet.ServerMessage{
-			MessageType: ditnet.MSG_SUCCESS,
-			Message:     removed_str,
+	if replication.Happened() {
+		if replicationFollow.Happened() {
+			err = ditmirror.FollowMirror(db, *replicationFollowLeader)
+			if err != nil {
+				fmt.Println("db error:", err)
+				return
+			}
+			fmt.Println("Following", color.YellowString(*replicationFollowLeader)+", clients can only read from this mirror until it is promoted")
+			return
+		} else if replicationPromote.Happened() {
+			leader, err := ditmirror.PromoteMirror(db)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Println("Stopped following", color.YellowString(leader)+", this mirror now accepts writes")
+			return
 		}
-		enc := gob.NewEncoder(c)
-		err = enc.Encode(success)
+		err = ditmirror.PrintReplicationStatus(db)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "send error:", err)
-			return
+			fmt.Println("db error:", err)
 		}
-
-	} else {
-		fmt.Println("unknown message type:", msg.MessageType)
-	}
-}
-
-func RemoveFilesNotInMaster(db *sql.DB, author string, parcelpath string, master map[string]string) int {
-	author = strings.TrimPrefix(author, "@")
-	// for each row in the database, check if it is in the master
-	// if it doesn't, delete it
-	rows, err := db.Query("SELECT path, checksum FROM files WHERE author=? AND parcel=?", author, parcelpath)
-	if err != nil {
-		fmt.Println(err)
-		return 0
-	}
-	defer rows.Close()
-
-	removed := 0
-
-	del_tx, err := db.Begin()
-	if err != nil {
-		fmt.Println("del_tx begin error:", err)
-		return 0
+		return
 	}
 
-	for rows.Next() {
-		var path string
-		var checksum string
-		err = rows.Scan(&path, &checksum)
+	if admin.Happened() {
+		err = ditmirror.RunAdmin(db, os.Stdout, adminCmd, "local")
 		if err != nil {
-			fmt.Println(err)
-			return removed
+			fmt.Println("admin error:", err)
 		}
+		return
+	}
 
-		// check if the file is in the master
-		if master[path] == "" {
-			// if not, delete it
-			fmt.Println("DEL", path)
-			_, err = del_tx.Exec("DELETE FROM files WHERE path=? AND checksum=?", path, checksum)
+	if quota.Happened() {
+		if quotaSet.Happened() {
+			maxBytes, err := ditmirror.ParseSize(*quotaSetBytes)
+			if err != nil || *quotaSetFiles < 0 {
+				fmt.Println("invalid quota:", *quotaSetBytes, *quotaSetFiles)
+				return
+			}
+			author := strings.TrimPrefix(*quotaSetAuthor, "@")
+			err = ditmirror.SetQuota(db, author, ditmirror.Quota{MaxBytes: maxBytes, MaxFiles: int64(*quotaSetFiles)})
 			if err != nil {
-				fmt.Println("DEL_TX ERROR", err)
-				return removed
+				fmt.Println("db error:", err)
+				return
 			}
-			removed++
+			fmt.Println("Set quota for", color.YellowString("@"+author))
+			return
+		}
+		err = ditmirror.PrintQuotas(db, &initialSettings)
+		if err != nil {
+			fmt.Println("db error:", err)
 		}
+		return
 	}
-	err = del_tx.Commit()
-	if err != nil {
-		fmt.Println("del_tx commit error:", err)
+
+	interval, err := time.ParseDuration(*gcInterval)
+	if err != nil || interval < 0 {
+		fmt.Println("invalid gc interval:", *gcInterval)
+		return
+	}
+	replicationInterval, err := time.ParseDuration(*replInterval)
+	if err != nil || replicationInterval <= 0 {
+		fmt.Println("invalid replication interval:", *replInterval)
+		return
+	}
+	drainTimeout, err := time.ParseDuration(*shutdownTimeout)
+	if err != nil || drainTimeout < 0 {
+		fmt.Println("invalid shutdown timeout:", *shutdownTimeout)
+		return
 	}
-	return removed
-}
 
-func GetParcelFiles(db *sql.DB, author string, parcel string) (ditnet.NetParcel, error) {
-	author = strings.TrimPrefix(author, "@")
-	rows, err := db.Query("SELECT * FROM files WHERE author=? AND parcel=?", author, parcel)
+	server, err := ditmirror.NewServer(ditmirror.Options{
+		DB:                  db,
+		DBPath:              *db_path,
+		Blobs:               blobs,
+		Settings:            &initialSettings,
+		GCInterval:          interval,
+		GCGrace:             grace,
+		ReplicationInterval: replicationInterval,
+	})
 	if err != nil {
-		return ditnet.NetParcel{}, err
-	}
-	defer rows.Close()
-
-	filePaths := make([]string, 0)
-
-	for rows.Next() {
-		var id int
-		var author string
-		var repopath string
-		var filepath string
-		var checksum string
-		var data []byte
-		var isGZIP bool
-		var created string
-		var last_sync string
-		err = rows.Scan(&id, &author, &repopath, &filepath, &checksum, &data, &isGZIP, &created, &last_sync)
-		if err != nil {
-			return ditnet.NetParcel{}, err
-		}
-		filePaths = append(filePaths, filepath)
+		fmt.Println(err)
+		return
 	}
 
-	netparcel := ditnet.NetParcel{
-		Info:      ditmaster.ParcelInfo{Author: author, RepoPath: parcel},
-		FilePaths: filePaths,
+	sqlite_version, _, _ := sqlite3.Version()
+	slog.Info("starting dit-mirror", "version", DITMIRROR_VERSION, "sqlite", sqlite_version, "db", *db_path, "config", *configPath)
+
+	l, err := net.Listen("tcp", *bind+":"+strconv.Itoa(*port))
+	if err != nil {
+		slog.Error("failed to listen", "err", err)
+		return
 	}
 
-	return netparcel, nil
-}
+	stopped := make(chan struct{})
+	go func() {
+		ShutdownOnSignal(server, drainTimeout)
+		close(stopped)
+	}()
+	go ReloadOnHangup(config, settingFlags, server)
+	if *metricsAddr != "" {
+		go ServeMetrics(*metricsAddr, server)
+	}
 
-func GetFile(db *sql.DB, author string, parcel string, file string) ([]byte, bool, error) {
-	author = strings.TrimPrefix(author, "@")
-	row := db.QueryRow("SELECT data, isGZIP FROM files WHERE author=? AND parcel=? AND path=?", author, parcel, file)
-	if row.Err() != nil {
-		return nil, false, row.Err()
+	slog.Info("serving dit-mirror", "address", l.Addr().String())
+	err = server.Serve(l)
+	if !errors.Is(err, ditmirror.ErrServerClosed) {
+		slog.Error("failed to accept connection", "err", err)
+		return
 	}
-	var data []byte
-	var isGZIP bool
 
-	err := row.Scan(&data, &isGZIP)
+	<-stopped
+	err = db.Close()
 	if err != nil {
-		return nil, false, err
+		slog.Error("failed to close database", "err", err)
+		return
 	}
-
-	return data, isGZIP, nil
+	slog.Info("stopped dit-mirror")
 }
 
-func SyncFileToDB(db *sql.DB, author string, parcel string, path string, checksum string, data []byte, isGZIP bool) {
-	author = strings.TrimPrefix(author, "@")
-	var id int
-	err := db.QueryRow("SELECT id FROM files WHERE author = ? AND parcel = ? AND path = ?", author, parcel, path).Scan(&id)
-	// if err is sql.ErrNoRows
-	timestamp := time.Now().String()
-
-	if errors.Is(err, sql.ErrNoRows) { // TODO: check if this works as expected
-		// insert
-		//fmt.Println("insert")
-		stmt, err := db.Prepare("INSERT INTO files (author, parcel, path, checksum, data, isGZIP, created, last_sync) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
-		if err != nil {
-			panic(err)
-		}
-		defer stmt.Close()
-		_, err = stmt.Exec(author, parcel, path, checksum, data, isGZIP, timestamp, timestamp)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "insert error: %v", err)
-		}
-	} else {
-		// update
-		//fmt.Println("update")
-		stmt, err := db.Prepare("UPDATE files SET checksum = ?, data = ?, isGZIP = ?, last_sync = ? WHERE id = ?")
-		if err != nil {
-			panic(err)
-		}
-		defer stmt.Close()
-		_, err = stmt.Exec(checksum, data, isGZIP, timestamp, id)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "update error: %v", err)
+// commandIndex returns the position of the first command of the parser in args, -1 if there is none
+func commandIndex(parser *argparse.Parser, args []string) int {
+	for i, arg := range args[1:] {
+		for _, cmd := range parser.GetCommands() {
+			if arg == cmd.GetName() {
+				return i + 1
+			}
 		}
 	}
+	return -1
 }
 
-func ensureSQLiteDB(db_path string) {
-	// open or create database
-	db, err := sql.Open("sqlite3", db_path)
-	if err != nil {
-		panic(err)
-	}
-	defer db.Close()
-
-	// create table if not exists, id, file path, checksum, data blob, isGZIP bool, created timestamp, last_sync timestamp
-	sqlStmt := `
-	create table if not exists files (id integer not null primary key, author text, parcel text, path text, checksum text, data blob, isGZIP bool, created timestamp, last_sync timestamp);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		panic(err)
+func hasHelpFlag(args []string) bool {
+	for _, arg := range args {
+		if arg == "-h" || arg == "--help" {
+			return true
+		}
 	}
+	return false
 }
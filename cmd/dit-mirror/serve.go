@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditmirror"
+)
+
+// On SIGINT or SIGTERM the mirror stops accepting connections and drains: requests in flight and the background
+// workers get until the shutdown timeout to finish, then the remaining connections are closed and the database is
+// closed. A second signal skips the wait.
+
+// ShutdownOnSignal shuts the server down on the first SIGINT or SIGTERM and returns once it stopped
+func ShutdownOnSignal(server *ditmirror.Server, timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("shutting down, draining connections", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			slog.Warn("second signal, closing connections without waiting")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	server.Shutdown(ctx)
+}
+
+// ServeMetrics serves /metrics and /health of the server on addr until the listener fails
+func ServeMetrics(addr string, server *ditmirror.Server) {
+	slog.Info("serving metrics", "address", addr)
+	err := http.ListenAndServe(addr, server.Handler())
+	slog.Error("metrics listener failed", "err", err)
+}
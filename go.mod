@@ -1,12 +1,15 @@
 module github.com/TheVoxcraft/dit
 
-go 1.19
+go 1.21
 
 require github.com/akamensky/argparse v1.4.0
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/fatih/color v1.13.0
 	github.com/nightlyone/lockfile v1.0.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	golang.org/x/term v0.0.0-20220722155259-a9ba230a4035
 )
 
 require (
@@ -0,0 +1,160 @@
+package ditclient
+
+import (
+	"crypto/ed25519"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/fatih/color"
+)
+
+// The agent holds an unlocked device key for a session and signs messages and unwraps parcel keys for dit commands
+// over a unix socket, so a locked key only needs its passphrase once.
+
+type agentRequest struct {
+	Stop    bool
+	Message ditnet.ClientMessage
+	Unwrap  []byte // a wrapped parcel key, unwrapped instead of signing
+}
+
+type agentResponse struct {
+	Message ditnet.ClientMessage
+	Key     []byte // the unwrapped parcel key, nil if it could not be unwrapped
+}
+
+func agentSocketPath() (string, error) {
+	dir, err := DitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, AgentSocketFile), nil
+}
+
+// RunAgent unlocks the device key and serves signing requests until the timeout passes or it is stopped
+func RunAgent(timeout time.Duration) error {
+	config_map, _, err := loadDitConfig()
+	if err != nil {
+		return err
+	}
+	key, err := loadPrivateKey()
+	if errors.Is(err, ErrKeyLocked) {
+		key, err = unlockPrivateKey()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = ensureConfigDir()
+	if err != nil {
+		return err
+	}
+	sock, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		return errors.New("agent is already running")
+	}
+	os.Remove(sock) // stale socket from an agent that did not exit cleanly
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sock)
+	err = os.Chmod(sock, 0600)
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-stop:
+		case <-time.After(timeout):
+		}
+		l.Close()
+	}()
+
+	fmt.Println(color.CyanString("[-]"), "Agent unlocked device", color.YellowString(config_map["device"]), "for", timeout)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			fmt.Println(color.CyanString("[-]"), "Agent stopped")
+			return nil
+		}
+		if serveAgentConn(c, config_map["author"], config_map["device"], key) {
+			l.Close()
+		}
+	}
+}
+
+// serveAgentConn signs one message or unwraps one parcel key, returns true if the agent was asked to stop
+func serveAgentConn(c net.Conn, author string, device string, key ed25519.PrivateKey) bool {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var req agentRequest
+	err := gob.NewDecoder(c).Decode(&req)
+	if err != nil {
+		return false
+	}
+	if req.Stop {
+		gob.NewEncoder(c).Encode(agentResponse{})
+		return true
+	}
+	if req.Unwrap != nil {
+		parcelKey, _ := unwrapParcelKey(req.Unwrap, key)
+		gob.NewEncoder(c).Encode(agentResponse{Key: parcelKey})
+		return false
+	}
+	req.Message.Sign(author, device, key)
+	gob.NewEncoder(c).Encode(agentResponse{Message: req.Message})
+	return false
+}
+
+func callAgent(req agentRequest) (agentResponse, error) {
+	sock, err := agentSocketPath()
+	if err != nil {
+		return agentResponse{}, err
+	}
+	c, err := net.DialTimeout("unix", sock, time.Second)
+	if err != nil {
+		return agentResponse{}, errors.New("agent is not running")
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	err = gob.NewEncoder(c).Encode(req)
+	if err != nil {
+		return agentResponse{}, err
+	}
+	var resp agentResponse
+	err = gob.NewDecoder(c).Decode(&resp)
+	return resp, err
+}
+
+func signWithAgent(msg *ditnet.ClientMessage) error {
+	resp, err := callAgent(agentRequest{Message: *msg})
+	if err != nil {
+		return err
+	}
+	*msg = resp.Message
+	return nil
+}
+
+func StopAgent() error {
+	_, err := callAgent(agentRequest{Stop: true})
+	return err
+}
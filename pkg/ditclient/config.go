@@ -0,0 +1,130 @@
+package ditclient
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/TheVoxcraft/dit/pkg/ditmaster"
+	"github.com/fatih/color"
+)
+
+const (
+	ConfigFile      = "config"      // author, mirror and device settings
+	CredentialsFile = "credentials" // device private key, only readable by the owner
+	AgentSocketFile = "agent.sock"
+)
+
+// DitConfigDir returns the directory holding the global dit config, ~/.config/dit unless XDG_CONFIG_HOME is set
+func DitConfigDir() (string, error) {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".config")
+	}
+	return filepath.Join(base, "dit"), nil
+}
+
+func ensureConfigDir() (string, error) {
+	dir, err := DitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	return dir, os.Chmod(dir, 0700)
+}
+
+func ditConfigPath() (string, error) {
+	dir, err := DitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ConfigFile), nil
+}
+
+func loadDitConfig() (map[string]string, string, error) {
+	err := migrateLegacyConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	config_path, err := ditConfigPath()
+	if err != nil {
+		return nil, "", err
+	}
+	config_map, err := ditmaster.KVLoad(config_path)
+	return config_map, config_path, err
+}
+
+func saveDitConfig(config_map map[string]string) error {
+	dir, err := ensureConfigDir()
+	if err != nil {
+		return err
+	}
+	return ditmaster.KVSavePrivate(filepath.Join(dir, ConfigFile), config_map)
+}
+
+func loadCredentials() (map[string]string, error) {
+	dir, err := DitConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := ditmaster.KVLoad(filepath.Join(dir, CredentialsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]string), nil
+	}
+	return creds, err
+}
+
+func saveCredentials(creds map[string]string) error {
+	dir, err := ensureConfigDir()
+	if err != nil {
+		return err
+	}
+	return ditmaster.KVSavePrivate(filepath.Join(dir, CredentialsFile), creds)
+}
+
+// migrateLegacyConfig moves the old ~/.dit config file into the config directory, splitting out the private key
+func migrateLegacyConfig() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	legacy_path := filepath.Join(home, ".dit")
+	info, err := os.Stat(legacy_path)
+	if err != nil || info.IsDir() { // nothing to migrate, or a parcel in the home directory
+		return nil
+	}
+	config_path, err := ditConfigPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(config_path); err == nil {
+		return nil // already migrated
+	}
+
+	legacy, err := ditmaster.KVLoad(legacy_path)
+	if err != nil {
+		return err
+	}
+	creds := make(map[string]string)
+	if key, ok := legacy["private_key"]; ok {
+		creds["private_key"] = key
+		delete(legacy, "private_key")
+	}
+	err = saveCredentials(creds)
+	if err != nil {
+		return err
+	}
+	err = saveDitConfig(legacy)
+	if err != nil {
+		return err
+	}
+	color.Cyan("Moved config from %s to %s", legacy_path, filepath.Dir(config_path))
+	return os.Remove(legacy_path)
+}
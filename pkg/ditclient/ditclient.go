@@ -17,7 +17,9 @@ import (
 	"github.com/fatih/color"
 )
 
-func SyncFilesDown(parcel ditmaster.ParcelInfo, base_path string, get_files []string) {
+// SyncFilesDown downloads files from the mirror. All files are read from the same snapshot, the latest one if
+// no files are supplied.
+func SyncFilesDown(parcel ditmaster.ParcelInfo, base_path string, get_files []string, snapshot int64) {
 	fpaths := get_files
 	if len(fpaths) == 0 { // get all files if none are supplied
 		req := ditnet.ClientMessage{
@@ -26,7 +28,7 @@ func SyncFilesDown(parcel ditmaster.ParcelInfo, base_path string, get_files []st
 			MessageType:  ditnet.MSG_GET_PARCEL,
 		}
 
-		resp := ditnet.SendMessageToServer(req, parcel.Mirror) // Get file paths from mirror
+		resp := sendMessage(req, parcel.Mirror) // Get file paths from mirror
 
 		var netparcel ditnet.NetParcel
 		if resp.MessageType != ditnet.MSG_PARCEL {
@@ -36,9 +38,10 @@ func SyncFilesDown(parcel ditmaster.ParcelInfo, base_path string, get_files []st
 		}
 
 		gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&netparcel)
-		fmt.Println("   ", len(netparcel.FilePaths), "files from mirror")
+		fmt.Println("   ", len(netparcel.FilePaths), "files from mirror, snapshot", netparcel.SnapshotID)
 
 		fpaths = netparcel.FilePaths
+		snapshot = netparcel.SnapshotID
 		for _, file := range fpaths {
 			color.Blue("\tGot %s", file)
 		}
@@ -52,24 +55,23 @@ func SyncFilesDown(parcel ditmaster.ParcelInfo, base_path string, get_files []st
 			MessageType:  ditnet.MSG_GET_FILE,
 			Message:      fpath,
 		}
-		resp := ditnet.SendMessageToServer(req, parcel.Mirror)
+		if snapshot > 0 {
+			req.Message2 = strconv.FormatInt(snapshot, 10)
+		}
+		resp := sendMessage(req, parcel.Mirror)
 		if resp.MessageType != ditnet.MSG_FILE {
 			color.HiRed("ERROR: Failed to get file", fpath, "from", parcel.Mirror)
 			continue
 		}
 
-		data := resp.Data
-		if resp.IsGZIP { // decompress if needed
-			uncompressed, err := ditsync.GZIPDecompress(data)
-			if err != nil {
-				color.HiRed("ERROR: Failed to decompress", fpath, "from", parcel.Mirror)
-				continue
-			}
-			data = uncompressed
+		data, err := fileData(parcel, resp)
+		if err != nil {
+			color.HiRed("ERROR: Failed to read %s from %s: %s", fpath, parcel.Mirror, err)
+			continue
 		}
 
 		// write file to disk using os
-		err := WriteFileWithDir(filepath.Join(base_path, fpath), data)
+		err = WriteFileWithDir(filepath.Join(base_path, fpath), data)
 		if err != nil {
 			color.HiRed("ERROR: Failed to write", fpath, "to disk")
 			continue
@@ -95,65 +97,152 @@ func WriteFileWithDir(path string, data []byte) error {
 	return os.WriteFile(path, data, 0644)
 }
 
-func SyncMasterUp(parcel ditmaster.ParcelInfo) {
+// CommitParcel publishes the master record as a new snapshot of the parcel on the mirror, files missing from
+// master are removed. The mirror refuses the commit if the parcel changed since preview or if it would remove more
+// files than preview counted. The stores are saved once the mirror has accepted the snapshot.
+func CommitParcel(parcel ditmaster.ParcelInfo, preview ditnet.NetSnapshot) (ditnet.NetSnapshot, error) {
+	snapshot, err := sendMaster(parcel, ditnet.MSG_COMMIT, &preview)
+	if err != nil {
+		return snapshot, err
+	}
+	err = ditmaster.SyncStoresToDisk(".") // save stores to disk
+	return snapshot, err
+}
+
+// PreviewCommit asks the mirror what CommitParcel would change, without changing anything
+func PreviewCommit(parcel ditmaster.ParcelInfo) (ditnet.NetSnapshot, error) {
+	return sendMaster(parcel, ditnet.MSG_PREVIEW_COMMIT, nil)
+}
+
+// DeleteLimits is how many files a sync up may remove from the mirror before asking for confirmation
+type DeleteLimits struct {
+	Force      bool
+	MaxFiles   int
+	MaxPercent int
+}
+
+// Exceeded reports whether removing the files counted by preview needs confirmation
+func (l DeleteLimits) Exceeded(preview ditnet.NetSnapshot) bool {
+	if l.Force || preview.Removed == 0 {
+		return false
+	}
+	return preview.Removed > l.MaxFiles || preview.Removed*100 > l.MaxPercent*preview.Before
+}
+
+func sendMaster(parcel ditmaster.ParcelInfo, messageType int, preview *ditnet.NetSnapshot) (ditnet.NetSnapshot, error) {
 	netmaster := ditnet.NetMaster{
 		Master: ditmaster.Stores.Master,
 	}
+	if preview != nil {
+		netmaster.Guarded = true
+		netmaster.Base = preview.ID
+		netmaster.MaxRemoved = preview.Removed
+	}
+	if parcel.Encrypted { // the mirror knows the files by their encrypted blob IDs
+		netmaster.Master = make(map[string]string, len(ditmaster.Stores.Master))
+		for path, checksum := range ditmaster.Stores.Master {
+			id, err := BlobID(parcel, checksum)
+			if err != nil {
+				return ditnet.NetSnapshot{}, err
+			}
+			netmaster.Master[path] = id
+		}
+	}
 
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 	err := enc.Encode(netmaster)
 	if err != nil {
-		log.Fatal(err)
+		return ditnet.NetSnapshot{}, err
 	}
 
 	msg := ditnet.ClientMessage{
 		OriginAuthor: parcel.Author,
 		ParcelPath:   parcel.RepoPath,
-		MessageType:  ditnet.MSG_SYNC_MASTER,
+		MessageType:  messageType,
 		Data:         buf.Bytes(),
 		IsGZIP:       false,
 	}
 
-	resp := ditnet.SendMessageToServer(msg, parcel.Mirror)
-	if resp.MessageType != ditnet.MSG_SUCCESS {
-		color.HiRed("ERROR: Failed to sync master store to mirror")
-	}
-	// int parse resp.Message to get number of files synced
-	count, err := strconv.Atoi(resp.Message)
-	if err != nil {
-		color.HiRed("ERROR: Failed to parse number of files synced")
-		return
-	}
-	if count > 0 {
-		color.HiGreen("Removed %d files from mirror", count)
+	resp := sendMessage(msg, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_SNAPSHOT {
+		return ditnet.NetSnapshot{}, errors.New(resp.Message)
 	}
+	var snapshot ditnet.NetSnapshot
+	err = gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&snapshot)
+	return snapshot, err
 }
 
-func SyncFilesUp(sync_files []ditsync.SyncFile, parcel ditmaster.ParcelInfo, save_to_master bool) {
+// SyncFilesUp uploads the data of new and modified files to the mirror, readers do not see it until CommitParcel.
+// Returns false if the sync has to be aborted.
+func SyncFilesUp(sync_files []ditsync.SyncFile, parcel ditmaster.ParcelInfo, save_to_master bool) bool {
+	var key []byte
+	if parcel.Encrypted {
+		var err error
+		key, err = parcelKey(parcel)
+		if err != nil {
+			color.HiRed("ERROR: Could not get the key of the encrypted parcel: %s", err)
+			color.HiRed("Sync aborted, no changes were published.")
+			return false
+		}
+	}
+	ids := make(map[string]string) // checksum -> blob ID on the mirror
+	checksums := make([]string, 0)
 	for _, file := range sync_files {
 		if file.IsDirty || file.IsNew {
-			file_data, is_gzip, b_before, b_after := ditsync.GetFileData(file.FilePath)
-			m := ditnet.ClientMessage{
-				OriginAuthor: parcel.Author,
-				ParcelPath:   parcel.RepoPath,
-				MessageType:  ditnet.MSG_SYNC_FILE,
-				Message:      file.FilePath,
-				Message2:     file.FileChecksum,
-				Data:         file_data,
-				IsGZIP:       is_gzip,
-			}
-
-			resp := ditnet.SendMessageToServer(m, parcel.Mirror)
-			if resp.MessageType != ditnet.MSG_SUCCESS {
-				color.HiRed("ERROR: Failed to sync file", file.FilePath, "to", parcel.Mirror)
+			ids[file.FileChecksum] = file.FileChecksum
+			if key != nil {
+				ids[file.FileChecksum] = ditsync.EncryptedBlobID(key, file.FileChecksum)
 			}
+			checksums = append(checksums, ids[file.FileChecksum])
+		}
+	}
+	missing, err := MissingBlobs(parcel, checksums)
+	if err != nil {
+		color.HiYellow("Could not check which files the mirror has, uploading all: %s", err)
+	}
 
+	for _, file := range sync_files {
+		if file.IsDirty || file.IsNew {
+			var is_gzip bool
+			var b_before, b_after int
 			comp_str := ""
-			if is_gzip {
-				kb_before := float64(b_before) / 1024
-				kb_after := float64(b_after) / 1024
-				comp_str = fmt.Sprintf("(gzip %.2f -> %.2f kB)", kb_before, kb_after)
+			if missing != nil && !missing[ids[file.FileChecksum]] {
+				comp_str = "(already on mirror)"
+			} else {
+				m := ditnet.ClientMessage{
+					OriginAuthor: parcel.Author,
+					ParcelPath:   parcel.RepoPath,
+					MessageType:  ditnet.MSG_PUT_BLOB,
+					Message:      file.FilePath,
+					Message2:     ids[file.FileChecksum],
+				}
+				m.Data, is_gzip, b_before, b_after = ditsync.GetFileData(file.FilePath)
+				m.IsGZIP = is_gzip
+				if key != nil {
+					m.Data, err = ditsync.EncryptBlob(key, m.Data, is_gzip)
+					if err != nil {
+						color.HiRed("ERROR: Failed to encrypt %s: %s", file.FilePath, err)
+						continue
+					}
+					m.IsGZIP = false
+				}
+
+				resp := sendMessage(m, parcel.Mirror)
+				if resp.MessageType == ditnet.MSG_QUOTA_EXCEEDED {
+					color.HiRed("ERROR: Could not sync %s, %s on %s", file.FilePath, resp.Message, parcel.Mirror)
+					color.HiRed("Sync aborted, no changes were published. See: dit quota")
+					return false
+				} else if resp.MessageType != ditnet.MSG_SUCCESS {
+					color.HiRed("ERROR: Failed to sync file %s to %s: %s", file.FilePath, parcel.Mirror, resp.Message)
+					continue
+				}
+
+				if is_gzip {
+					kb_before := float64(b_before) / 1024
+					kb_after := float64(b_after) / 1024
+					comp_str = fmt.Sprintf("(gzip %.2f -> %.2f kB)", kb_before, kb_after)
+				}
 			}
 
 			if file.IsNew {
@@ -175,14 +264,42 @@ func SyncFilesUp(sync_files []ditsync.SyncFile, parcel ditmaster.ParcelInfo, sav
 			color.White("\tSkipping: %s", file.FilePath)
 		}
 	}
+	return true
+}
 
-	err := ditmaster.SyncStoresToDisk(".") // save stores to disk
+// MissingBlobs asks the mirror which of the checksums it has no data for
+func MissingBlobs(parcel ditmaster.ParcelInfo, checksums []string) (map[string]bool, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(checksums)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_HAS_BLOBS,
+		Data:         buf.Bytes(),
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_BLOBS {
+		return nil, errors.New(resp.Message)
+	}
+
+	var missing []string
+	err = gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&missing)
+	if err != nil {
+		return nil, err
 	}
+	missing_set := make(map[string]bool)
+	for _, checksum := range missing {
+		missing_set[checksum] = true
+	}
+	return missing_set, nil
 }
 
-func GetParcelInfoFromMirror(author string, repoPath string, mirror string) (ditnet.NetParcel, error) {
+// GetParcelInfoFromMirror lists the latest snapshot of a parcel, or the snapshot a tag points at
+func GetParcelInfoFromMirror(author string, repoPath string, mirror string, tag string) (ditnet.NetParcel, error) {
 	author = strings.TrimSpace(strings.ToLower(author))
 	repoPath = strings.TrimSpace(strings.ToLower(repoPath))
 	mirror = strings.TrimSpace(strings.ToLower(mirror))
@@ -191,12 +308,13 @@ func GetParcelInfoFromMirror(author string, repoPath string, mirror string) (dit
 		OriginAuthor: author,
 		ParcelPath:   repoPath,
 		MessageType:  ditnet.MSG_GET_PARCEL,
+		Message:      tag,
 		//TODO: Secret: secret,
 	}
 
-	resp := ditnet.SendMessageToServer(req, mirror)
+	resp := sendMessage(req, mirror)
 	if resp.MessageType != ditnet.MSG_PARCEL {
-		return ditnet.NetParcel{}, errors.New("failed to get parcel info from mirror")
+		return ditnet.NetParcel{}, errors.New(resp.Message)
 	}
 
 	var netparcel ditnet.NetParcel
@@ -208,25 +326,21 @@ func GetParcelInfoFromMirror(author string, repoPath string, mirror string) (dit
 }
 
 func SetDitConfig(author string, mirror string, pub_key string) string {
-	// home dir
-	home, err := os.UserHomeDir()
-	home_dit := filepath.Join(home, ".dit")
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = os.Create(home_dit)
+	config_map, home_dit, err := loadDitConfig()
 	if err != nil {
-		log.Fatal(err)
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Fatal(err)
+		}
+		config_map = make(map[string]string) // first time setup
 	}
 
-	config_map := map[string]string{
-		"author": author,
-		"mirror": mirror,
-		"pubkey": pub_key,
+	config_map["author"] = author
+	config_map["mirror"] = mirror
+	if pub_key != "" {
+		config_map["pubkey"] = pub_key
 	}
 
-	err = ditmaster.KVSave(home_dit, config_map)
+	err = saveDitConfig(config_map)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -234,15 +348,7 @@ func SetDitConfig(author string, mirror string, pub_key string) string {
 }
 
 func GetDitFromConfig(key string) string {
-	// home dir
-	home, err := os.UserHomeDir()
-	home_dit := filepath.Join(home, ".dit")
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	config_map, err := ditmaster.KVLoad(home_dit)
+	config_map, _, err := loadDitConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -251,15 +357,7 @@ func GetDitFromConfig(key string) string {
 }
 
 func PrintDitConfig() {
-	// home dir
-	home, err := os.UserHomeDir()
-	home_dit := filepath.Join(home, ".dit")
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	config_map, err := ditmaster.KVLoad(home_dit)
+	config_map, _, err := loadDitConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -299,3 +397,166 @@ func ParseFullRepoPath(full_repo string) (string, string) {
 	}
 	return "", ""
 }
+
+func SetParcelVisibility(parcel ditmaster.ParcelInfo, visibility string) error {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_SET_VISIBILITY,
+		Message:      visibility,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
+
+func ShareParcel(parcel ditmaster.ParcelInfo, grantee string, remove bool) error {
+	action := "add"
+	if remove {
+		action = "remove"
+	}
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_SHARE_PARCEL,
+		Message:      strings.TrimPrefix(strings.TrimSpace(grantee), "@"),
+		Message2:     action,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
+
+// GetQuota fetches the storage usage and limits of the author on the mirror
+func GetQuota(author string, mirror string) (ditnet.NetQuota, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: strings.TrimPrefix(strings.TrimSpace(author), "@"),
+		MessageType:  ditnet.MSG_GET_QUOTA,
+	}
+	resp := sendMessage(req, mirror)
+	if resp.MessageType != ditnet.MSG_QUOTA {
+		return ditnet.NetQuota{}, errors.New(resp.Message)
+	}
+
+	var quota ditnet.NetQuota
+	err := gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&quota)
+	return quota, err
+}
+
+// ListFileVersions fetches the history of a file on the mirror, newest first
+func ListFileVersions(parcel ditmaster.ParcelInfo, path string) ([]ditnet.NetFileVersion, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_LIST_VERSIONS,
+		Message:      path,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_VERSIONS {
+		return nil, errors.New(resp.Message)
+	}
+
+	var versions []ditnet.NetFileVersion
+	err := gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&versions)
+	return versions, err
+}
+
+// GetFileVersion fetches the data of a previous version of a file
+func GetFileVersion(parcel ditmaster.ParcelInfo, path string, id int64) ([]byte, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_GET_VERSION,
+		Message:      path,
+		Message2:     strconv.FormatInt(id, 10),
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_FILE {
+		return nil, errors.New(resp.Message)
+	}
+	return fileData(parcel, resp)
+}
+
+// CreateTag names a snapshot of the parcel on the mirror, the latest one if snapshot is 0
+func CreateTag(parcel ditmaster.ParcelInfo, name string, snapshot int64) (int64, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_CREATE_TAG,
+		Message:      name,
+	}
+	if snapshot > 0 {
+		req.Message2 = strconv.FormatInt(snapshot, 10)
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return 0, errors.New(resp.Message)
+	}
+	return strconv.ParseInt(resp.Message, 10, 64)
+}
+
+func ListTags(parcel ditmaster.ParcelInfo) ([]ditnet.NetTag, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_LIST_TAGS,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_TAGS {
+		return nil, errors.New(resp.Message)
+	}
+
+	var tags []ditnet.NetTag
+	err := gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&tags)
+	return tags, err
+}
+
+func DeleteTag(parcel ditmaster.ParcelInfo, name string) error {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_DELETE_TAG,
+		Message:      name,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
+
+// ListTrash fetches the files deleted from the parcel that the mirror still keeps, most recently deleted first
+func ListTrash(parcel ditmaster.ParcelInfo) ([]ditnet.NetTrashEntry, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_LIST_TRASH,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_TRASH {
+		return nil, errors.New(resp.Message)
+	}
+
+	var entries []ditnet.NetTrashEntry
+	err := gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&entries)
+	return entries, err
+}
+
+// RestoreFromTrash puts a deleted file back into the parcel on the mirror and returns its data
+func RestoreFromTrash(parcel ditmaster.ParcelInfo, path string) ([]byte, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_RESTORE_TRASH,
+		Message:      path,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_FILE {
+		return nil, errors.New(resp.Message)
+	}
+	return fileData(parcel, resp)
+}
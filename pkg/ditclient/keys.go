@@ -0,0 +1,334 @@
+package ditclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/fatih/color"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+var (
+	ErrNoDeviceKey = errors.New("no device key, use 'dit keys add' to create one")
+	ErrKeyLocked   = errors.New("device key is locked with a passphrase")
+)
+
+const (
+	lockedKeyPrefix = "scrypt:" // marks a private key encrypted with a passphrase
+	scryptN         = 1 << 15
+	scryptR         = 8
+	scryptP         = 1
+)
+
+var unlockedKey ed25519.PrivateKey // a locked key stays unlocked for the rest of the process once the passphrase is entered
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// sendMessage signs the message with this device's key (if there is one) before sending it to the mirror
+func sendMessage(msg ditnet.ClientMessage, mirror string) ditnet.ServerMessage {
+	SignMessage(&msg)
+	return ditnet.SendMessageToServer(msg, mirror)
+}
+
+// SignMessage signs with the device key, asking a running agent or prompting for the passphrase if the key is locked
+func SignMessage(msg *ditnet.ClientMessage) {
+	config_map, _, err := loadDitConfig()
+	if err != nil {
+		return // no config, send unsigned
+	}
+	key, err := loadPrivateKey()
+	if errors.Is(err, ErrKeyLocked) {
+		if signWithAgent(msg) == nil {
+			return
+		}
+		key, err = unlockPrivateKey()
+	}
+	if err != nil {
+		if !errors.Is(err, ErrNoDeviceKey) {
+			color.HiYellow("Sending unsigned message: %s", err)
+		}
+		return
+	}
+	msg.Sign(config_map["author"], config_map["device"], key)
+}
+
+// LoadDevicePublicKey returns the device name and public key, which never requires unlocking the private key
+func LoadDevicePublicKey() (string, ed25519.PublicKey, error) {
+	config_map, _, err := loadDitConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	if config_map["pubkey"] == "" {
+		return "", nil, ErrNoDeviceKey
+	}
+	pub, err := DecodePublicKey(config_map["pubkey"])
+	if err != nil {
+		return "", nil, err
+	}
+	return config_map["device"], pub, nil
+}
+
+func loadPrivateKey() (ed25519.PrivateKey, error) {
+	creds, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	encoded := creds["private_key"]
+	if encoded == "" {
+		return nil, ErrNoDeviceKey
+	}
+	if strings.HasPrefix(encoded, lockedKeyPrefix) {
+		if unlockedKey != nil {
+			return unlockedKey, nil
+		}
+		return nil, ErrKeyLocked
+	}
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("device key in credentials is corrupt")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func unlockPrivateKey() (ed25519.PrivateKey, error) {
+	creds, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := ReadPassphrase("Passphrase for device key: ")
+	if err != nil {
+		return nil, err
+	}
+	seed, err := decryptSeed(creds["private_key"], passphrase)
+	if err != nil {
+		return nil, err
+	}
+	unlockedKey = ed25519.NewKeyFromSeed(seed)
+	return unlockedKey, nil
+}
+
+// CreateDeviceKey generates a new key for this device and stores it in the credentials, replacing any previous key
+func CreateDeviceKey(device string) (ed25519.PublicKey, error) {
+	config_map, _, err := loadDitConfig()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	creds["private_key"] = base64.StdEncoding.EncodeToString(priv.Seed())
+	err = saveCredentials(creds)
+	if err != nil {
+		return nil, err
+	}
+	config_map["device"] = device
+	config_map["pubkey"] = EncodePublicKey(pub)
+	return pub, saveDitConfig(config_map)
+}
+
+// LockDeviceKey encrypts the device key with a key derived from the passphrase
+func LockDeviceKey(passphrase string) error {
+	key, err := loadPrivateKey()
+	if errors.Is(err, ErrKeyLocked) {
+		return errors.New("device key is already locked")
+	} else if err != nil {
+		return err
+	}
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	creds["private_key"], err = encryptSeed(key.Seed(), passphrase)
+	if err != nil {
+		return err
+	}
+	return saveCredentials(creds)
+}
+
+// UnlockDeviceKey removes the passphrase from the device key
+func UnlockDeviceKey() error {
+	key, err := loadPrivateKey()
+	if errors.Is(err, ErrKeyLocked) {
+		key, err = unlockPrivateKey()
+	} else if err == nil {
+		return errors.New("device key is not locked")
+	}
+	if err != nil {
+		return err
+	}
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	creds["private_key"] = base64.StdEncoding.EncodeToString(key.Seed())
+	return saveCredentials(creds)
+}
+
+func encryptSeed(seed []byte, passphrase string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, seed, nil)
+	return lockedKeyPrefix + base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSeed(encoded string, passphrase string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(encoded, lockedKeyPrefix), ":")
+	if len(parts) != 2 {
+		return nil, errors.New("locked device key is corrupt")
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("locked device key is corrupt")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("locked device key is corrupt")
+	}
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("locked device key is corrupt")
+	}
+	seed, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("wrong passphrase")
+	}
+	return seed, nil
+}
+
+func passphraseCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadPassphrase prompts on stderr and reads without echo when stdin is a terminal
+func ReadPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(passphrase), err
+	}
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Confirm asks a yes or no question on stderr, it is answered no when stdin is not a terminal
+func Confirm(prompt string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprint(os.Stderr, prompt+" [y/N] ")
+	line, _ := stdinReader.ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+func DefaultDeviceName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "device"
+	}
+	return strings.ToLower(strings.Split(host, ".")[0])
+}
+
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+func DecodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	return pub, nil
+}
+
+// RegisterKey adds a device key, token is only needed for the first key of an author who already has parcels
+func RegisterKey(author string, mirror string, device string, pub ed25519.PublicKey, token string) error {
+	req := ditnet.ClientMessage{
+		OriginAuthor: author,
+		MessageType:  ditnet.MSG_ADD_KEY,
+		Message:      device,
+		Message2:     token,
+		Data:         pub,
+	}
+	resp := sendMessage(req, mirror)
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
+
+func ListKeys(author string, mirror string) ([]ditnet.NetKey, error) {
+	req := ditnet.ClientMessage{
+		OriginAuthor: author,
+		MessageType:  ditnet.MSG_LIST_KEYS,
+	}
+	resp := sendMessage(req, mirror)
+	if resp.MessageType != ditnet.MSG_KEYS {
+		return nil, errors.New(resp.Message)
+	}
+
+	var keys []ditnet.NetKey
+	err := gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func RevokeKey(author string, mirror string, device string, force bool) error {
+	req := ditnet.ClientMessage{
+		OriginAuthor: author,
+		MessageType:  ditnet.MSG_REVOKE_KEY,
+		Message:      device,
+	}
+	if force {
+		req.Message2 = "force"
+	}
+	resp := sendMessage(req, mirror)
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package ditclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/gob"
+	"errors"
+	"math/big"
+
+	"github.com/TheVoxcraft/dit/pkg/ditmaster"
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+// Files of an encrypted parcel are encrypted with the parcel key before they leave the device. The mirror only
+// keeps the parcel key wrapped for each device key of the author: an X25519 exchange between a fresh key and the
+// device key, converted from ed25519, derives the key that seals it. A device added later reads the parcel once
+// another device rewraps the key for it, a revoked device loses its wrapped key on the mirror. Authors the parcel
+// is shared with have no wrapped key and cannot decrypt it.
+
+const wrappedKeySize = 32 + 12 + ditsync.PARCEL_KEY_SIZE + 16 // ephemeral public key, nonce, sealed key
+
+var parcelKeys = make(map[string][]byte) // parcel keys unwrapped during this process, by mirror and parcel
+
+func parcelKeyID(parcel ditmaster.ParcelInfo) string {
+	return parcel.Mirror + "@" + parcel.Author + parcel.RepoPath
+}
+
+// EncryptParcel generates a parcel key and wraps it for every active device key of the author.
+// The mirror only accepts it before anything was synced to the parcel. Returns the devices that can read the parcel.
+func EncryptParcel(parcel ditmaster.ParcelInfo) ([]string, error) {
+	key := make([]byte, ditsync.PARCEL_KEY_SIZE)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := setParcelKeys(parcel, key)
+	if err != nil {
+		return nil, err
+	}
+	parcelKeys[parcelKeyID(parcel)] = key
+	return devices, nil
+}
+
+// RewrapParcelKey wraps the key of an encrypted parcel for the current active device keys of the author, run it from a
+// device that can read the parcel after adding a device. A revoked device that read the parcel before still knows the key.
+func RewrapParcelKey(parcel ditmaster.ParcelInfo) ([]string, error) {
+	key, err := parcelKey(parcel)
+	if err != nil {
+		return nil, err
+	}
+	return setParcelKeys(parcel, key)
+}
+
+func setParcelKeys(parcel ditmaster.ParcelInfo, key []byte) ([]string, error) {
+	keys, err := ListKeys(parcel.Author, parcel.Mirror)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make(map[string][]byte)
+	devices := make([]string, 0)
+	for _, k := range keys {
+		if k.Revoked != "" {
+			continue
+		}
+		wrapped[k.Device], err = wrapParcelKey(key, k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, k.Device)
+	}
+	if len(devices) == 0 {
+		return nil, ErrNoDeviceKey
+	}
+
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_SET_PARCEL_KEYS,
+		Data:         buf.Bytes(),
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return nil, errors.New(resp.Message)
+	}
+	return devices, nil
+}
+
+// parcelKey fetches the parcel key wrapped for this device and unwraps it
+func parcelKey(parcel ditmaster.ParcelInfo) ([]byte, error) {
+	if key := parcelKeys[parcelKeyID(parcel)]; key != nil {
+		return key, nil
+	}
+	req := ditnet.ClientMessage{
+		OriginAuthor: parcel.Author,
+		ParcelPath:   parcel.RepoPath,
+		MessageType:  ditnet.MSG_GET_PARCEL_KEY,
+	}
+	resp := sendMessage(req, parcel.Mirror)
+	if resp.MessageType != ditnet.MSG_PARCEL_KEY {
+		return nil, errors.New(resp.Message)
+	}
+
+	device, err := loadPrivateKey()
+	if errors.Is(err, ErrKeyLocked) {
+		if agent, err := callAgent(agentRequest{Unwrap: resp.Data}); err == nil && agent.Key != nil {
+			parcelKeys[parcelKeyID(parcel)] = agent.Key
+			return agent.Key, nil
+		}
+		device, err = unlockPrivateKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := unwrapParcelKey(resp.Data, device)
+	if err != nil {
+		return nil, err
+	}
+	parcelKeys[parcelKeyID(parcel)] = key
+	return key, nil
+}
+
+// BlobID returns the ID the mirror stores a file under, which is its checksum unless the parcel is encrypted
+func BlobID(parcel ditmaster.ParcelInfo, checksum string) (string, error) {
+	if !parcel.Encrypted {
+		return checksum, nil
+	}
+	key, err := parcelKey(parcel)
+	if err != nil {
+		return "", err
+	}
+	return ditsync.EncryptedBlobID(key, checksum), nil
+}
+
+// fileData returns the content of a file sent by the mirror
+func fileData(parcel ditmaster.ParcelInfo, resp ditnet.ServerMessage) ([]byte, error) {
+	if parcel.Encrypted {
+		key, err := parcelKey(parcel)
+		if err != nil {
+			return nil, err
+		}
+		return ditsync.DecryptBlob(key, resp.Data)
+	}
+	if resp.IsGZIP {
+		return ditsync.GZIPDecompress(resp.Data)
+	}
+	return resp.Data, nil
+}
+
+func wrapParcelKey(key []byte, device ed25519.PublicKey) ([]byte, error) {
+	devicePub, err := x25519PublicKey(device)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(devicePub)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := wrapCipher(shared, ephemeral.PublicKey().Bytes(), devicePub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := append(ephemeral.PublicKey().Bytes(), nonce...)
+	return gcm.Seal(wrapped, nonce, key, nil), nil
+}
+
+func unwrapParcelKey(wrapped []byte, device ed25519.PrivateKey) ([]byte, error) {
+	if len(wrapped) != wrappedKeySize {
+		return nil, errors.New("invalid wrapped parcel key")
+	}
+	devicePriv, err := x25519PrivateKey(device)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(wrapped[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := devicePriv.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := wrapCipher(shared, wrapped[:32], devicePriv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	key, err := gcm.Open(nil, wrapped[32:32+gcm.NonceSize()], wrapped[32+gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("failed to unwrap the parcel key, it was wrapped for another device key")
+	}
+	return key, nil
+}
+
+func wrapCipher(shared []byte, ephemeral []byte, device []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("dit parcel key"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(device)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// x25519PrivateKey derives the X25519 key of a device key the same way ed25519 derives its scalar
+func x25519PrivateKey(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(key.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// x25519PublicKey maps an ed25519 public key to the matching X25519 key, u = (1 + y) / (1 - y)
+func x25519PublicKey(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	le := make([]byte, len(pub))
+	copy(le, pub)
+	le[31] &= 0x7f // the top bit is the sign of x
+	y := new(big.Int).SetBytes(reverse(le))
+	one := big.NewInt(1)
+	den := new(big.Int).Mod(new(big.Int).Sub(one, y), curve25519P)
+	inv := new(big.Int).ModInverse(den, curve25519P)
+	if inv == nil {
+		return nil, errors.New("invalid public key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, inv).Mod(u, curve25519P)
+	return ecdh.X25519().NewPublicKey(reverse(u.FillBytes(make([]byte, 32))))
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package ditclient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+func TestWrapParcelKeyForADeviceKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPub, err := x25519PublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPriv, err := x25519PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromPub.Bytes(), fromPriv.PublicKey().Bytes()) {
+		t.Fatal("the X25519 keys derived from the public and the private device key differ")
+	}
+
+	key := bytes.Repeat([]byte{7}, ditsync.PARCEL_KEY_SIZE)
+	wrapped, err := wrapParcelKey(key, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := unwrapParcelKey(wrapped, priv)
+	if err != nil || !bytes.Equal(unwrapped, key) {
+		t.Fatalf("unwrapped %x: %v", unwrapped, err)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	if _, err := unwrapParcelKey(wrapped, other); err == nil {
+		t.Fatal("another device key unwrapped the parcel key")
+	}
+
+	data := bytes.Repeat([]byte("compressible "), 200)
+	compressed, err := ditsync.GZIPCompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ditsync.EncryptBlob(unwrapped, compressed, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ditsync.DecryptBlob(key, blob)
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Fatalf("decrypted %d bytes: %v", len(decrypted), err)
+	}
+	blob[len(blob)-1] ^= 1
+	if _, err := ditsync.DecryptBlob(key, blob); err == nil {
+		t.Fatal("an altered blob decrypted")
+	}
+}
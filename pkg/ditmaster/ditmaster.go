@@ -25,11 +25,13 @@ type DitMaster struct {
 }
 
 type ParcelInfo struct {
-	Author     string
-	RepoPath   string
-	Mirror     string
-	publicKey  string
-	IgnoreList []string
+	Author           string
+	RepoPath         string
+	Mirror           string
+	publicKey        string
+	IgnoreList       []string
+	SecretExceptions []string // Paths allowed to be synced even if they look like they contain secrets
+	Encrypted        bool     // Files are encrypted with the parcel key before they are sent to the mirror
 }
 
 var diskStores = DitMaster{ // these stores are supposed to be synced to disk data
@@ -175,6 +177,9 @@ func newManifestFile(path string, info ParcelInfo) error {
 	Stores.Manifest["repo_path"] = info.RepoPath
 	Stores.Manifest["mirror"] = info.Mirror
 	Stores.Manifest["public_key"] = info.publicKey
+	if info.Encrypted {
+		Stores.Manifest["encrypted"] = "true"
+	}
 	err = KVSave(filepath.Join(path, ManifestPath), Stores.Manifest)
 	return err
 }
@@ -206,32 +211,54 @@ func newMasterRecord(path string) error {
 
 func GetParcelInfo(path string) ParcelInfo {
 	return ParcelInfo{
-		Author:     Stores.Manifest["author"],
-		RepoPath:   Stores.Manifest["repo_path"],
-		Mirror:     Stores.Manifest["mirror"],
-		publicKey:  Stores.Manifest["public_key"],
-		IgnoreList: strings.Split(Stores.PrivateManifest["ignore_list"], ","),
+		Author:           Stores.Manifest["author"],
+		RepoPath:         Stores.Manifest["repo_path"],
+		Mirror:           Stores.Manifest["mirror"],
+		publicKey:        Stores.Manifest["public_key"],
+		IgnoreList:       strings.Split(Stores.PrivateManifest["ignore_list"], ","),
+		SecretExceptions: strings.Split(Stores.PrivateManifest["secret_exceptions"], ","),
+		Encrypted:        Stores.Manifest["encrypted"] == "true",
 	}
 }
 
+func (ParcelInfo) SetEncrypted() {
+	Stores.Manifest["encrypted"] = "true"
+}
+
 func (ParcelInfo) AddIgnorePattern(p string) {
+	addToPrivateList("ignore_list", p)
+}
+
+func (ParcelInfo) RemoveIgnorePattern(p string) {
+	removeFromPrivateList("ignore_list", p)
+}
+
+func (ParcelInfo) AddSecretException(p string) {
+	addToPrivateList("secret_exceptions", p)
+}
+
+func (ParcelInfo) RemoveSecretException(p string) {
+	removeFromPrivateList("secret_exceptions", p)
+}
+
+func addToPrivateList(key string, p string) {
 	if strings.Contains(p, ",") {
-		log.Fatal("ignore pattern cannot contain a comma")
+		log.Fatal("pattern cannot contain a comma")
 	}
-	l := strings.Split(Stores.PrivateManifest["ignore_list"], ",")
+	l := strings.Split(Stores.PrivateManifest[key], ",")
 	l = append(l, p)
-	Stores.PrivateManifest["ignore_list"] = strings.Join(l, ",")
+	Stores.PrivateManifest[key] = strings.Join(l, ",")
 }
 
-func (ParcelInfo) RemoveIgnorePattern(p string) {
+func removeFromPrivateList(key string, p string) {
 	if strings.Contains(p, ",") {
-		log.Fatal("ignore pattern cannot contain a comma")
+		log.Fatal("pattern cannot contain a comma")
 	}
-	l := strings.Split(Stores.PrivateManifest["ignore_list"], ",")
+	l := strings.Split(Stores.PrivateManifest[key], ",")
 	for i, v := range l {
 		if v == p {
 			l = append(l[:i], l[i+1:]...)
 		}
 	}
-	Stores.PrivateManifest["ignore_list"] = strings.Join(l, ",")
+	Stores.PrivateManifest[key] = strings.Join(l, ",")
 }
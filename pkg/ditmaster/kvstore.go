@@ -34,7 +34,19 @@ func KVLoad(path string) (map[string]string, error) {
 }
 
 func KVSave(path string, store map[string]string) error { // save keys to exisiting file
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	return kvSave(path, store, 0644)
+}
+
+func KVSavePrivate(path string, store map[string]string) error { // save keys readable only by the owner
+	err := os.Chmod(path, 0600) // restrict an existing file before writing to it
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return kvSave(path, store, 0600)
+}
+
+func kvSave(path string, store map[string]string, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,406 @@
+package ditmirror
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+// Admin commands run against the database directly, or on a running mirror through MSG_ADMIN authenticated with
+// the admin secret. Either way the output is rendered on the mirror, so both print the same thing.
+
+var ErrParcelNotFound = errors.New("parcel not found")
+var ErrParcelExists = errors.New("target parcel already exists")
+
+type AdminCommand struct {
+	Name   string // authors, parcels, largest, delete-parcel, rename-parcel, move-parcel, reset-keys, key-token
+	Author string
+	Parcel string
+	Target string // new parcel path or author
+	Limit  int
+}
+
+var adminWriteCommands = map[string]bool{"delete-parcel": true, "rename-parcel": true, "move-parcel": true, "reset-keys": true, "key-token": true}
+
+// tables that hold rows per parcel, snapshot_files hangs off snapshots
+var parcelTables = []string{"files", "file_versions", "snapshots", "tags", "trash", "shares", "parcel_keys", "parcels"}
+
+// RunAdmin runs an admin command and writes its output to w, remote is recorded in the audit log
+func RunAdmin(db *sql.DB, w io.Writer, cmd AdminCommand, remote string) error {
+	if adminWriteCommands[cmd.Name] {
+		state, following, err := GetReplicationState(db)
+		if err != nil {
+			return err
+		}
+		if following {
+			return errors.New("this mirror is a read-only follower of " + state.Leader + ", run the command on the leader")
+		}
+	}
+
+	switch cmd.Name {
+	case "authors":
+		return adminAuthors(db, w)
+	case "parcels":
+		return adminParcels(db, w, cmd.Author)
+	case "largest":
+		return adminLargest(db, w, cmd.Author, cmd.Limit)
+	case "delete-parcel":
+		files, err := DeleteParcel(db, cmd.Author, cmd.Parcel)
+		if err != nil {
+			return err
+		}
+		AuditLog(db, AUDIT_PARCEL_DELETE, cmd.Author, remote, cmd.Parcel, "", "")
+		fmt.Fprintf(w, "Deleted @%s%s with %d files, run gc to reclaim the space\n", cmd.Author, cmd.Parcel, files)
+	case "rename-parcel":
+		err := MoveParcel(db, cmd.Author, cmd.Parcel, cmd.Author, cmd.Target)
+		if err != nil {
+			return err
+		}
+		AuditLog(db, AUDIT_PARCEL_MOVE, cmd.Author, remote, cmd.Parcel, "", "@"+strings.TrimPrefix(cmd.Author, "@")+cmd.Target)
+		fmt.Fprintf(w, "Renamed @%s%s to @%s%s\n", cmd.Author, cmd.Parcel, cmd.Author, cmd.Target)
+	case "move-parcel":
+		err := MoveParcel(db, cmd.Author, cmd.Parcel, cmd.Target, cmd.Parcel)
+		if err != nil {
+			return err
+		}
+		AuditLog(db, AUDIT_PARCEL_MOVE, cmd.Author, remote, cmd.Parcel, "", "@"+strings.TrimPrefix(cmd.Target, "@")+cmd.Parcel)
+		fmt.Fprintf(w, "Moved @%s%s to @%s%s\n", cmd.Author, cmd.Parcel, cmd.Target, cmd.Parcel)
+	case "reset-keys":
+		keys, err := ResetKeys(db, cmd.Author)
+		if err != nil {
+			return err
+		}
+		AuditLog(db, AUDIT_KEY_RESET, cmd.Author, remote, "", "", "")
+		fmt.Fprintf(w, "Removed %d keys of @%s\n", keys, cmd.Author)
+		var encrypted int
+		db.QueryRow("SELECT COUNT(*) FROM parcels WHERE author = ? AND encrypted", strings.TrimPrefix(cmd.Author, "@")).Scan(&encrypted)
+		if encrypted > 0 {
+			fmt.Fprintf(w, "The files of %d encrypted parcels of @%s cannot be decrypted anymore\n", encrypted, cmd.Author)
+		}
+		return adminKeyToken(db, w, cmd.Author, remote)
+	case "key-token":
+		return adminKeyToken(db, w, cmd.Author, remote)
+	default:
+		return fmt.Errorf("unknown admin command %q", cmd.Name)
+	}
+	return nil
+}
+
+// adminKeyToken issues a token for the first key of an author, unless the author can register one without it
+func adminKeyToken(db *sql.DB, w io.Writer, author string, remote string) error {
+	author = strings.TrimPrefix(author, "@")
+	if HasKeys(db, author) {
+		return fmt.Errorf("@%s has device keys, a new key is added from one of their devices", author)
+	}
+	hasData, err := authorHasData(db, author)
+	if err != nil {
+		return err
+	}
+	if !hasData {
+		fmt.Fprintf(w, "@%s has no parcels, the next key they add is trusted without a token\n", author)
+		return nil
+	}
+	token, err := IssueKeyToken(db, author)
+	if err != nil {
+		return err
+	}
+	AuditLog(db, AUDIT_KEY_TOKEN, author, remote, "", "", "")
+	fmt.Fprintf(w, "Give @%s this one-time token over a trusted channel, it is valid for %s:\n  dit keys add --token %s\n", author, keyTokenLifetime, token)
+	return nil
+}
+
+func adminAuthors(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`SELECT a.author,
+		(SELECT COUNT(*) FROM parcels p WHERE p.author = a.author),
+		(SELECT COUNT(*) FROM keys k WHERE k.author = a.author AND k.revoked IS NULL)
+		FROM (SELECT author FROM parcels UNION SELECT author FROM files UNION SELECT author FROM keys) a ORDER BY a.author`)
+	if err != nil {
+		return err
+	}
+	type authorRow struct {
+		author  string
+		parcels int
+		keys    int
+	}
+	authors := make([]authorRow, 0)
+	for rows.Next() {
+		var a authorRow
+		if err := rows.Scan(&a.author, &a.parcels, &a.keys); err != nil {
+			rows.Close()
+			return err
+		}
+		authors = append(authors, a)
+	}
+	rows.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AUTHOR\tPARCELS\tFILES\tSTORED\tKEYS")
+	for _, a := range authors {
+		usage, err := GetUsage(db, a.author)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "@%s\t%d\t%d\t%s\t%d\n", a.author, a.parcels, usage.Files, FormatSize(usage.Bytes), a.keys)
+	}
+	return tw.Flush()
+}
+
+func adminParcels(db *sql.DB, w io.Writer, author string) error {
+	author = strings.TrimPrefix(author, "@")
+	rows, err := db.Query(`SELECT p.author, p.parcel, p.visibility,
+		(SELECT COUNT(*) FROM files f WHERE f.author = p.author AND f.parcel = p.parcel),
+		(SELECT COALESCE(SUM(b.size), 0) FROM blobs b WHERE b.checksum IN (SELECT f.checksum FROM files f WHERE f.author = p.author AND f.parcel = p.parcel)),
+		(SELECT COALESCE(MAX(s.number), 0) FROM snapshots s WHERE s.author = p.author AND s.parcel = p.parcel),
+		(SELECT COUNT(*) FROM trash t WHERE t.author = p.author AND t.parcel = p.parcel)
+		FROM parcels p WHERE ? = '' OR p.author = ? ORDER BY p.author, p.parcel`, author, author)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PARCEL\tVISIBILITY\tFILES\tSIZE\tSNAPSHOT\tTRASH")
+	for rows.Next() {
+		var owner, parcel, visibility string
+		var files, size, snapshot, trash int64
+		if err := rows.Scan(&owner, &parcel, &visibility, &files, &size, &snapshot, &trash); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "@%s%s\t%s\t%d\t%s\t#%d\t%d\n", owner, parcel, visibility, files, FormatSize(size), snapshot, trash)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func adminLargest(db *sql.DB, w io.Writer, author string, limit int) error {
+	author = strings.TrimPrefix(author, "@")
+	if limit <= 0 {
+		limit = 20
+	}
+	rows, err := db.Query(`SELECT f.author, f.parcel, f.path, COALESCE(b.size, 0) FROM files f LEFT JOIN blobs b ON b.checksum = f.checksum
+		WHERE ? = '' OR f.author = ? ORDER BY 4 DESC, f.author, f.parcel, f.path LIMIT ?`, author, author, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tFILE")
+	for rows.Next() {
+		var owner, parcel, path string
+		var size int64
+		if err := rows.Scan(&owner, &parcel, &path, &size); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t@%s%s%s\n", FormatSize(size), owner, parcel, path)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func parcelExists(db querier, author string, parcel string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT (SELECT COUNT(*) FROM parcels WHERE author = ? AND parcel = ?) + (SELECT COUNT(*) FROM files WHERE author = ? AND parcel = ?)",
+		author, parcel, author, parcel).Scan(&count)
+	return count > 0, err
+}
+
+// DeleteParcel removes a parcel with its history, trash, tags and shares. The blobs are left for gc.
+func DeleteParcel(db *sql.DB, author string, parcel string) (int, error) {
+	author = strings.TrimPrefix(author, "@")
+	exists, err := parcelExists(db, author, parcel)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, ErrParcelNotFound
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var files int
+	err = tx.QueryRow("SELECT COUNT(*) FROM files WHERE author = ? AND parcel = ?", author, parcel).Scan(&files)
+	if err != nil {
+		return 0, err
+	}
+	err = deleteParcelRows(tx, author, parcel)
+	if err != nil {
+		return 0, err
+	}
+	return files, tx.Commit()
+}
+
+func deleteParcelRows(tx execer, author string, parcel string) error {
+	_, err := tx.Exec("DELETE FROM snapshot_files WHERE snapshot_id IN (SELECT id FROM snapshots WHERE author = ? AND parcel = ?)", author, parcel)
+	if err != nil {
+		return err
+	}
+	for _, table := range parcelTables {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE author = ? AND parcel = ?", author, parcel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MoveParcel renames a parcel, moves it to another author, or both. Clients holding the old path have to be
+// pointed at the new one, their next sync would otherwise recreate the old parcel.
+func MoveParcel(db *sql.DB, author string, parcel string, toAuthor string, toParcel string) error {
+	author = strings.TrimPrefix(author, "@")
+	toAuthor = strings.TrimPrefix(toAuthor, "@")
+	if toAuthor == "" || toParcel == "" {
+		return errors.New("target author and parcel cannot be empty")
+	}
+	exists, err := parcelExists(db, author, parcel)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrParcelNotFound
+	}
+	exists, err = parcelExists(db, toAuthor, toParcel)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrParcelExists
+	}
+	if toAuthor != author {
+		encrypted, err := IsEncrypted(db, author, parcel)
+		if err != nil {
+			return err
+		}
+		if encrypted {
+			return errors.New("an encrypted parcel cannot move to another author, its key is only wrapped for the devices of @" + author)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = moveParcelRows(tx, author, parcel, toAuthor, toParcel)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func moveParcelRows(tx execer, author string, parcel string, toAuthor string, toParcel string) error {
+	for _, table := range parcelTables {
+		_, err := tx.Exec("UPDATE "+table+" SET author = ?, parcel = ? WHERE author = ? AND parcel = ?", toAuthor, toParcel, author, parcel)
+		if err != nil {
+			return err
+		}
+	}
+	// a parcel cannot be shared with its own author
+	_, err := tx.Exec("DELETE FROM shares WHERE author = ? AND parcel = ? AND grantee = ?", toAuthor, toParcel, toAuthor)
+	return err
+}
+
+// ResetKeys removes every key of an author, including revoked ones, so they can register a new first key with a key token.
+// The parcel keys wrapped for those devices go with them, the files of encrypted parcels cannot be decrypted afterwards.
+func ResetKeys(db *sql.DB, author string) (int, error) {
+	author = strings.TrimPrefix(author, "@")
+	res, err := db.Exec("DELETE FROM keys WHERE author = ?", author)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	_, err = db.Exec("DELETE FROM parcel_keys WHERE author = ?", author)
+	return int(n), err
+}
+
+// ParseParcelArg splits @author/parcel/path into the author and the parcel path as clients store it
+func ParseParcelArg(arg string) (string, string, error) {
+	arg = strings.TrimSpace(arg)
+	i := strings.Index(arg, "/")
+	if !strings.HasPrefix(arg, "@") || i < 2 {
+		return "", "", errors.New("invalid parcel, format: @author/repo/path")
+	}
+	parcel, err := CanonicalParcelPath(arg[i:])
+	return arg[1:i], parcel, err
+}
+
+// CanonicalParcelPath normalizes a parcel path the way clients do when a parcel is created
+func CanonicalParcelPath(path string) (string, error) {
+	path = strings.TrimSpace(path)
+	path = strings.ReplaceAll(path, " ", "-")
+	path = strings.ReplaceAll(path, "\\", "/")
+	path = strings.ReplaceAll(path, "//", "/")
+	if strings.ContainsAny(path, ":*?\"<>|") || strings.Trim(path, "/") == "" {
+		return "", fmt.Errorf("invalid parcel path %q", path)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return strings.ToLower(path), nil
+}
+
+// SendAdminCommand runs an admin command on a running mirror and returns its output
+func SendAdminCommand(mirror string, secret string, cmd AdminCommand) (string, error) {
+	var cmdBytes bytes.Buffer
+	err := gob.NewEncoder(&cmdBytes).Encode(cmd)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ditnet.ExchangeMessage(ditnet.ClientMessage{MessageType: ditnet.MSG_ADMIN, Data: cmdBytes.Bytes(), Secret: secret}, mirror)
+	if err != nil {
+		return "", err
+	}
+	if resp.MessageType != ditnet.MSG_SUCCESS {
+		return "", errors.New(resp.Message)
+	}
+	return resp.Message, nil
+}
+
+func handleAdminMessage(c net.Conn, db *sql.DB, cfg *Settings, msg *ditnet.ClientMessage, remote string) {
+	secret := cfg.AdminSecret
+	if secret == "" {
+		sendFailure(c, "remote administration is not enabled on this mirror")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(msg.Secret), []byte(secret)) != 1 {
+		AuditLog(db, AUDIT_AUTH_FAIL, "", remote, "", "", "admin")
+		sendFailure(c, "invalid admin secret")
+		return
+	}
+	var cmd AdminCommand
+	err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(&cmd)
+	if err != nil {
+		connLogger(c).Warn("gob decode error", "err", err)
+		sendFailure(c, "invalid admin command")
+		return
+	}
+	logAttrs(c, "command", strings.TrimSpace(strings.Join([]string{cmd.Name, cmd.Author + cmd.Parcel, cmd.Target}, " ")))
+
+	var out bytes.Buffer
+	err = RunAdmin(db, &out, cmd, remote)
+	if err != nil {
+		sendFailure(c, err.Error())
+		return
+	}
+	sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: out.String()})
+}
@@ -0,0 +1,153 @@
+package ditmirror
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	/* Audit events */
+	AUDIT_SYNC       = "sync"       // file uploaded or updated
+	AUDIT_DELETE     = "delete"     // file moved to the trash by a sync
+	AUDIT_KEY_ADD    = "key-add"    // device key registered
+	AUDIT_KEY_REVOKE = "key-revoke" // device key revoked
+	AUDIT_AUTH_FAIL  = "auth-fail"  // request rejected by authentication
+	AUDIT_VISIBILITY = "visibility" // parcel visibility changed
+	AUDIT_SHARE      = "share"      // parcel shared with another author
+	AUDIT_UNSHARE    = "unshare"    // parcel no longer shared with another author
+	AUDIT_TAG        = "tag"        // snapshot tagged
+	AUDIT_UNTAG      = "untag"      // tag deleted
+	AUDIT_RESTORE    = "restore"    // file restored from the trash
+	AUDIT_REPLICATE  = "replicate"  // parcel updated from the leader mirror
+	AUDIT_PARCEL_KEY = "parcel-key" // parcel encrypted or its key wrapped for a new set of devices, detail lists the devices
+
+	AUDIT_PARCEL_DELETE = "parcel-delete" // parcel deleted by an administrator
+	AUDIT_PARCEL_MOVE   = "parcel-move"   // parcel renamed or moved to another author by an administrator, detail is the new @author/parcel
+	AUDIT_KEY_RESET     = "key-reset"     // every key of an author removed by an administrator
+	AUDIT_KEY_TOKEN     = "key-token"     // one-time token for the first key of an author issued by an administrator
+)
+
+type AuditEntry struct {
+	ID     int
+	Time   string
+	Event  string
+	Author string
+	Remote string
+	Parcel string
+	Path   string
+	Detail string
+}
+
+type AuditFilter struct {
+	Author string
+	Parcel string
+	Path   string
+	Event  string
+	Since  time.Time
+	Limit  int
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so audit records can be written as part of a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func AuditLog(db execer, event string, author string, remote string, parcel string, path string, detail string) {
+	author = strings.TrimPrefix(author, "@")
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.Exec("INSERT INTO audit (time, event, author, remote, parcel, path, detail) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		timestamp, event, author, remote, parcel, path, detail)
+	if err != nil {
+		slog.Error("audit error", "event", event, "err", err)
+	}
+}
+
+func QueryAudit(db *sql.DB, filter AuditFilter) ([]AuditEntry, error) {
+	query := "SELECT id, time, event, author, remote, parcel, path, detail FROM audit"
+	conds := make([]string, 0)
+	args := make([]any, 0)
+	if filter.Author != "" {
+		conds = append(conds, "author = ?")
+		args = append(args, strings.TrimPrefix(filter.Author, "@"))
+	}
+	if filter.Parcel != "" {
+		conds = append(conds, "parcel = ?")
+		args = append(args, filter.Parcel)
+	}
+	if filter.Path != "" {
+		conds = append(conds, "path = ?")
+		args = append(args, filter.Path)
+	}
+	if filter.Event != "" {
+		conds = append(conds, "event = ?")
+		args = append(args, filter.Event)
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "time >= ?")
+		args = append(args, filter.Since.UTC().Format(time.RFC3339))
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		err = rows.Scan(&e.ID, &e.Time, &e.Event, &e.Author, &e.Remote, &e.Parcel, &e.Path, &e.Detail)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ParseSince accepts either a duration relative to now (e.g. 24h) or a date (2006-01-02 or RFC3339)
+func ParseSince(since string) (time.Time, error) {
+	since = strings.TrimSpace(since)
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use a duration (24h) or a date (2006-01-02)", since)
+	}
+	return t, nil
+}
+
+func PrintAudit(entries []AuditEntry) {
+	// print oldest first so the output reads like a log
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		target := color.YellowString("@"+e.Author) + e.Parcel
+		if e.Path != "" {
+			target += " [" + e.Path + "]"
+		}
+		line := fmt.Sprintf("%s %-10s %s %s", e.Time, e.Event, target, color.BlueString(e.Remote))
+		if e.Detail != "" {
+			line += " " + e.Detail
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,465 @@
+package ditmirror
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// A backup is a tar archive holding a copy of the database taken with VACUUM INTO, which is consistent while the
+// mirror keeps serving, and the data of every blob it references. Blobs never change once written, so an
+// incremental backup only holds the blobs its base backup does not have, but always a full copy of the database.
+// Garbage collection may run while a backup is written, even in another process. It only deletes blobs nothing
+// references anymore, so the blobs are copied before the database: a blob it deleted meanwhile is left out along
+// with the references to it, as if the copy had been taken after the collection.
+// The manifest is written last and lists the sha256 of every other entry.
+
+const (
+	backupFormat       = 1
+	backupManifestName = "manifest.json"
+	backupDBName       = "dit.db"
+	backupBlobsDir     = "blobs/"
+)
+
+type BackupManifest struct {
+	Format        int
+	ID            string
+	Created       string
+	SchemaVersion int
+	Base          string            // file name of the backup this one is incremental to, in the same directory
+	BaseID        string            // ID of the base backup
+	Blobs         []string          // every blob the database references, stored here or in a base backup
+	Files         map[string]string // archive entry -> sha256
+}
+
+type BackupReport struct {
+	Blobs    int   // blobs written to the archive
+	Skipped  int   // blobs left to the base backup
+	Removed  int   // blobs garbage collection deleted during the backup, left out with their references
+	Bytes    int64 // bytes of blob data written
+	Database int64 // size of the database copy
+	Manifest BackupManifest
+}
+
+// Backup writes a backup of the mirror to out, holding only blobs missing from base if it is not empty
+func Backup(db *sql.DB, blobs BlobStore, out string, base string) (BackupReport, error) {
+	var report BackupReport
+	manifest := BackupManifest{
+		Format:  backupFormat,
+		ID:      newBackupID(),
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Files:   make(map[string]string),
+	}
+
+	inBase := make(map[string]bool)
+	if base != "" {
+		baseManifest, err := ReadBackupManifest(base)
+		if err != nil {
+			return report, fmt.Errorf("failed to read base backup: %w", err)
+		}
+		if filepath.Dir(filepath.Clean(base)) != filepath.Dir(filepath.Clean(out)) {
+			return report, errors.New("an incremental backup must be written next to its base backup")
+		}
+		manifest.Base = filepath.Base(base)
+		manifest.BaseID = baseManifest.ID
+		for _, checksum := range baseManifest.Blobs {
+			inBase[checksum] = true
+		}
+	}
+
+	snapshot := out + ".db-tmp"
+	os.Remove(snapshot)
+	_, err := db.Exec("VACUUM INTO ?", snapshot)
+	if err != nil {
+		return report, fmt.Errorf("failed to copy database: %w", err)
+	}
+	defer os.Remove(snapshot)
+
+	// the blob list comes from the copy, so it matches the database in the archive
+	snapshotDB, err := sql.Open("sqlite3", snapshot)
+	if err != nil {
+		return report, err
+	}
+	defer snapshotDB.Close()
+	manifest.SchemaVersion, err = SchemaVersion(snapshotDB)
+	if err == nil {
+		manifest.Blobs, err = listBlobChecksums(snapshotDB)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	tmp := out + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return report, err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+	archive := tar.NewWriter(file)
+
+	collected := make(map[string]bool)
+	for _, checksum := range manifest.Blobs {
+		if inBase[checksum] {
+			report.Skipped++
+			continue
+		}
+		data, err := blobs.Get(checksum)
+		if errors.Is(err, ErrBlobNotFound) {
+			if has, err := HasBlob(db, checksum); err != nil || has {
+				return report, fmt.Errorf("blob %s is in the database but missing from the blob store", checksum)
+			}
+			collected[checksum] = true
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		name := backupBlobsDir + checksum
+		manifest.Files[name], err = writeTarEntry(archive, name, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			return report, err
+		}
+		report.Blobs++
+		report.Bytes += int64(len(data))
+	}
+	if len(collected) > 0 {
+		err = dropBackupBlobs(snapshotDB, collected)
+		if err != nil {
+			return report, err
+		}
+		kept := make([]string, 0, len(manifest.Blobs)-len(collected))
+		for _, checksum := range manifest.Blobs {
+			if !collected[checksum] {
+				kept = append(kept, checksum)
+			}
+		}
+		manifest.Blobs = kept
+		report.Removed = len(collected)
+	}
+	err = snapshotDB.Close()
+	if err != nil {
+		return report, err
+	}
+
+	dbFile, err := os.Open(snapshot)
+	if err != nil {
+		return report, err
+	}
+	info, err := dbFile.Stat()
+	if err != nil {
+		dbFile.Close()
+		return report, err
+	}
+	report.Database = info.Size()
+	manifest.Files[backupDBName], err = writeTarEntry(archive, backupDBName, info.Size(), dbFile)
+	dbFile.Close()
+	if err != nil {
+		return report, err
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	_, err = writeTarEntry(archive, backupManifestName, int64(len(manifestBytes)), bytes.NewReader(manifestBytes))
+	if err != nil {
+		return report, err
+	}
+	err = archive.Close()
+	if err != nil {
+		return report, err
+	}
+	err = file.Close()
+	if err != nil {
+		return report, err
+	}
+	report.Manifest = manifest
+	return report, os.Rename(tmp, out)
+}
+
+func PrintBackupReport(report BackupReport, out string) {
+	fmt.Println(color.CyanString("[backup]"), "Wrote database", fmt.Sprintf("(%s, schema version %d)", FormatSize(report.Database), report.Manifest.SchemaVersion),
+		"and", report.Blobs, "blobs", fmt.Sprintf("(%s)", FormatSize(report.Bytes)), "to", out)
+	if report.Manifest.Base != "" {
+		fmt.Println(color.CyanString("[backup]"), "Incremental to", report.Manifest.Base+",", report.Skipped, "blobs are in earlier backups")
+	}
+	if report.Removed > 0 {
+		fmt.Println(color.CyanString("[backup]"), "Left out", report.Removed, "blobs garbage collection deleted during the backup")
+	}
+}
+
+// ReadBackupManifest reads the manifest of a backup archive
+func ReadBackupManifest(path string) (BackupManifest, error) {
+	var manifest BackupManifest
+	file, err := os.Open(path)
+	if err != nil {
+		return manifest, err
+	}
+	defer file.Close()
+
+	archive := tar.NewReader(file)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return manifest, fmt.Errorf("%s has no manifest, it is not a dit-mirror backup or it is incomplete", path)
+		} else if err != nil {
+			return manifest, err
+		}
+		if header.Name != backupManifestName {
+			continue
+		}
+		err = json.NewDecoder(archive).Decode(&manifest)
+		if err != nil {
+			return manifest, fmt.Errorf("invalid manifest in %s: %w", path, err)
+		}
+		if manifest.Format != backupFormat {
+			return manifest, fmt.Errorf("%s has backup format %d, this dit-mirror reads format %d", path, manifest.Format, backupFormat)
+		}
+		return manifest, nil
+	}
+}
+
+// Restore rebuilds a mirror from a backup and the backups it is incremental to. The database is only put in
+// place once every entry has been verified against the manifests and every blob against its checksum.
+// With dryRun the archives are verified and nothing is written.
+func Restore(archivePath string, dbPath string, blobs BlobStore, dryRun bool) (int, error) {
+	if _, err := os.Stat(dbPath); err == nil && !dryRun {
+		return 0, fmt.Errorf("database %s already exists, move it away before restoring", dbPath)
+	}
+
+	// the newest backup holds the database, its bases may hold some of the blobs
+	chain := []string{archivePath}
+	manifests := make([]BackupManifest, 0)
+	for path := archivePath; ; {
+		manifest, err := ReadBackupManifest(path)
+		if err != nil {
+			return 0, err
+		}
+		if len(manifests) > 0 && manifests[len(manifests)-1].BaseID != manifest.ID {
+			return 0, fmt.Errorf("%s is not the backup %s was made from", path, chain[len(chain)-2])
+		}
+		manifests = append(manifests, manifest)
+		if manifest.Base == "" {
+			break
+		}
+		path = filepath.Join(filepath.Dir(archivePath), manifest.Base)
+		chain = append(chain, path)
+	}
+
+	tmpDB := dbPath + ".restore-tmp"
+	os.Remove(tmpDB)
+	defer os.Remove(tmpDB)
+	needed := make(map[string]bool)
+	for _, checksum := range manifests[0].Blobs {
+		needed[checksum] = true
+	}
+
+	// the blobs are verified against the database, which newer backups write after them
+	err := extractBackupDB(archivePath, manifests[0], tmpDB)
+	if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", tmpDB)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	restored := 0
+	for i, path := range chain {
+		file, err := os.Open(path)
+		if err != nil {
+			return restored, err
+		}
+		seen := 0
+		archive := tar.NewReader(file)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				file.Close()
+				return restored, fmt.Errorf("%s: %w", path, err)
+			}
+			if header.Name == backupManifestName {
+				continue
+			}
+			expected, ok := manifests[i].Files[header.Name]
+			if !ok {
+				file.Close()
+				return restored, fmt.Errorf("%s: unexpected entry %s", path, header.Name)
+			}
+			data, err := io.ReadAll(archive)
+			if err != nil {
+				file.Close()
+				return restored, fmt.Errorf("%s: %w", path, err)
+			}
+			sum := sha256.Sum256(data)
+			if hex.EncodeToString(sum[:]) != expected {
+				file.Close()
+				return restored, fmt.Errorf("%s: %s is corrupt, its checksum does not match the manifest", path, header.Name)
+			}
+			seen++
+
+			if header.Name == backupDBName {
+				continue // only the newest database is restored, it is extracted already
+			}
+
+			checksum := strings.TrimPrefix(header.Name, backupBlobsDir)
+			if !needed[checksum] {
+				continue // referenced by a base backup only
+			}
+			var isGZIP bool
+			err = db.QueryRow("SELECT isGZIP FROM blobs WHERE checksum = ?", checksum).Scan(&isGZIP)
+			if err == nil {
+				err = VerifyBlob(checksum, data, isGZIP)
+			}
+			if err != nil {
+				file.Close()
+				return restored, fmt.Errorf("%s: blob %s: %w", path, checksum, err)
+			}
+			if !dryRun {
+				err = blobs.Put(checksum, data)
+				if err != nil {
+					file.Close()
+					return restored, err
+				}
+			}
+			delete(needed, checksum)
+			restored++
+		}
+		file.Close()
+		if seen != len(manifests[i].Files) {
+			return restored, fmt.Errorf("%s is incomplete, %d of %d entries found", path, seen, len(manifests[i].Files))
+		}
+	}
+
+	if len(needed) > 0 {
+		return restored, fmt.Errorf("%d blobs are missing from %s and its base backups", len(needed), archivePath)
+	}
+	db.Close()
+	if dryRun {
+		return restored, nil
+	}
+	return restored, os.Rename(tmpDB, dbPath)
+}
+
+// extractBackupDB writes the database of a backup to path after checking it against the manifest
+func extractBackupDB(archivePath string, manifest BackupManifest, path string) error {
+	expected, ok := manifest.Files[backupDBName]
+	if !ok {
+		return fmt.Errorf("%s has no database", archivePath)
+	}
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	archive := tar.NewReader(file)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s has no database", archivePath)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", archivePath, err)
+		}
+		if header.Name != backupDBName {
+			continue
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return fmt.Errorf("%s: %w", archivePath, err)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != expected {
+			return fmt.Errorf("%s: %s is corrupt, its checksum does not match the manifest", archivePath, backupDBName)
+		}
+		return os.WriteFile(path, data, 0644)
+	}
+}
+
+// listBlobChecksums returns the blobs a database references. Unreferenced blobs are deleted from it first, they
+// are staged for a commit that is not in the copy or waiting for garbage collection, which may delete them any time.
+func listBlobChecksums(db *sql.DB) ([]string, error) {
+	_, err := db.Exec(`DELETE FROM blobs WHERE checksum NOT IN (SELECT checksum FROM files UNION SELECT checksum FROM file_versions
+		UNION SELECT checksum FROM snapshot_files UNION SELECT checksum FROM trash)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("DELETE FROM blob_uploads")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT checksum FROM blobs ORDER BY checksum")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := make([]string, 0)
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+	return checksums, rows.Err()
+}
+
+// dropBackupBlobs removes the blobs garbage collection deleted from the copy of the database, with every reference
+// to them. The mirror does not reference them anymore either, they belonged to expired versions, snapshots or trash.
+func dropBackupBlobs(db *sql.DB, checksums map[string]bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for checksum := range checksums {
+		for _, table := range []string{"files", "file_versions", "snapshot_files", "trash", "blobs"} {
+			_, err = tx.Exec("DELETE FROM "+table+" WHERE checksum = ?", checksum)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// writeTarEntry adds a file to the archive and returns the sha256 of its content
+func writeTarEntry(archive *tar.Writer, name string, size int64, content io.Reader) (string, error) {
+	err := archive.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(archive, hash), content)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newBackupID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(id)
+}
@@ -0,0 +1,88 @@
+package ditmirror
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+// collectingBlobStore deletes a blob, as garbage collection would, right before the backup reads it
+type collectingBlobStore struct {
+	BlobStore
+	db      *sql.DB
+	collect string
+}
+
+func (s collectingBlobStore) Get(checksum string) ([]byte, error) {
+	if checksum == s.collect {
+		s.db.Exec("DELETE FROM file_versions WHERE checksum = ?", checksum)
+		s.db.Exec("DELETE FROM blobs WHERE checksum = ?", checksum)
+		s.BlobStore.Delete(checksum)
+	}
+	return s.BlobStore.Get(checksum)
+}
+
+func TestBackupSkipsBlobsCollectedDuringTheBackup(t *testing.T) {
+	db, blobs := newTestDB(t)
+	contents := map[string]string{"kept": "current file", "expired": "old version", "staged": "not committed yet"}
+	checksums := make(map[string]string)
+	for name, content := range contents {
+		checksums[name] = ditsync.DataChecksum([]byte(content))
+		if err := PutBlob(db, blobs, checksums[name], []byte(content), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SyncFileToDB(db, "alice", "/p", "a.txt", checksums["kept"]); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec("INSERT INTO file_versions (author, parcel, path, checksum, created) VALUES ('alice', '/p', 'a.txt', ?, '2020-01-01T00:00:00Z')", checksums["expired"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "backup.tar")
+	report, err := Backup(db, collectingBlobStore{BlobStore: blobs, db: db, collect: checksums["expired"]}, archive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Removed != 1 || report.Blobs != 1 {
+		t.Fatalf("backup report: %+v", report)
+	}
+	if len(report.Manifest.Blobs) != 1 || report.Manifest.Blobs[0] != checksums["kept"] {
+		t.Fatalf("the backup lists blobs %v, want only the referenced one", report.Manifest.Blobs)
+	}
+
+	restoreDir := t.TempDir()
+	restoredBlobs, err := NewFSBlobStore(filepath.Join(restoreDir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(restoreDir, "dit.db")
+	restored, err := Restore(archive, dbPath, restoredBlobs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 {
+		t.Fatalf("restored %d blobs, want 1", restored)
+	}
+	restoredDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restoredDB.Close()
+	var versions, blobRows int
+	restoredDB.QueryRow("SELECT COUNT(*) FROM file_versions WHERE checksum = ?", checksums["expired"]).Scan(&versions)
+	restoredDB.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobRows)
+	if versions != 0 || blobRows != 1 {
+		t.Fatalf("the restored database has %d versions of the collected blob and %d blobs", versions, blobRows)
+	}
+	if _, err := restoredBlobs.Get(checksums["kept"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoredBlobs.Get(checksums["staged"]); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("the staged blob was restored: %v", err)
+	}
+}
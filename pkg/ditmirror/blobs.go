@@ -0,0 +1,208 @@
+package ditmirror
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+// File data is stored once per checksum in a BlobStore, the blobs table keeps its metadata and file entries
+// reference it by checksum. Identical content is shared between paths, parcels and authors, but an author only
+// learns that the mirror has a blob, or gets to reference it without sending the data, if the author already
+// references it or uploaded it. Otherwise anyone could probe for or claim the files of others by checksum.
+
+var ErrMissingBlob = errors.New("mirror does not have the file data, upload it again")
+
+func hasColumn(db querier, table string, column string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// migrateInlineFileData moves data stored in the files table by older mirrors into the blob store
+func migrateInlineFileData(db querier, blobs BlobStore) error {
+	hasData, err := hasColumn(db, "files", "data")
+	if err != nil || !hasData {
+		return err
+	}
+
+	slog.Info("moving file data into blob store")
+	rows, err := db.Query("SELECT DISTINCT checksum FROM files")
+	if err != nil {
+		return err
+	}
+	checksums := make([]string, 0)
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			rows.Close()
+			return err
+		}
+		checksums = append(checksums, checksum)
+	}
+	rows.Close()
+
+	for _, checksum := range checksums { // one at a time, the data can be large
+		var data []byte
+		var isGZIP bool
+		err = db.QueryRow("SELECT data, isGZIP FROM files WHERE checksum = ? LIMIT 1", checksum).Scan(&data, &isGZIP)
+		if err != nil {
+			return err
+		}
+		err = PutBlob(db, blobs, checksum, data, isGZIP)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec("alter table files drop column data; alter table files drop column isGZIP;")
+	return err
+}
+
+// migrateInlineBlobData moves data stored in the blobs table into the blob store
+func migrateInlineBlobData(db querier, blobs BlobStore) error {
+	hasData, err := hasColumn(db, "blobs", "data")
+	if err != nil || !hasData {
+		return err
+	}
+
+	slog.Info("moving blob data into blob store")
+	rows, err := db.Query("SELECT checksum, data FROM blobs WHERE data IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var checksum string
+		var data []byte
+		if err := rows.Scan(&checksum, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := blobs.Put(checksum, data); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec("alter table blobs drop column data")
+	return err
+}
+
+// VerifyBlob checks that the uploaded data hashes to the checksum it is stored under, encrypted data is only checked for its form
+func VerifyBlob(checksum string, data []byte, isGZIP bool) error {
+	if ditsync.IsEncryptedBlob(checksum) {
+		// only the client can check encrypted data, it is authenticated when it is decrypted
+		if isGZIP {
+			return errors.New("encrypted data is compressed before it is encrypted")
+		}
+		if !ditsync.ValidEncryptedBlobID(checksum) || len(data) < ditsync.ENCRYPTED_BLOB_OVERHEAD {
+			return errors.New("invalid encrypted data")
+		}
+		return nil
+	}
+	raw := data
+	if isGZIP {
+		var err error
+		raw, err = ditsync.GZIPDecompress(data)
+		if err != nil {
+			return fmt.Errorf("failed to decompress data: %w", err)
+		}
+	}
+	if ditsync.DataChecksum(raw) != checksum {
+		return errors.New("checksum does not match data")
+	}
+	return nil
+}
+
+// PutBlob writes the data to the blob store before recording it, so a recorded blob always has data
+func PutBlob(db querier, blobs BlobStore, checksum string, data []byte, isGZIP bool) error {
+	has, err := HasBlob(db, checksum)
+	if err != nil || has {
+		return err
+	}
+	err = blobs.Put(checksum, data)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err = db.Exec("INSERT OR IGNORE INTO blobs (checksum, isGZIP, size, created) VALUES (?, ?, ?, ?)", checksum, isGZIP, len(data), timestamp)
+	return err
+}
+
+func HasBlob(db querier, checksum string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM blobs WHERE checksum = ?", checksum).Scan(&count)
+	return count > 0, err
+}
+
+// RecordUpload notes that author sent the data of a blob, so a commit of the author can reference it
+func RecordUpload(db execer, author string, checksum string) error {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.Exec("INSERT INTO blob_uploads (author, checksum, created) VALUES (?, ?, ?) ON CONFLICT (author, checksum) DO UPDATE SET created = excluded.created",
+		author, checksum, timestamp)
+	return err
+}
+
+// AuthorHasBlob reports whether the mirror has a blob that author references or uploaded, only then may the
+// author reference it without sending the data
+func AuthorHasBlob(db querier, author string, checksum string) (bool, error) {
+	var has bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM blobs WHERE checksum = ?)
+		AND (EXISTS (SELECT 1 FROM blob_uploads WHERE author = ? AND checksum = ?) OR `+referencedByAuthor+`)`,
+		checksum, author, checksum, author, checksum, author, checksum, author, checksum, author, checksum).Scan(&has)
+	return has, err
+}
+
+// referencedByAuthor is true if the blob is stored for the author, the usage the author is charged for.
+// It takes the author and checksum four times.
+const referencedByAuthor = `(EXISTS (SELECT 1 FROM files WHERE author = ? AND checksum = ?)
+	OR EXISTS (SELECT 1 FROM file_versions WHERE author = ? AND checksum = ?)
+	OR EXISTS (SELECT 1 FROM snapshot_files f JOIN snapshots s ON s.id = f.snapshot_id WHERE s.author = ? AND f.checksum = ?)
+	OR EXISTS (SELECT 1 FROM trash WHERE author = ? AND checksum = ?))`
+
+// MissingBlobs returns the checksums author has to upload, every blob the author does not reference or uploaded
+func MissingBlobs(db *sql.DB, author string, checksums []string) ([]string, error) {
+	missing := make([]string, 0)
+	for _, checksum := range checksums {
+		has, err := AuthorHasBlob(db, author, checksum)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			missing = append(missing, checksum)
+		}
+	}
+	return missing, nil
+}
+
+func GetBlob(db *sql.DB, blobs BlobStore, checksum string) ([]byte, bool, error) {
+	var isGZIP bool
+	err := db.QueryRow("SELECT isGZIP FROM blobs WHERE checksum = ?", checksum).Scan(&isGZIP)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrMissingBlob
+	} else if err != nil {
+		return nil, false, err
+	}
+	data, err := blobs.Get(checksum)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, false, ErrMissingBlob
+	}
+	return data, isGZIP, err
+}
@@ -0,0 +1,57 @@
+package ditmirror
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+func (d *testDevice) missingBlobs(t *testing.T, checksums ...string) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(checksums)
+	resp := d.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: d.author, ParcelPath: "/p", MessageType: ditnet.MSG_HAS_BLOBS, Data: buf.Bytes()})
+	var missing []string
+	err := gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return missing
+}
+
+func TestDedupIsScopedToTheAuthor(t *testing.T) {
+	_, addr := startTestServer(t, DefaultSettings())
+	alice := newTestDevice(t, addr, "alice", "laptop")
+	mallory := newTestDevice(t, addr, "mallory", "laptop")
+	secret := "alice's password"
+	checksum := ditsync.DataChecksum([]byte(secret))
+	alice.syncUp(t, "/p", map[string]string{"passwords.txt": secret})
+
+	if missing := alice.missingBlobs(t, checksum); len(missing) != 0 {
+		t.Fatal("the mirror asks alice for data she already stored")
+	}
+	if missing := mallory.missingBlobs(t, checksum); len(missing) != 1 {
+		t.Fatal("the mirror confirmed to mallory that it stores alice's file")
+	}
+
+	var masterBytes bytes.Buffer
+	gob.NewEncoder(&masterBytes).Encode(ditnet.NetMaster{Master: map[string]string{"stolen.txt": checksum}})
+	commit := ditnet.ClientMessage{OriginAuthor: "mallory", ParcelPath: "/p", MessageType: ditnet.MSG_COMMIT, Data: masterBytes.Bytes()}
+	if resp := mallory.send(t, commit); resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatal("mallory committed alice's blob without sending its data")
+	}
+	omitted := ditnet.ClientMessage{OriginAuthor: "mallory", ParcelPath: "/p", MessageType: ditnet.MSG_SYNC_FILE,
+		Message: "stolen.txt", Message2: checksum, DataOmitted: true}
+	if resp := mallory.send(t, omitted); resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatal("mallory synced alice's blob without sending its data")
+	}
+
+	// whoever has the data can store it, the blob is still stored once
+	mallory.syncUp(t, "/p", map[string]string{"stolen.txt": secret})
+	if got := mallory.getFile(t, "mallory", "/p", "stolen.txt"); got != secret {
+		t.Fatalf("got %q back", got)
+	}
+}
@@ -0,0 +1,131 @@
+package ditmirror
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore holds file data by key (the checksum). The database only keeps metadata about blobs.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Stat(key string) (BlobInfo, error)     // returns ErrBlobNotFound if the key does not exist
+	List(visit func(BlobInfo) error) error // calls visit for every blob in no particular order, stops at the first error
+}
+
+// FSBlobStore stores blobs as files in a directory, sharded by the first characters of the key
+type FSBlobStore struct {
+	Root string
+}
+
+func NewFSBlobStore(root string) (*FSBlobStore, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FSBlobStore{Root: root}, nil
+}
+
+func (s *FSBlobStore) path(key string) (string, error) {
+	if len(key) < 4 || strings.ContainsAny(key, "/\\.") {
+		return "", errors.New("invalid blob key")
+	}
+	return filepath.Join(s.Root, key[0:2], key[2:4], key), nil
+}
+
+func (s *FSBlobStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FSBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *FSBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FSBlobStore) Stat(key string) (BlobInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return BlobInfo{}, ErrBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *FSBlobStore) List(visit func(BlobInfo) error) error {
+	return filepath.WalkDir(s.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if strings.Contains(entry.Name(), ".") { // a temporary file of Put, or not a blob
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // deleted while listing
+		} else if err != nil {
+			return err
+		}
+		return visit(BlobInfo{Key: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
@@ -0,0 +1,557 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditmaster"
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown was called
+var ErrServerClosed = errors.New("ditmirror: server closed")
+
+// Options of a Server, DB and Blobs are required
+type Options struct {
+	DB                  *sql.DB       // migrated with MigrateDB, the caller closes it after Shutdown
+	DBPath              string        // file of DB, reported in the metrics
+	Blobs               BlobStore     // file data
+	Settings            *Settings     // DefaultSettings if nil, see SetSettings
+	GCInterval          time.Duration // collect garbage in the background this often, 0 disables it
+	GCGrace             time.Duration // keep unreferenced file data younger than this, it may be staged for a commit
+	ReplicationInterval time.Duration // how often a follower pulls changes from its leader, 5s if 0
+}
+
+// Server answers dit clients and other mirrors on the listeners given to Serve. The garbage collector and the
+// replication worker run in the background from the first call to Serve until Shutdown.
+type Server struct {
+	db                  *sql.DB
+	dbPath              string
+	blobs               BlobStore
+	gcInterval          time.Duration
+	gcGrace             time.Duration
+	replicationInterval time.Duration
+	settings            atomic.Pointer[Settings]
+
+	// gcLock is held for reading while a request stores or references blobs, and for writing while garbage is
+	// deleted. A commit either references a blob before it can be collected, or fails because the blob is missing.
+	gcLock sync.RWMutex
+
+	metrics  *mirrorMetrics
+	tracker  *connTracker
+	draining atomic.Bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	started   bool
+	stop      chan struct{} // closed by Shutdown, stops the background workers
+	workers   sync.WaitGroup
+}
+
+// NewServer returns a server for a migrated database and its blob store
+func NewServer(opts Options) (*Server, error) {
+	if opts.DB == nil || opts.Blobs == nil {
+		return nil, errors.New("ditmirror: a server needs a database and a blob store")
+	}
+	if opts.GCInterval < 0 || opts.GCGrace < 0 || opts.ReplicationInterval < 0 {
+		return nil, errors.New("ditmirror: intervals must not be negative")
+	}
+	if opts.ReplicationInterval == 0 {
+		opts.ReplicationInterval = 5 * time.Second
+	}
+	s := &Server{
+		db:                  opts.DB,
+		dbPath:              opts.DBPath,
+		blobs:               opts.Blobs,
+		gcInterval:          opts.GCInterval,
+		gcGrace:             opts.GCGrace,
+		replicationInterval: opts.ReplicationInterval,
+		metrics:             newMirrorMetrics(),
+		tracker:             newConnTracker(),
+		listeners:           make(map[net.Listener]struct{}),
+		stop:                make(chan struct{}),
+	}
+	if opts.Settings != nil {
+		s.SetSettings(*opts.Settings)
+	} else {
+		s.SetSettings(DefaultSettings())
+	}
+	return s, nil
+}
+
+// Serve handles the connections accepted on l until Shutdown is called, then it returns ErrServerClosed. Serve can
+// be called for several listeners at once, it closes l when it returns.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	s.mu.Lock()
+	if s.draining.Load() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	if !s.started {
+		s.started = true
+		s.startWorkers()
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.draining.Load() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.tracker.add(c) {
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.tracker.done(c)
+			s.handleConnection(c)
+		}()
+	}
+}
+
+// startWorkers starts the garbage collector and the replication worker, they return once stop is closed
+func (s *Server) startWorkers() {
+	if s.gcInterval > 0 {
+		slog.Info("collecting garbage in the background", "interval", s.gcInterval)
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.runGCScheduler()
+		}()
+	}
+	if state, following, err := GetReplicationState(s.db); err == nil && following {
+		slog.Info("following leader", "leader", state.Leader)
+	}
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.runReplication()
+	}()
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	started := time.Now()
+	db, blobs, cfg := s.db, s.blobs, s.Settings()
+	remote := conn.RemoteAddr().String()
+	c := newRequestConn(conn, s.metrics)
+	defer c.Close()
+	s.metrics.active.Add(1)
+	defer s.metrics.active.Add(-1)
+	defer c.finish(started)
+
+	dec := gob.NewDecoder(c)
+	msg := &ditnet.ClientMessage{}
+	err := dec.Decode(msg)
+	if err != nil {
+		logAttrs(c, "err", err) // logged as a dropped request
+		return
+	}
+	c.identify(msg)
+
+	requester, err := AuthenticateMessage(db, msg)
+	if err != nil {
+		AuditLog(db, AUDIT_AUTH_FAIL, msg.Requester, remote, msg.ParcelPath, msg.Message, msg.Device+": "+err.Error())
+		sendFailure(c, err.Error())
+		return
+	}
+
+	if isWriteMessage(msg.MessageType) {
+		state, following, err := GetReplicationState(db)
+		if err != nil {
+			c.log.Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		if following {
+			sendFailure(c, "this mirror is a read-only follower of "+state.Leader+", sync with the leader instead")
+			return
+		}
+	}
+
+	if msg.MessageType == ditnet.MSG_SYNC_FILE {
+		logAttrs(c, "file", msg.Message)
+		if err := AuthorizeAuthor(db, msg.OriginAuthor, requester); err != nil {
+			AuditLog(db, AUDIT_AUTH_FAIL, msg.OriginAuthor, remote, msg.ParcelPath, msg.Message, "sync")
+			sendFailure(c, err.Error())
+			return
+		}
+		if err := CheckParcelBlob(db, msg.OriginAuthor, msg.ParcelPath, msg.Message2); err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		s.gcLock.RLock()
+		defer s.gcLock.RUnlock()
+
+		size := int64(len(msg.Data))
+		if msg.DataOmitted {
+			has, err := AuthorHasBlob(db, strings.TrimPrefix(msg.OriginAuthor, "@"), msg.Message2)
+			if err == nil && has {
+				size, err = GetBlobSize(db, msg.Message2)
+			}
+			if err != nil || !has {
+				sendFailure(c, ErrMissingBlob.Error())
+				return
+			}
+		}
+		err = CheckQuota(db, cfg, msg.OriginAuthor, msg.ParcelPath, msg.Message, msg.Message2, size)
+		if errors.Is(err, ErrQuotaExceeded) {
+			sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_QUOTA_EXCEEDED, Message: err.Error()})
+			return
+		} else if err != nil {
+			c.log.Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+
+		if !msg.DataOmitted {
+			err = VerifyBlob(msg.Message2, msg.Data, msg.IsGZIP)
+			if err != nil {
+				sendFailure(c, err.Error())
+				return
+			}
+			err = PutBlob(db, blobs, msg.Message2, msg.Data, msg.IsGZIP)
+			if err != nil {
+				c.log.Error("db error", "err", err)
+				sendFailure(c, "db error")
+				return
+			}
+		}
+		err = EnsureParcel(db, msg.OriginAuthor, msg.ParcelPath)
+		if err != nil {
+			c.log.Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		err = syncFile(db, cfg, msg, requester, remote)
+		if err != nil {
+			c.log.Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: "OK"})
+	} else if msg.MessageType == ditnet.MSG_GET_PARCEL {
+		if !CanRead(db, msg.OriginAuthor, msg.ParcelPath, requester) {
+			AuditLog(db, AUDIT_AUTH_FAIL, msg.OriginAuthor, remote, msg.ParcelPath, "", "read by @"+requester)
+			sendFailure(c, ErrParcelAccess.Error())
+			return
+		}
+		var snapshot int64
+		if msg.Message != "" { // tag name
+			snapshot, err = ResolveTag(db, msg.OriginAuthor, msg.ParcelPath, msg.Message)
+			if err != nil {
+				sendFailure(c, err.Error())
+				return
+			}
+		}
+		netparcel, err := GetParcelFiles(db, msg.OriginAuthor, msg.ParcelPath, snapshot)
+		if err != nil {
+			c.log.Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+
+		// gob encode nparcel to bytes
+		var parcelBytes bytes.Buffer
+		enc := gob.NewEncoder(&parcelBytes)
+		err = enc.Encode(netparcel)
+		if err != nil {
+			c.log.Error("gob encode error", "err", err)
+			sendFailure(c, "encode error")
+			return
+		}
+
+		sendServerMessage(c, ditnet.ServerMessage{
+			MessageType: ditnet.MSG_PARCEL,
+			Message:     "@" + msg.OriginAuthor + msg.ParcelPath,
+			Data:        parcelBytes.Bytes(),
+		})
+
+	} else if msg.MessageType == ditnet.MSG_GET_FILE {
+		logAttrs(c, "file", msg.Message)
+		if !CanRead(db, msg.OriginAuthor, msg.ParcelPath, requester) {
+			AuditLog(db, AUDIT_AUTH_FAIL, msg.OriginAuthor, remote, msg.ParcelPath, msg.Message, "read by @"+requester)
+			sendFailure(c, ErrParcelAccess.Error())
+			return
+		}
+		var filedata []byte
+		var gzip bool
+		if msg.Message2 != "" { // read from the snapshot the client listed
+			snapshot, err := strconv.ParseInt(msg.Message2, 10, 64)
+			if err != nil {
+				sendFailure(c, "invalid snapshot")
+				return
+			}
+			filedata, gzip, err = GetSnapshotFile(db, blobs, msg.OriginAuthor, msg.ParcelPath, snapshot, msg.Message)
+		} else {
+			filedata, gzip, err = GetFile(db, blobs, msg.OriginAuthor, msg.ParcelPath, msg.Message)
+		}
+		if err != nil {
+			c.log.Warn("file not served", "file", msg.Message, "err", err)
+			sendFailure(c, err.Error())
+			return
+		}
+
+		sendServerMessage(c, ditnet.ServerMessage{
+			MessageType: ditnet.MSG_FILE,
+			Message:     msg.Message,
+			Data:        filedata,
+			IsGZIP:      gzip,
+		})
+	} else if msg.MessageType == ditnet.MSG_SYNC_MASTER {
+		if err := AuthorizeAuthor(db, msg.OriginAuthor, requester); err != nil {
+			AuditLog(db, AUDIT_AUTH_FAIL, msg.OriginAuthor, remote, msg.ParcelPath, "", "sync master")
+			sendFailure(c, err.Error())
+			return
+		}
+		// decode to netmaster
+		var netmaster ditnet.NetMaster
+		dec := gob.NewDecoder(bytes.NewReader(msg.Data))
+		err := dec.Decode(&netmaster)
+		if err != nil {
+			c.log.Warn("gob decode error", "err", err)
+			sendFailure(c, "invalid master")
+			return
+		}
+
+		removed, err := RemoveFilesNotInMaster(db, cfg, msg.OriginAuthor, msg.ParcelPath, netmaster.Master, requester, msg.Device, remote)
+		if err == nil && removed > 0 {
+			_, err = SnapshotParcel(db, cfg, msg.OriginAuthor, msg.ParcelPath, requester, msg.Device)
+		}
+		if errors.Is(err, ErrTooManyRemovals) {
+			sendFailure(c, err.Error())
+			return
+		} else if err != nil {
+			c.log.Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		logAttrs(c, "removed", removed)
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: strconv.Itoa(removed)})
+
+	} else if msg.MessageType == ditnet.MSG_HAS_BLOBS {
+		if err := AuthorizeAuthor(db, msg.OriginAuthor, requester); err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		var checksums []string
+		err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(&checksums)
+		if err != nil {
+			c.log.Warn("gob decode error", "err", err)
+			sendFailure(c, "invalid checksum list")
+			return
+		}
+		missing, err := MissingBlobs(db, strings.TrimPrefix(msg.OriginAuthor, "@"), checksums)
+		if err != nil {
+			c.log.Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		var missingBytes bytes.Buffer
+		err = gob.NewEncoder(&missingBytes).Encode(missing)
+		if err != nil {
+			c.log.Error("gob encode error", "err", err)
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_BLOBS, Data: missingBytes.Bytes()})
+	} else if msg.MessageType == ditnet.MSG_PUT_BLOB || msg.MessageType == ditnet.MSG_COMMIT || msg.MessageType == ditnet.MSG_PREVIEW_COMMIT {
+		s.handleSnapshotMessage(c, cfg, msg, requester, remote)
+	} else if msg.MessageType == ditnet.MSG_CREATE_TAG || msg.MessageType == ditnet.MSG_LIST_TAGS || msg.MessageType == ditnet.MSG_DELETE_TAG {
+		handleTagMessage(c, db, msg, requester, remote)
+	} else if msg.MessageType == ditnet.MSG_LIST_VERSIONS || msg.MessageType == ditnet.MSG_GET_VERSION {
+		handleVersionMessage(c, db, blobs, msg, requester, remote)
+	} else if msg.MessageType == ditnet.MSG_LIST_TRASH || msg.MessageType == ditnet.MSG_RESTORE_TRASH {
+		s.handleTrashMessage(c, cfg, msg, requester, remote)
+	} else if msg.MessageType == ditnet.MSG_REPL_CHANGES || msg.MessageType == ditnet.MSG_REPL_BLOB {
+		handleReplicationMessage(c, db, blobs, cfg, msg, remote)
+	} else if msg.MessageType == ditnet.MSG_ADMIN {
+		handleAdminMessage(c, db, cfg, msg, remote)
+	} else if msg.MessageType == ditnet.MSG_GET_QUOTA {
+		handleQuotaMessage(c, db, cfg, msg, requester)
+	} else if msg.MessageType == ditnet.MSG_ADD_KEY || msg.MessageType == ditnet.MSG_REVOKE_KEY || msg.MessageType == ditnet.MSG_LIST_KEYS {
+		handleKeyMessage(c, db, msg, requester, remote)
+	} else if msg.MessageType == ditnet.MSG_SET_VISIBILITY || msg.MessageType == ditnet.MSG_SHARE_PARCEL ||
+		msg.MessageType == ditnet.MSG_SET_PARCEL_KEYS || msg.MessageType == ditnet.MSG_GET_PARCEL_KEY {
+		handleParcelMessage(c, db, msg, requester, remote)
+	} else {
+		sendFailure(c, "unknown message type")
+	}
+}
+
+func sendServerMessage(c net.Conn, msg ditnet.ServerMessage) {
+	logReply(c, msg)
+	enc := gob.NewEncoder(c)
+	err := enc.Encode(msg)
+	if err != nil {
+		connLogger(c).Warn("failed to send reply", "err", err)
+	}
+}
+
+func sendFailure(c net.Conn, reason string) {
+	sendServerMessage(c, ditnet.ServerMessage{
+		MessageType: ditnet.MSG_FAILURE,
+		Message:     reason,
+	})
+}
+
+// RemoveFilesNotInMaster moves the files of one parcel that are no longer in the client's master record to the trash.
+// Older clients send the master record without a preview, so the removals are held to the deletion limits of the mirror.
+func RemoveFilesNotInMaster(db *sql.DB, cfg *Settings, author string, parcelpath string, master map[string]string, requester string, device string, remote string) (int, error) {
+	author = strings.TrimPrefix(author, "@")
+	del_tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer del_tx.Rollback()
+
+	current, err := parcelFiles(del_tx, author, parcelpath)
+	if err != nil {
+		return 0, err
+	}
+	removedFiles := make(map[string]string) // path -> checksum
+	for path, checksum := range current {
+		if master[path] == "" {
+			removedFiles[path] = checksum
+		}
+	}
+	if len(removedFiles) == 0 {
+		return 0, nil
+	}
+	err = checkUnconfirmedRemovals(cfg, len(removedFiles), len(current))
+	if err != nil {
+		return 0, err
+	}
+
+	for path, checksum := range removedFiles {
+		slog.Debug("moving file to trash", "author", author, "parcel", parcelpath, "path", path)
+		_, err = del_tx.Exec("DELETE FROM files WHERE author=? AND parcel=? AND path=?", author, parcelpath, path)
+		if err != nil {
+			return 0, err
+		}
+		err = TrashFile(del_tx, author, parcelpath, path, checksum, requester, device)
+		if err != nil {
+			return 0, err
+		}
+		AuditLog(del_tx, AUDIT_DELETE, author, remote, parcelpath, path, checksum)
+	}
+	err = del_tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return len(removedFiles), nil
+}
+
+// GetParcelFiles lists the files in a snapshot of a parcel, the latest one if snapshot is 0
+func GetParcelFiles(db *sql.DB, author string, parcel string, snapshot int64) (ditnet.NetParcel, error) {
+	author = strings.TrimPrefix(author, "@")
+	encrypted, err := IsEncrypted(db, author, parcel)
+	if err != nil {
+		return ditnet.NetParcel{}, err
+	}
+	info := ditmaster.ParcelInfo{Author: author, RepoPath: parcel, Encrypted: encrypted}
+	if snapshot == 0 {
+		snapshot, err = LatestSnapshot(db, author, parcel)
+		if err != nil {
+			return ditnet.NetParcel{}, err
+		}
+	}
+	if snapshot > 0 {
+		filePaths, err := GetSnapshotFiles(db, author, parcel, snapshot)
+		if err != nil {
+			return ditnet.NetParcel{}, err
+		}
+		return ditnet.NetParcel{
+			Info:       info,
+			FilePaths:  filePaths,
+			SnapshotID: snapshot,
+		}, nil
+	}
+
+	rows, err := db.Query("SELECT path FROM files WHERE author=? AND parcel=?", author, parcel)
+	if err != nil {
+		return ditnet.NetParcel{}, err
+	}
+	defer rows.Close()
+
+	filePaths := make([]string, 0)
+
+	for rows.Next() {
+		var filepath string
+		err = rows.Scan(&filepath)
+		if err != nil {
+			return ditnet.NetParcel{}, err
+		}
+		filePaths = append(filePaths, filepath)
+	}
+
+	netparcel := ditnet.NetParcel{
+		Info:      info,
+		FilePaths: filePaths,
+	}
+
+	return netparcel, nil
+}
+
+func GetFile(db *sql.DB, blobs BlobStore, author string, parcel string, file string) ([]byte, bool, error) {
+	author = strings.TrimPrefix(author, "@")
+	var checksum string
+	err := db.QueryRow("SELECT checksum FROM files WHERE author=? AND parcel=? AND path=?", author, parcel, file).Scan(&checksum)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return GetBlob(db, blobs, checksum)
+}
+
+// syncFile points the path at the uploaded blob and records the new version in one transaction.
+// Older clients sync with one MSG_SYNC_FILE per file, each of them is published as a snapshot.
+func syncFile(db *sql.DB, cfg *Settings, msg *ditnet.ClientMessage, requester string, remote string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = SyncFileToDB(tx, msg.OriginAuthor, msg.ParcelPath, msg.Message, msg.Message2)
+	if err != nil {
+		return err
+	}
+	err = RecordFileVersion(tx, cfg, msg.OriginAuthor, msg.ParcelPath, msg.Message, msg.Message2, requester, msg.Device)
+	if err != nil {
+		return err
+	}
+	AuditLog(tx, AUDIT_SYNC, msg.OriginAuthor, remote, msg.ParcelPath, msg.Message, msg.Message2)
+	err = legacySnapshot(tx, cfg, msg.OriginAuthor, msg.ParcelPath, requester, msg.Device)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func SyncFileToDB(db execer, author string, parcel string, path string, checksum string) error {
+	author = strings.TrimPrefix(author, "@")
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.Exec(`INSERT INTO files (author, parcel, path, checksum, created, last_sync) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (author, parcel, path) DO UPDATE SET checksum = excluded.checksum, last_sync = excluded.last_sync`,
+		author, parcel, path, checksum, timestamp, timestamp)
+	return err
+}
@@ -0,0 +1,236 @@
+package ditmirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+// newTestDB returns a migrated database in a temporary directory and a blob store next to it
+func newTestDB(t *testing.T) (*sql.DB, BlobStore) {
+	t.Helper()
+	dir := t.TempDir()
+	blobs, err := NewFSBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "dit.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = MigrateDB(db, dbPath, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, blobs
+}
+
+// startTestServer serves a new database on a loopback port until the test ends, it returns the server and its address
+func startTestServer(t *testing.T, settings Settings) (*Server, string) {
+	t.Helper()
+	db, blobs := newTestDB(t)
+	server, err := NewServer(Options{DB: db, Blobs: blobs, Settings: &settings, ReplicationInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		<-served
+	})
+	return server, l.Addr().String()
+}
+
+// testDevice signs messages for an author with a device key registered on a mirror
+type testDevice struct {
+	author string
+	device string
+	key    ed25519.PrivateKey
+	mirror string
+}
+
+func newTestDevice(t *testing.T, mirror string, author string, device string) *testDevice {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDevice{author: author, device: device, key: key, mirror: mirror}
+	d.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: author, MessageType: ditnet.MSG_ADD_KEY, Message: device, Data: pub})
+	return d
+}
+
+// addDevice registers a key for another device of the author, signed by this device
+func (d *testDevice) addDevice(t *testing.T, device string) *testDevice {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: d.author, MessageType: ditnet.MSG_ADD_KEY, Message: device, Data: pub})
+	return &testDevice{author: d.author, device: device, key: key, mirror: d.mirror}
+}
+
+func (d *testDevice) send(t *testing.T, msg ditnet.ClientMessage) ditnet.ServerMessage {
+	t.Helper()
+	msg.Sign(d.author, d.device, d.key)
+	resp, err := ditnet.ExchangeMessage(msg, d.mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func (d *testDevice) mustSucceed(t *testing.T, msg ditnet.ClientMessage) ditnet.ServerMessage {
+	t.Helper()
+	resp := d.send(t, msg)
+	if resp.MessageType == ditnet.MSG_FAILURE || resp.MessageType == ditnet.MSG_QUOTA_EXCEEDED {
+		t.Fatalf("%s refused: %s", ditnet.MessageTypeName(msg.MessageType), resp.Message)
+	}
+	return resp
+}
+
+// syncUp stages the files of a parcel and commits them the way dit sync up does
+func (d *testDevice) syncUp(t *testing.T, parcel string, files map[string]string) ditnet.NetSnapshot {
+	t.Helper()
+	master := make(map[string]string)
+	for path, content := range files {
+		checksum := ditsync.DataChecksum([]byte(content))
+		master[path] = checksum
+		d.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: d.author, ParcelPath: parcel, MessageType: ditnet.MSG_PUT_BLOB,
+			Message: path, Message2: checksum, Data: []byte(content)})
+	}
+	// like the client, preview the commit and confirm what it removes
+	preview := d.commit(t, parcel, ditnet.MSG_PREVIEW_COMMIT, ditnet.NetMaster{Master: master})
+	return d.commit(t, parcel, ditnet.MSG_COMMIT, ditnet.NetMaster{Master: master, Guarded: true, Base: preview.ID, MaxRemoved: preview.Removed})
+}
+
+// commit sends a master record with MSG_COMMIT or MSG_PREVIEW_COMMIT and returns the snapshot
+func (d *testDevice) commit(t *testing.T, parcel string, messageType int, netmaster ditnet.NetMaster) ditnet.NetSnapshot {
+	t.Helper()
+	var masterBytes bytes.Buffer
+	err := gob.NewEncoder(&masterBytes).Encode(netmaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := d.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: d.author, ParcelPath: parcel, MessageType: messageType, Data: masterBytes.Bytes()})
+	var snapshot ditnet.NetSnapshot
+	err = gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+// getParcel lists the files of the latest snapshot of a parcel
+func (d *testDevice) getParcel(t *testing.T, author string, parcel string) ditnet.NetParcel {
+	t.Helper()
+	resp := d.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: author, ParcelPath: parcel, MessageType: ditnet.MSG_GET_PARCEL})
+	var netparcel ditnet.NetParcel
+	err := gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&netparcel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netparcel
+}
+
+func (d *testDevice) getFile(t *testing.T, author string, parcel string, path string) string {
+	t.Helper()
+	resp := d.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: author, ParcelPath: parcel, MessageType: ditnet.MSG_GET_FILE, Message: path})
+	data := resp.Data
+	if resp.IsGZIP {
+		var err error
+		data, err = ditsync.GZIPDecompress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return string(data)
+}
+
+func TestServeSyncShutdown(t *testing.T) {
+	db, blobs := newTestDB(t)
+	server, err := NewServer(Options{DB: db, Blobs: blobs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	alice := newTestDevice(t, l.Addr().String(), "alice", "laptop")
+	snapshot := alice.syncUp(t, "/notes", map[string]string{"a.txt": "first", "dir/b.txt": "second"})
+	if snapshot.ID != 1 || snapshot.Changed != 2 {
+		t.Fatalf("commit published snapshot %d with %d changes, want snapshot 1 with 2", snapshot.ID, snapshot.Changed)
+	}
+	netparcel := alice.getParcel(t, "alice", "/notes")
+	if len(netparcel.FilePaths) != 2 || netparcel.SnapshotID != 1 {
+		t.Fatalf("parcel lists %v in snapshot %d", netparcel.FilePaths, netparcel.SnapshotID)
+	}
+	if got := alice.getFile(t, "alice", "/notes", "dir/b.txt"); got != "second" {
+		t.Fatalf("got %q back", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Fatal("shutdown:", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatal("serve returned", err)
+	}
+	if !server.Draining() {
+		t.Fatal("server is not draining after shutdown")
+	}
+	if _, err := ditnet.ExchangeMessage(ditnet.ClientMessage{MessageType: ditnet.MSG_GET_PARCEL}, l.Addr().String()); err == nil {
+		t.Fatal("server still answers after shutdown")
+	}
+}
+
+func TestServerSettingsArePerServer(t *testing.T) {
+	strict := DefaultSettings()
+	strict.DefaultQuota = Quota{MaxFiles: 1}
+	_, strictAddr := startTestServer(t, strict)
+	_, openAddr := startTestServer(t, DefaultSettings())
+
+	files := map[string]string{"a.txt": "a", "b.txt": "b"}
+	open := newTestDevice(t, openAddr, "alice", "laptop")
+	open.syncUp(t, "/p", files)
+
+	limited := newTestDevice(t, strictAddr, "alice", "laptop")
+	master := make(map[string]string)
+	for path, content := range files {
+		master[path] = ditsync.DataChecksum([]byte(content))
+		limited.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_PUT_BLOB,
+			Message: path, Message2: master[path], Data: []byte(content)})
+	}
+	var masterBytes bytes.Buffer
+	gob.NewEncoder(&masterBytes).Encode(ditnet.NetMaster{Master: master})
+	resp := limited.send(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_COMMIT, Data: masterBytes.Bytes()})
+	if resp.MessageType != ditnet.MSG_QUOTA_EXCEEDED {
+		t.Fatalf("commit of 2 files against a quota of 1 file: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+}
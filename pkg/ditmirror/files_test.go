@@ -0,0 +1,224 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"testing"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+// two authors and two parcels holding the same path with the same content
+var isolationFiles = []struct{ author, parcel string }{
+	{"alice", "/p"},
+	{"alice", "/q"},
+	{"bob", "/p"},
+}
+
+const isolationChecksum = "SAMECHECKSUM"
+
+func seedIsolationFiles(t *testing.T, db *sql.DB) {
+	t.Helper()
+	for _, f := range isolationFiles {
+		if err := SyncFileToDB(db, f.author, f.parcel, "a.txt", isolationChecksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fileChecksums returns the checksum of a.txt in every parcel that still has it
+func fileChecksums(t *testing.T, db *sql.DB) map[string]string {
+	t.Helper()
+	rows, err := db.Query("SELECT author, parcel, checksum FROM files WHERE path = 'a.txt'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	files := make(map[string]string)
+	for rows.Next() {
+		var author, parcel, checksum string
+		if err := rows.Scan(&author, &parcel, &checksum); err != nil {
+			t.Fatal(err)
+		}
+		files[author+parcel] = checksum
+	}
+	return files
+}
+
+func TestRemoveFilesNotInMasterIsScopedToTheParcel(t *testing.T) {
+	db, _ := newTestDB(t)
+	seedIsolationFiles(t, db)
+	cfg := Settings{} // no deletion limits
+
+	removed, err := RemoveFilesNotInMaster(db, &cfg, "@alice", "/p", map[string]string{}, "alice", "laptop", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed %d files, want 1", removed)
+	}
+	files := fileChecksums(t, db)
+	if _, ok := files["alice/p"]; ok || len(files) != 2 || files["alice/q"] == "" || files["bob/p"] == "" {
+		t.Fatalf("files left after removing a.txt from @alice/p: %v", files)
+	}
+	var trashed int
+	db.QueryRow("SELECT COUNT(*) FROM trash WHERE NOT (author = 'alice' AND parcel = '/p')").Scan(&trashed)
+	if trashed != 0 {
+		t.Fatalf("%d files of other parcels were moved to the trash", trashed)
+	}
+}
+
+func TestCommitTrashAndRestoreAreScopedToTheParcel(t *testing.T) {
+	db, _ := newTestDB(t)
+	seedIsolationFiles(t, db)
+	_, err := db.Exec("INSERT INTO blobs (checksum, isGZIP, size, created) VALUES (?, false, 1, '2024-01-01T00:00:00Z')", isolationChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultSettings()
+
+	// an empty master moves every file of the parcel to the trash
+	empty := ditnet.NetMaster{Master: map[string]string{}, Guarded: true, MaxRemoved: 1}
+	snapshot, err := CommitSnapshot(db, &cfg, "bob", "/p", empty, "bob", "laptop", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Removed != 1 {
+		t.Fatalf("commit removed %d files, want 1", snapshot.Removed)
+	}
+	files := fileChecksums(t, db)
+	if len(files) != 2 || files["alice/p"] == "" || files["alice/q"] == "" {
+		t.Fatalf("files left after bob cleared /p: %v", files)
+	}
+	entries, err := ListTrash(db, &cfg, "alice", "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("bob's commit trashed %d files of alice", len(entries))
+	}
+
+	_, _, err = RestoreFile(db, &cfg, "alice", "/p", "a.txt", "alice", "laptop", "test")
+	if !errors.Is(err, ErrNotInTrash) {
+		t.Fatalf("restored bob's file into alice's parcel: %v", err)
+	}
+	_, _, err = RestoreFile(db, &cfg, "bob", "/p", "a.txt", "bob", "laptop", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := fileChecksums(t, db); len(files) != 3 {
+		t.Fatalf("files after the restore: %v", files)
+	}
+}
+
+func TestSyncFileToDBUpsertsOneRowPerPath(t *testing.T) {
+	db, _ := newTestDB(t)
+	seedIsolationFiles(t, db)
+	for _, checksum := range []string{"V2", "V3", "V3"} {
+		if err := SyncFileToDB(db, "alice", "/p", "a.txt", checksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rows int
+	db.QueryRow("SELECT COUNT(*) FROM files WHERE author = 'alice' AND parcel = '/p' AND path = 'a.txt'").Scan(&rows)
+	if rows != 1 {
+		t.Fatalf("%d rows for @alice/p a.txt, want 1", rows)
+	}
+	files := fileChecksums(t, db)
+	if files["alice/p"] != "V3" || files["alice/q"] != isolationChecksum || files["bob/p"] != isolationChecksum {
+		t.Fatalf("an upsert of @alice/p changed other parcels: %v", files)
+	}
+
+	_, err := db.Exec("INSERT INTO files (author, parcel, path, checksum) VALUES ('alice', '/p', 'a.txt', 'DUP')")
+	if err == nil {
+		t.Fatal("the files table accepted a second row for the same author, parcel and path")
+	}
+}
+
+func TestLegacySyncTakesOneSnapshotPerSync(t *testing.T) {
+	server, addr := startTestServer(t, DefaultSettings())
+	alice := newTestDevice(t, addr, "alice", "old-client")
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		content := []byte("content of " + path)
+		alice.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_SYNC_FILE,
+			Message: path, Message2: ditsync.DataChecksum(content), Data: content})
+	}
+	latest, err := LatestSnapshot(server.db, "alice", "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != 1 {
+		t.Fatalf("a sync of 3 files took %d snapshots", latest)
+	}
+	if parcel := alice.getParcel(t, "alice", "/p"); len(parcel.FilePaths) != 3 {
+		t.Fatalf("the snapshot lists %d files, want 3", len(parcel.FilePaths))
+	}
+
+	// a commit closes the open snapshot, the next upload of the old client starts a new one
+	alice.syncUp(t, "/p", map[string]string{"a.txt": "committed"})
+	alice.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_SYNC_FILE,
+		Message: "d.txt", Message2: ditsync.DataChecksum([]byte("d")), Data: []byte("d")})
+	latest, err = LatestSnapshot(server.db, "alice", "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != 3 {
+		t.Fatalf("latest snapshot is %d after a commit and another upload, want 3", latest)
+	}
+}
+
+func TestCommitRefusesUnconfirmedRemovals(t *testing.T) {
+	_, addr := startTestServer(t, DefaultSettings())
+	laptop := newTestDevice(t, addr, "alice", "laptop")
+	tablet := laptop.addDevice(t, "tablet")
+	files := map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c", "d.txt": "d"}
+	laptop.syncUp(t, "/p", files)
+	keep := map[string]string{"a.txt": ditsync.DataChecksum([]byte("a"))}
+
+	commit := func(d *testDevice, netmaster ditnet.NetMaster) ditnet.ServerMessage {
+		var masterBytes bytes.Buffer
+		gob.NewEncoder(&masterBytes).Encode(netmaster)
+		return d.send(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_COMMIT, Data: masterBytes.Bytes()})
+	}
+
+	// a client that confirms nothing is held to the limits of the mirror, 3 of 4 files is over 50%
+	resp := commit(tablet, ditnet.NetMaster{Master: keep})
+	if resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatalf("unconfirmed commit removing 3 of 4 files: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	var masterBytes bytes.Buffer
+	gob.NewEncoder(&masterBytes).Encode(ditnet.NetMaster{Master: keep})
+	resp = tablet.send(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_SYNC_MASTER, Data: masterBytes.Bytes()})
+	if resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatalf("sync master removing 3 of 4 files: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+
+	// the tablet previews, then the laptop adds a file before the tablet commits
+	preview := tablet.commit(t, "/p", ditnet.MSG_PREVIEW_COMMIT, ditnet.NetMaster{Master: keep})
+	if preview.Removed != 3 {
+		t.Fatalf("preview removes %d files, want 3", preview.Removed)
+	}
+	files["e.txt"] = "e"
+	laptop.syncUp(t, "/p", files)
+	resp = commit(tablet, ditnet.NetMaster{Master: keep, Guarded: true, Base: preview.ID, MaxRemoved: preview.Removed})
+	if resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatalf("commit previewed against an older snapshot: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	preview = tablet.commit(t, "/p", ditnet.MSG_PREVIEW_COMMIT, ditnet.NetMaster{Master: keep})
+	resp = commit(tablet, ditnet.NetMaster{Master: keep, Guarded: true, Base: preview.ID, MaxRemoved: 3})
+	if resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatalf("commit removing 4 files with 3 confirmed: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	if parcel := tablet.getParcel(t, "alice", "/p"); len(parcel.FilePaths) != 5 {
+		t.Fatalf("parcel has %d files after the refused commits, want 5", len(parcel.FilePaths))
+	}
+
+	snapshot := tablet.commit(t, "/p", ditnet.MSG_COMMIT, ditnet.NetMaster{Master: keep, Guarded: true, Base: preview.ID, MaxRemoved: preview.Removed})
+	if snapshot.Removed != 4 {
+		t.Fatalf("confirmed commit removed %d files, want 4", snapshot.Removed)
+	}
+}
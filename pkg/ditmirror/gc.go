@@ -0,0 +1,209 @@
+package ditmirror
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+	"github.com/fatih/color"
+)
+
+// Garbage collection applies version, snapshot and trash retention, then deletes blobs that no file, version,
+// snapshot or trash entry references. Blobs younger than the grace period are kept, they may be staged for a commit.
+// Last it sweeps the blob store for objects the database does not know, left by a crash between storing a blob and
+// recording it or by a delete that failed.
+
+type GCReport struct {
+	Versions  int // expired versions removed
+	Snapshots int // expired snapshots removed
+	Trash     int // expired trash entries removed
+	Blobs     int // unreferenced blobs removed
+	Orphans   int // objects in the blob store without a blob in the database removed
+	Bytes     int64
+}
+
+// RunGC collects garbage, with dryRun the database and blob store are left untouched. A running Server collects
+// its own garbage with CollectGarbage, which keeps requests from referencing a blob while it is deleted.
+func RunGC(db *sql.DB, blobs BlobStore, retention *Settings, grace time.Duration, dryRun bool) (GCReport, error) {
+	var report GCReport
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	if retention.VersionRetention > 0 {
+		res, err := tx.Exec(`DELETE FROM file_versions WHERE id IN (SELECT id FROM
+			(SELECT id, row_number() OVER (PARTITION BY author, parcel, path ORDER BY id DESC) AS n FROM file_versions) WHERE n > ?)`,
+			retention.VersionRetention)
+		if err != nil {
+			return report, err
+		}
+		n, _ := res.RowsAffected()
+		report.Versions = int(n)
+	}
+
+	if retention.SnapshotRetention > 0 {
+		expired := `SELECT s.id FROM snapshots s
+			JOIN (SELECT author, parcel, MAX(number) AS latest FROM snapshots GROUP BY author, parcel) l ON l.author = s.author AND l.parcel = s.parcel
+			WHERE s.number <= l.latest - ? AND s.id NOT IN (SELECT snapshot_id FROM tags)`
+		_, err = tx.Exec("DELETE FROM snapshot_files WHERE snapshot_id IN ("+expired+")", retention.SnapshotRetention)
+		if err != nil {
+			return report, err
+		}
+		res, err := tx.Exec("DELETE FROM snapshots WHERE id IN ("+expired+")", retention.SnapshotRetention)
+		if err != nil {
+			return report, err
+		}
+		n, _ := res.RowsAffected()
+		report.Snapshots = int(n)
+	}
+
+	if retention.TrashRetention > 0 {
+		res, err := tx.Exec("DELETE FROM trash WHERE deleted < ?", time.Now().UTC().AddDate(0, 0, -retention.TrashRetention).Format(time.RFC3339))
+		if err != nil {
+			return report, err
+		}
+		n, _ := res.RowsAffected()
+		report.Trash = int(n)
+	}
+
+	// uploads older than the grace period are not staged for a commit anymore
+	cutoff := time.Now().UTC().Add(-grace).Format(time.RFC3339)
+	_, err = tx.Exec("DELETE FROM blob_uploads WHERE created < ?", cutoff)
+	if err != nil {
+		return report, err
+	}
+	rows, err := tx.Query(`SELECT checksum, COALESCE(size, 0) FROM blobs WHERE created < ? AND checksum NOT IN
+		(SELECT checksum FROM files UNION SELECT checksum FROM file_versions UNION SELECT checksum FROM snapshot_files UNION SELECT checksum FROM trash
+		UNION SELECT checksum FROM blob_uploads)`, cutoff)
+	if err != nil {
+		return report, err
+	}
+	unreferenced := make([]string, 0)
+	for rows.Next() {
+		var checksum string
+		var size int64
+		if err := rows.Scan(&checksum, &size); err != nil {
+			rows.Close()
+			return report, err
+		}
+		unreferenced = append(unreferenced, checksum)
+		report.Bytes += size
+	}
+	rows.Close()
+	report.Blobs = len(unreferenced)
+
+	for _, checksum := range unreferenced {
+		_, err = tx.Exec("DELETE FROM blobs WHERE checksum = ?", checksum)
+		if err != nil {
+			return report, err
+		}
+	}
+	if dryRun {
+		err = tx.Rollback()
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// the metadata is gone first, so a failed delete leaves an unused object rather than a blob without data
+	deleted := make(map[string]bool)
+	for _, checksum := range unreferenced {
+		if !dryRun {
+			deleted[checksum] = true
+			err = blobs.Delete(checksum)
+			if err != nil {
+				slog.Warn("gc failed to delete blob", "checksum", checksum, "err", err)
+			}
+		}
+	}
+	err = sweepOrphans(db, blobs, time.Now().Add(-grace), deleted, dryRun, &report)
+	return report, err
+}
+
+// sweepOrphans deletes the objects of the blob store that have no row in blobs and were stored before cutoff,
+// younger ones may be a blob being stored right now. Objects already deleted in this run are skipped.
+func sweepOrphans(db *sql.DB, blobs BlobStore, cutoff time.Time, deleted map[string]bool, dryRun bool, report *GCReport) error {
+	orphans := make([]BlobInfo, 0)
+	err := blobs.List(func(info BlobInfo) error {
+		if deleted[info.Key] || !info.ModTime.Before(cutoff) || !isBlobKey(info.Key) {
+			return nil
+		}
+		has, err := HasBlob(db, info.Key)
+		if err != nil || has {
+			return err
+		}
+		orphans = append(orphans, info)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing the blob store: %w", err)
+	}
+	for _, orphan := range orphans {
+		report.Orphans++
+		report.Bytes += orphan.Size
+		if dryRun {
+			continue
+		}
+		err = blobs.Delete(orphan.Key)
+		if err != nil {
+			slog.Warn("gc failed to delete orphaned blob", "checksum", orphan.Key, "err", err)
+		}
+	}
+	return nil
+}
+
+// isBlobKey reports whether a key has the form of a checksum or an encrypted blob ID, other objects sharing the
+// blob store are never collected
+func isBlobKey(key string) bool {
+	if ditsync.IsEncryptedBlob(key) {
+		return ditsync.ValidEncryptedBlobID(key)
+	}
+	hash, err := base32.StdEncoding.DecodeString(key)
+	return err == nil && len(hash) == sha256.Size
+}
+
+func PrintGCReport(report GCReport, dryRun bool) {
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Println(color.CyanString("[gc]"), verb, report.Versions, "expired versions,", report.Snapshots, "expired snapshots,",
+		report.Trash, "expired trash entries,", report.Blobs, "unreferenced blobs,", report.Orphans, "orphaned blobs, reclaiming", FormatSize(report.Bytes))
+}
+
+// CollectGarbage runs RunGC with the settings of the server, holding off requests that store or reference blobs
+func (s *Server) CollectGarbage(dryRun bool) (GCReport, error) {
+	if !dryRun {
+		s.gcLock.Lock()
+		defer s.gcLock.Unlock()
+	}
+	return RunGC(s.db, s.blobs, s.Settings(), s.gcGrace, dryRun)
+}
+
+// runGCScheduler collects garbage every interval until the server stops
+func (s *Server) runGCScheduler() {
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		report, err := s.CollectGarbage(false)
+		if err != nil {
+			slog.Error("gc error", "err", err)
+			continue
+		}
+		slog.Info("collected garbage", "versions", report.Versions, "snapshots", report.Snapshots, "trash", report.Trash,
+			"blobs", report.Blobs, "orphans", report.Orphans, "bytes", report.Bytes)
+	}
+}
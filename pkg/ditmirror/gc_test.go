@@ -0,0 +1,68 @@
+package ditmirror
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+func TestGCSweepsOrphanedBlobs(t *testing.T) {
+	db, blobs := newTestDB(t)
+	store := blobs.(*FSBlobStore)
+	old := time.Now().Add(-2 * time.Hour)
+
+	// an orphan left by a crash before its row was written, one being stored right now, an object that is not a blob
+	// and a blob the database knows
+	orphan := ditsync.DataChecksum([]byte("orphan"))
+	fresh := ditsync.DataChecksum([]byte("fresh"))
+	other := "NOTABLOB"
+	for _, key := range []string{orphan, fresh, other} {
+		if err := store.Put(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{orphan, other} {
+		path, _ := store.path(key)
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	known := ditsync.DataChecksum([]byte("known"))
+	if err := PutBlob(db, blobs, known, []byte("known"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncFileToDB(db, "alice", "/p", "a.txt", known); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultSettings()
+	report, err := RunGC(db, blobs, &cfg, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Orphans != 1 || report.Bytes != int64(len(orphan)) {
+		t.Fatalf("dry run reported %d orphans of %d bytes, want 1 of %d", report.Orphans, report.Bytes, len(orphan))
+	}
+	if _, err := store.Stat(orphan); err != nil {
+		t.Fatalf("the dry run deleted the orphan: %v", err)
+	}
+
+	report, err = RunGC(db, blobs, &cfg, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Orphans != 1 {
+		t.Fatalf("gc removed %d orphans, want 1", report.Orphans)
+	}
+	if _, err := store.Stat(orphan); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("stat of the orphan after gc returned %v", err)
+	}
+	for _, key := range []string{fresh, other, known} {
+		if _, err := store.Stat(key); err != nil {
+			t.Fatalf("gc deleted %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package ditmirror
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+var ErrAuthRequired = errors.New("authentication required, this author has registered device keys")
+var ErrKeyRequired = errors.New("this author has no device keys, register one first with: dit keys add")
+var ErrReplayed = errors.New("this signed message was received before, sign it again")
+var ErrKeyTokenRequired = errors.New("this author already has parcels, ask the mirror administrator for a key token and run: dit keys add --token <token>")
+var ErrInvalidKeyToken = errors.New("invalid or expired key token")
+var ErrLastKey = errors.New("this is the last active key of the author, without it only an administrator can give access to the parcels again, revoke it with --force")
+
+// The first key of an author is trusted without a signature from another device. For an author who already has
+// data that would let anyone take it over by registering first, so the first key then needs a one-time token the
+// administrator hands out, see dit-mirror admin key-token.
+const keyTokenLifetime = 24 * time.Hour
+
+// AuthenticateMessage verifies the signature of a message against the active keys of its requester.
+// Unsigned messages authenticate as the empty requester, as do replication messages, which are signed with the
+// replication secret and checked by handleReplicationMessage.
+func AuthenticateMessage(db *sql.DB, msg *ditnet.ClientMessage) (string, error) {
+	if !msg.IsSigned() || msg.MessageType == ditnet.MSG_REPL_CHANGES || msg.MessageType == ditnet.MSG_REPL_BLOB {
+		return "", nil
+	}
+	requester := strings.TrimPrefix(msg.Requester, "@")
+	if msg.MessageType == ditnet.MSG_ADD_KEY && !HasKeys(db, requester) {
+		return "", nil // first key of an author, verified against the key being added in AddKey
+	}
+
+	pub, err := getActiveKey(db, requester, msg.Device)
+	if err != nil {
+		return "", err
+	}
+	err = msg.Verify(pub)
+	if err != nil {
+		return "", err
+	}
+	err = markSignatureSeen(db, msg)
+	if err != nil {
+		return "", err
+	}
+	return requester, nil
+}
+
+// markSignatureSeen rejects a signature the mirror accepted before. Signatures are kept until Verify would
+// reject them as expired anyway. Identical messages signed by older clients in the same second are rejected as
+// well, newer clients sign with a random nonce.
+func markSignatureSeen(db *sql.DB, msg *ditnet.ClientMessage) error {
+	now := time.Now().Unix()
+	_, err := db.Exec("DELETE FROM seen_signatures WHERE expires < ?", now)
+	if err != nil {
+		return err
+	}
+	expires := msg.Timestamp + int64(ditnet.SIGNATURE_MAX_AGE/time.Second)
+	_, err = db.Exec("INSERT INTO seen_signatures (signature, expires) VALUES (?, ?)", msg.Signature, expires)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+		return ErrReplayed
+	}
+	return err
+}
+
+// AuthorizeAuthor checks that the requester may act as author. Authors without registered keys are open.
+func AuthorizeAuthor(db *sql.DB, author string, requester string) error {
+	author = strings.TrimPrefix(author, "@")
+	if requester == author || !HasKeys(db, author) {
+		return nil
+	}
+	return ErrAuthRequired
+}
+
+// HasKeys reports if an author has ever registered a key. Revoking every key does not open the author up again.
+func HasKeys(db *sql.DB, author string) bool {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM keys WHERE author = ?", author).Scan(&count)
+	if err != nil {
+		return true // fail closed
+	}
+	return count > 0
+}
+
+func getActiveKey(db *sql.DB, author string, device string) (ed25519.PublicKey, error) {
+	var pub []byte
+	err := db.QueryRow("SELECT public_key FROM keys WHERE author = ? AND device = ? AND revoked IS NULL", author, device).Scan(&pub)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("unknown or revoked key for device %q", device)
+	} else if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+func AddKey(db *sql.DB, msg *ditnet.ClientMessage, requester string) error {
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+	device := strings.TrimSpace(msg.Message)
+	pub := ed25519.PublicKey(msg.Data)
+	if author == "" || device == "" {
+		return errors.New("author and device cannot be empty")
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+
+	if HasKeys(db, author) {
+		if requester != author {
+			return ErrAuthRequired
+		}
+	} else {
+		// first key of an author, the request must be signed by the key being registered
+		if strings.TrimPrefix(msg.Requester, "@") != author || msg.Device != device {
+			return errors.New("the first key must be registered from its own device")
+		}
+		if err := msg.Verify(pub); err != nil {
+			return err
+		}
+		if err := markSignatureSeen(db, msg); err != nil {
+			return err
+		}
+		if err := checkKeyToken(db, author, msg.Message2); err != nil {
+			return err
+		}
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.Exec("INSERT INTO keys (author, device, public_key, created) VALUES (?, ?, ?, ?)", author, device, []byte(pub), timestamp)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return fmt.Errorf("device %q already has an active key, revoke it first", device)
+		}
+		return err
+	}
+	_, err = db.Exec("DELETE FROM key_tokens WHERE author = ?", author)
+	return err
+}
+
+func authorHasData(db querier, author string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT (SELECT COUNT(*) FROM parcels WHERE author = ?) + (SELECT COUNT(*) FROM files WHERE author = ?)", author, author).Scan(&count)
+	return count > 0, err
+}
+
+// IssueKeyToken returns a new one-time token for the first key of an author, replacing any earlier one
+func IssueKeyToken(db *sql.DB, author string) (string, error) {
+	raw := make([]byte, 15)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	token := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+	hash := sha256.Sum256([]byte(token))
+	expires := time.Now().UTC().Add(keyTokenLifetime).Format(time.RFC3339)
+	_, err = db.Exec(`INSERT INTO key_tokens (author, token_hash, expires) VALUES (?, ?, ?)
+		ON CONFLICT (author) DO UPDATE SET token_hash = excluded.token_hash, expires = excluded.expires`, author, hash[:], expires)
+	return token, err
+}
+
+// checkKeyToken accepts the first key of an author without data, or with the author's unexpired key token
+func checkKeyToken(db *sql.DB, author string, token string) error {
+	hasData, err := authorHasData(db, author)
+	if err != nil || !hasData {
+		return err
+	}
+	token = strings.ToLower(strings.TrimSpace(token))
+	if token == "" {
+		return ErrKeyTokenRequired
+	}
+	var stored []byte
+	var expires string
+	err = db.QueryRow("SELECT token_hash, expires FROM key_tokens WHERE author = ?", author).Scan(&stored, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidKeyToken
+	} else if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(token))
+	expiry, err := time.Parse(time.RFC3339, expires)
+	if err != nil || time.Now().After(expiry) || subtle.ConstantTimeCompare(hash[:], stored) != 1 {
+		return ErrInvalidKeyToken
+	}
+	return nil
+}
+
+// RevokeKey revokes the key of a device, the last active key of an author only with force. The author keeps having
+// keys, so revoking the last one locks every device out until an administrator resets the keys.
+func RevokeKey(db *sql.DB, author string, device string, force bool) error {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	res, err := db.Exec(`UPDATE keys SET revoked = ?1 WHERE author = ?2 AND device = ?3 AND revoked IS NULL
+		AND (?4 OR EXISTS (SELECT 1 FROM keys WHERE author = ?2 AND device != ?3 AND revoked IS NULL))`, timestamp, author, device, force)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var active bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM keys WHERE author = ? AND device = ? AND revoked IS NULL)", author, device).Scan(&active)
+		if err != nil {
+			return err
+		}
+		if active {
+			return ErrLastKey
+		}
+		return fmt.Errorf("no active key for device %q", device)
+	}
+	// the device cannot unwrap parcel keys anymore, even with a copy of the wrapped key it would need a fresh parcel key
+	_, err = db.Exec("DELETE FROM parcel_keys WHERE author = ? AND device = ?", author, device)
+	return err
+}
+
+func ListKeys(db *sql.DB, author string) ([]ditnet.NetKey, error) {
+	rows, err := db.Query("SELECT device, public_key, created, COALESCE(revoked, '') FROM keys WHERE author = ? ORDER BY id", author)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]ditnet.NetKey, 0)
+	for rows.Next() {
+		var key ditnet.NetKey
+		err = rows.Scan(&key.Device, &key.PublicKey, &key.Created, &key.Revoked)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func handleKeyMessage(c net.Conn, db *sql.DB, msg *ditnet.ClientMessage, requester string, remote string) {
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+
+	switch msg.MessageType {
+	case ditnet.MSG_ADD_KEY:
+		logAttrs(c, "key_device", msg.Message)
+		err := AddKey(db, msg, requester)
+		if err != nil {
+			AuditLog(db, AUDIT_AUTH_FAIL, author, remote, "", "", "add key "+msg.Message+": "+err.Error())
+			sendFailure(c, err.Error())
+			return
+		}
+		AuditLog(db, AUDIT_KEY_ADD, author, remote, "", "", msg.Message)
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: "OK"})
+
+	case ditnet.MSG_REVOKE_KEY:
+		logAttrs(c, "key_device", msg.Message)
+		if requester != author {
+			AuditLog(db, AUDIT_AUTH_FAIL, author, remote, "", "", "revoke key "+msg.Message)
+			sendFailure(c, ErrAuthRequired.Error())
+			return
+		}
+		err := RevokeKey(db, author, msg.Message, msg.Message2 == "force")
+		if err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		AuditLog(db, AUDIT_KEY_REVOKE, author, remote, "", "", msg.Message+" by "+msg.Device)
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: "OK"})
+
+	case ditnet.MSG_LIST_KEYS:
+		if err := AuthorizeAuthor(db, author, requester); err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		keys, err := ListKeys(db, author)
+		if err != nil {
+			sendFailure(c, "db error")
+			return
+		}
+		var keysBytes bytes.Buffer
+		err = gob.NewEncoder(&keysBytes).Encode(keys)
+		if err != nil {
+			sendFailure(c, "encode error")
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_KEYS, Data: keysBytes.Bytes()})
+	}
+}
@@ -0,0 +1,119 @@
+package ditmirror
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+func TestSignedMessagesCannotBeReplayed(t *testing.T) {
+	_, addr := startTestServer(t, DefaultSettings())
+	alice := newTestDevice(t, addr, "alice", "laptop")
+	alice.syncUp(t, "/notes", map[string]string{"a.txt": "secret"})
+
+	msg := ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_GET_FILE, Message: "a.txt"}
+	msg.Sign(alice.author, alice.device, alice.key)
+	for i, want := range []int{ditnet.MSG_FILE, ditnet.MSG_FAILURE} {
+		resp, err := ditnet.ExchangeMessage(msg, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.MessageType != want {
+			t.Fatalf("send %d: %s %q, want %s", i+1, ditnet.MessageTypeName(resp.MessageType), resp.Message, ditnet.MessageTypeName(want))
+		}
+	}
+
+	// the same request signed again is a new message
+	if got := alice.getFile(t, "alice", "/notes", "a.txt"); got != "secret" {
+		t.Fatalf("got %q", got)
+	}
+	if got := alice.getFile(t, "alice", "/notes", "a.txt"); got != "secret" {
+		t.Fatalf("got %q", got)
+	}
+
+	// the nonce is signed, so it cannot be stripped or changed to get a replay past the mirror
+	legacy := ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_LIST_KEYS}
+	legacy.Sign(alice.author, alice.device, alice.key)
+	legacy.Nonce = nil
+	resp, err := ditnet.ExchangeMessage(legacy, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageType != ditnet.MSG_FAILURE || !strings.Contains(resp.Message, "invalid signature") {
+		t.Fatalf("a signature over a nonce verified without it: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+}
+
+// addFirstKey registers a new key for a device, signed by that key the way dit keys add does
+func addFirstKey(t *testing.T, addr string, author string, device string, token string) ditnet.ServerMessage {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := ditnet.ClientMessage{OriginAuthor: author, MessageType: ditnet.MSG_ADD_KEY, Message: device, Message2: token, Data: pub}
+	msg.Sign(author, device, key)
+	resp, err := ditnet.ExchangeMessage(msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestFirstKeyOfAnAuthorWithDataNeedsAToken(t *testing.T) {
+	server, addr := startTestServer(t, DefaultSettings())
+	if resp := addFirstKey(t, addr, "newcomer", "laptop", ""); resp.MessageType != ditnet.MSG_SUCCESS {
+		t.Fatalf("the first key of a new author was refused: %s", resp.Message)
+	}
+
+	if err := EnsureParcel(server.db, "alice", "/notes"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := addFirstKey(t, addr, "alice", "mallory", ""); resp.Message != ErrKeyTokenRequired.Error() {
+		t.Fatalf("first key without a token: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	var out bytes.Buffer
+	if err := RunAdmin(server.db, &out, AdminCommand{Name: "key-token", Author: "alice"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(out.String())
+	token := fields[len(fields)-1]
+	if resp := addFirstKey(t, addr, "alice", "mallory", "guessed"); resp.Message != ErrInvalidKeyToken.Error() {
+		t.Fatalf("first key with a wrong token: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	if resp := addFirstKey(t, addr, "alice", "laptop", token); resp.MessageType != ditnet.MSG_SUCCESS {
+		t.Fatalf("first key with the token: %s", resp.Message)
+	}
+
+	// the token is used up, a reset issues a new one
+	if err := RunAdmin(server.db, io.Discard, AdminCommand{Name: "reset-keys", Author: "alice"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := addFirstKey(t, addr, "alice", "mallory", token); resp.Message != ErrInvalidKeyToken.Error() {
+		t.Fatalf("a used token was accepted again: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+}
+
+func TestLastActiveKeyIsOnlyRevokedWithForce(t *testing.T) {
+	_, addr := startTestServer(t, DefaultSettings())
+	laptop := newTestDevice(t, addr, "alice", "laptop")
+	laptop.addDevice(t, "phone")
+
+	laptop.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", MessageType: ditnet.MSG_REVOKE_KEY, Message: "phone"})
+	resp := laptop.send(t, ditnet.ClientMessage{OriginAuthor: "alice", MessageType: ditnet.MSG_REVOKE_KEY, Message: "laptop"})
+	if resp.MessageType != ditnet.MSG_FAILURE || resp.Message != ErrLastKey.Error() {
+		t.Fatalf("revoking the last active key: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	// the key still works
+	laptop.syncUp(t, "/notes", map[string]string{"a.txt": "a"})
+
+	laptop.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", MessageType: ditnet.MSG_REVOKE_KEY, Message: "laptop", Message2: "force"})
+	resp = laptop.send(t, ditnet.ClientMessage{OriginAuthor: "alice", MessageType: ditnet.MSG_LIST_KEYS})
+	if resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatalf("a revoked key still lists keys: %s", ditnet.MessageTypeName(resp.MessageType))
+	}
+}
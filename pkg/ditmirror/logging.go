@@ -0,0 +1,102 @@
+package ditmirror
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+// Every request ends with one log line carrying the remote address, message type, author, parcel, duration and
+// bytes in and out; handlers add their own fields to it with logAttrs and log errors with connLogger, so those lines
+// carry the same request fields. The mirror logs to the slog default logger.
+
+// requestConn counts the bytes of a request and remembers how it was answered, for the request log line
+type requestConn struct {
+	net.Conn
+	log     *slog.Logger
+	msgType string
+	read    int64
+	written int64
+	reply   int
+	replied bool
+	failure string
+	attrs   []any
+	metrics *mirrorMetrics
+}
+
+func newRequestConn(c net.Conn, metrics *mirrorMetrics) *requestConn {
+	return &requestConn{Conn: c, log: slog.With("remote", c.RemoteAddr().String()), msgType: "INVALID", metrics: metrics}
+}
+
+func (c *requestConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *requestConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// identify adds the fields of the decoded message to every line logged for the request
+func (c *requestConn) identify(msg *ditnet.ClientMessage) {
+	c.msgType = ditnet.MessageTypeName(msg.MessageType)
+	c.log = c.log.With("type", c.msgType)
+	if msg.OriginAuthor != "" {
+		c.log = c.log.With("author", strings.TrimPrefix(msg.OriginAuthor, "@"), "parcel", msg.ParcelPath)
+	}
+	if msg.Requester != "" {
+		c.log = c.log.With("requester", msg.Requester, "device", msg.Device)
+	}
+}
+
+// finish logs the request line and counts the request in the metrics, failed requests are logged as warnings
+func (c *requestConn) finish(started time.Time) {
+	duration := time.Since(started)
+	args := append([]any{"duration", duration.Round(time.Microsecond), "bytes_in", c.read, "bytes_out", c.written}, c.attrs...)
+	result := "success"
+	if !c.replied {
+		result = "dropped"
+		c.log.Warn("request dropped without a reply", args...)
+	} else if c.failure != "" {
+		result = "failure"
+		if c.reply == ditnet.MSG_QUOTA_EXCEEDED {
+			result = "quota_exceeded"
+		}
+		c.log.Warn("request failed", append(args, "reply", ditnet.MessageTypeName(c.reply), "reason", c.failure)...)
+	} else {
+		c.log.Info("request", append(args, "reply", ditnet.MessageTypeName(c.reply))...)
+	}
+	c.metrics.observeRequest(c.msgType, result, c.read, c.written, duration)
+}
+
+// connLogger returns the logger of the request on c
+func connLogger(c net.Conn) *slog.Logger {
+	if rc, ok := c.(*requestConn); ok {
+		return rc.log
+	}
+	return slog.Default()
+}
+
+// logAttrs adds key value pairs to the request line of c
+func logAttrs(c net.Conn, args ...any) {
+	if rc, ok := c.(*requestConn); ok {
+		rc.attrs = append(rc.attrs, args...)
+	}
+}
+
+// logReply records how the request on c was answered
+func logReply(c net.Conn, msg ditnet.ServerMessage) {
+	if rc, ok := c.(*requestConn); ok {
+		rc.replied = true
+		rc.reply = msg.MessageType
+		if msg.MessageType == ditnet.MSG_FAILURE || msg.MessageType == ditnet.MSG_QUOTA_EXCEEDED {
+			rc.failure = msg.Message
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server.Handler serves Prometheus text format metrics at /metrics. Request metrics are counted per server as
+// requests finish, database and storage metrics are read from the database on every scrape.
+// /health answers 200 ok while serving and 503 draining during shutdown, for load balancers.
+
+// upper bounds in seconds, uploads of large files take a while
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative
+	sum    float64
+	count  int64
+}
+
+type requestKey struct {
+	messageType string
+	result      string
+}
+
+type mirrorMetrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]int64
+	bytesIn  map[string]int64
+	bytesOut map[string]int64
+	latency  map[string]*histogram
+	active   atomic.Int64
+}
+
+func newMirrorMetrics() *mirrorMetrics {
+	return &mirrorMetrics{
+		requests: make(map[requestKey]int64),
+		bytesIn:  make(map[string]int64),
+		bytesOut: make(map[string]int64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+// observeRequest counts a finished request, result is success, failure, quota_exceeded or dropped
+func (m *mirrorMetrics) observeRequest(messageType string, result string, in int64, out int64, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{messageType, result}]++
+	m.bytesIn[messageType] += in
+	m.bytesOut[messageType] += out
+
+	h, ok := m.latency[messageType]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latency[messageType] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// writeRequestMetrics writes the request counters and latency histograms
+func (m *mirrorMetrics) writeRequestMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "dit_mirror_requests_total", "counter", "Requests handled, by message type and result")
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].messageType != keys[j].messageType {
+			return keys[i].messageType < keys[j].messageType
+		}
+		return keys[i].result < keys[j].result
+	})
+	for _, key := range keys {
+		writeSample(w, "dit_mirror_requests_total", labels("type", key.messageType, "result", key.result), float64(m.requests[key]))
+	}
+
+	writeHeader(w, "dit_mirror_received_bytes_total", "counter", "Bytes read from clients, by message type")
+	for _, messageType := range sortedKeys(m.bytesIn) {
+		writeSample(w, "dit_mirror_received_bytes_total", labels("type", messageType), float64(m.bytesIn[messageType]))
+	}
+	writeHeader(w, "dit_mirror_sent_bytes_total", "counter", "Bytes written to clients, by message type")
+	for _, messageType := range sortedKeys(m.bytesOut) {
+		writeSample(w, "dit_mirror_sent_bytes_total", labels("type", messageType), float64(m.bytesOut[messageType]))
+	}
+
+	writeHeader(w, "dit_mirror_request_duration_seconds", "histogram", "Time from accepting a connection to the end of its request")
+	types := make([]string, 0, len(m.latency))
+	for messageType := range m.latency {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+	for _, messageType := range types {
+		h := m.latency[messageType]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			writeSample(w, "dit_mirror_request_duration_seconds_bucket", labels("type", messageType, "le", formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, "dit_mirror_request_duration_seconds_bucket", labels("type", messageType, "le", "+Inf"), float64(h.count))
+		writeSample(w, "dit_mirror_request_duration_seconds_sum", labels("type", messageType), h.sum)
+		writeSample(w, "dit_mirror_request_duration_seconds_count", labels("type", messageType), float64(h.count))
+	}
+
+	writeHeader(w, "dit_mirror_active_connections", "gauge", "Connections currently being handled")
+	writeSample(w, "dit_mirror_active_connections", "", float64(m.active.Load()))
+}
+
+// writeStorageMetrics writes the database size, blob totals and the storage of every parcel and author
+func writeStorageMetrics(w io.Writer, db *sql.DB, dbPath string) error {
+	var dbBytes int64
+	for _, suffix := range []string{"", "-wal"} {
+		if info, err := os.Stat(dbPath + suffix); err == nil {
+			dbBytes += info.Size()
+		}
+	}
+	writeHeader(w, "dit_mirror_database_bytes", "gauge", "Size of the database file and its write-ahead log")
+	writeSample(w, "dit_mirror_database_bytes", "", float64(dbBytes))
+
+	var blobCount, blobBytes int64
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs").Scan(&blobCount, &blobBytes)
+	if err != nil {
+		return err
+	}
+	writeHeader(w, "dit_mirror_blobs", "gauge", "Blobs in the blob store")
+	writeSample(w, "dit_mirror_blobs", "", float64(blobCount))
+	writeHeader(w, "dit_mirror_blob_bytes", "gauge", "Bytes of file data in the blob store")
+	writeSample(w, "dit_mirror_blob_bytes", "", float64(blobBytes))
+
+	rows, err := db.Query(`SELECT p.author, p.parcel,
+		(SELECT COUNT(*) FROM files f WHERE f.author = p.author AND f.parcel = p.parcel),
+		(SELECT COALESCE(SUM(b.size), 0) FROM blobs b WHERE b.checksum IN (SELECT f.checksum FROM files f WHERE f.author = p.author AND f.parcel = p.parcel))
+		FROM parcels p ORDER BY p.author, p.parcel`)
+	if err != nil {
+		return err
+	}
+	var files, sizes bytes.Buffer
+	for rows.Next() {
+		var author, parcel string
+		var count, size int64
+		if err := rows.Scan(&author, &parcel, &count, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		writeSample(&files, "dit_mirror_parcel_files", labels("author", author, "parcel", parcel), float64(count))
+		writeSample(&sizes, "dit_mirror_parcel_bytes", labels("author", author, "parcel", parcel), float64(size))
+	}
+	rows.Close()
+	writeHeader(w, "dit_mirror_parcel_files", "gauge", "Current files of a parcel")
+	w.Write(files.Bytes())
+	writeHeader(w, "dit_mirror_parcel_bytes", "gauge", "Bytes of the current files of a parcel")
+	w.Write(sizes.Bytes())
+
+	rows, err = db.Query("SELECT DISTINCT author FROM files UNION SELECT author FROM parcels ORDER BY 1")
+	if err != nil {
+		return err
+	}
+	authors := make([]string, 0)
+	for rows.Next() {
+		var author string
+		if err := rows.Scan(&author); err != nil {
+			rows.Close()
+			return err
+		}
+		authors = append(authors, author)
+	}
+	rows.Close()
+
+	writeHeader(w, "dit_mirror_author_stored_bytes", "gauge", "Bytes stored for an author, counting history and trash, as quotas count them")
+	files.Reset()
+	for _, author := range authors {
+		usage, err := GetUsage(db, author)
+		if err != nil {
+			return err
+		}
+		writeSample(w, "dit_mirror_author_stored_bytes", labels("author", author), float64(usage.Bytes))
+		writeSample(&files, "dit_mirror_author_files", labels("author", author), float64(usage.Files))
+	}
+	writeHeader(w, "dit_mirror_author_files", "gauge", "Current files of an author")
+	w.Write(files.Bytes())
+	return nil
+}
+
+// Handler serves /metrics and /health, mount it on an HTTP server of your own
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if s.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "draining\n")
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var out bytes.Buffer
+		s.metrics.writeRequestMetrics(&out)
+		err := writeStorageMetrics(&out, s.db, s.dbPath)
+		if err != nil {
+			slog.Error("metrics error", "err", err)
+			http.Error(w, "failed to read storage metrics", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(out.Bytes())
+	})
+	return mux
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// labels formats name value pairs as {name="value",...}
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, pairs[i]+`="`+value+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
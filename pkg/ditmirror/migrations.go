@@ -0,0 +1,319 @@
+package ditmirror
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// The mirror schema is upgraded by running every migration newer than the version recorded in schema_version.
+// Migrations are never edited once released, schema changes are made by appending a new one.
+// Databases created before schema_version existed start at version 0, so the early migrations are written to
+// be safe to run against tables that already exist.
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	Func    func(tx *sql.Tx, blobs BlobStore) error // optional, runs after SQL in the same transaction
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	execer
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "files table",
+		SQL: `
+		create table if not exists files (id integer not null primary key, author text, parcel text, path text, checksum text, created timestamp, last_sync timestamp);
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "audit log",
+		// the audit table is append-only, the triggers reject any attempt to rewrite history
+		SQL: `
+		create table if not exists audit (id integer not null primary key, time timestamp, event text, author text, remote text, parcel text, path text, detail text);
+		create index if not exists audit_author_parcel on audit (author, parcel);
+		create trigger if not exists audit_no_update before update on audit begin select raise(abort, 'audit log is append-only'); end;
+		create trigger if not exists audit_no_delete before delete on audit begin select raise(abort, 'audit log is append-only'); end;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "device keys",
+		// a device name can be reused once its previous key has been revoked
+		SQL: `
+		create table if not exists keys (id integer not null primary key, author text, device text, public_key blob, created timestamp, revoked timestamp);
+		create unique index if not exists keys_active on keys (author, device) where revoked is null;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "parcel visibility and shares",
+		SQL: `
+		create table if not exists parcels (id integer not null primary key, author text, parcel text, visibility text not null default 'private', created timestamp, unique (author, parcel));
+		create table if not exists shares (id integer not null primary key, author text, parcel text, grantee text, created timestamp, unique (author, parcel, grantee));
+		insert or ignore into parcels (author, parcel, created) select author, parcel, min(created) from files group by author, parcel;
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "blobs table, move file data out of files",
+		SQL: `
+		create table if not exists blobs (checksum text not null primary key, isGZIP bool, size integer, created timestamp);
+		create index if not exists files_checksum on files (checksum);
+		`,
+		Func: func(tx *sql.Tx, blobs BlobStore) error { return migrateInlineFileData(tx, blobs) },
+	},
+	{
+		Version: 6,
+		Name:    "move blob data into the blob store",
+		Func:    func(tx *sql.Tx, blobs BlobStore) error { return migrateInlineBlobData(tx, blobs) },
+	},
+	{
+		Version: 7,
+		Name:    "quotas",
+		SQL: `
+		create table if not exists quotas (author text not null primary key, max_bytes integer not null default 0, max_files integer not null default 0);
+		create index if not exists files_author on files (author, checksum);
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "unique file per author, parcel and path",
+		// rebuilds files with a composite unique key, keeping the most recent row of any duplicates
+		SQL: `
+		create table files_new (id integer not null primary key, author text not null, parcel text not null, path text not null, checksum text not null, created timestamp, last_sync timestamp, unique (author, parcel, path));
+		insert into files_new (id, author, parcel, path, checksum, created, last_sync)
+			select id, author, parcel, path, checksum, created, last_sync from files
+			where id in (select max(id) from files where author is not null and parcel is not null and path is not null and checksum is not null group by author, parcel, path);
+		drop table files;
+		alter table files_new rename to files;
+		create index files_checksum on files (checksum);
+		create index files_author on files (author, checksum);
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "file version history",
+		// older mirrors wrote timestamps with time.Time.String(), keep only the part sqlite can parse
+		SQL: `
+		create table file_versions (id integer not null primary key, author text not null, parcel text not null, path text not null, checksum text not null, requester text, device text, created timestamp);
+		create index file_versions_path on file_versions (author, parcel, path, id);
+		create index file_versions_checksum on file_versions (checksum);
+		insert into file_versions (author, parcel, path, checksum, created)
+			select author, parcel, path, checksum, case when last_sync glob '????-??-??T*' then last_sync else substr(last_sync, 1, 19) end from files order by id;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "parcel snapshots",
+		// every existing parcel starts out with its current files as snapshot 1
+		SQL: `
+		create table snapshots (id integer not null primary key, author text not null, parcel text not null, number integer not null, requester text, device text, created timestamp, unique (author, parcel, number));
+		create table snapshot_files (snapshot_id integer not null, path text not null, checksum text not null, primary key (snapshot_id, path));
+		create index snapshot_files_checksum on snapshot_files (checksum);
+		insert into snapshots (author, parcel, number, created)
+			select author, parcel, 1, max(case when last_sync glob '????-??-??T*' then last_sync else substr(last_sync, 1, 19) end) from files group by author, parcel;
+		insert into snapshot_files (snapshot_id, path, checksum) select s.id, f.path, f.checksum from files f join snapshots s on s.author = f.author and s.parcel = f.parcel;
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "snapshot tags",
+		SQL: `
+		create table tags (id integer not null primary key, author text not null, parcel text not null, name text not null, snapshot_id integer not null, requester text, created timestamp, unique (author, parcel, name));
+		create index tags_snapshot on tags (snapshot_id);
+		`,
+	},
+	{
+		Version: 12,
+		Name:    "trash for deleted files",
+		SQL: `
+		create table trash (id integer not null primary key, author text not null, parcel text not null, path text not null, checksum text not null, requester text, device text, deleted timestamp);
+		create index trash_path on trash (author, parcel, path, id);
+		create index trash_deleted on trash (deleted);
+		create index trash_checksum on trash (checksum);
+		`,
+	},
+	{
+		Version: 13,
+		Name:    "replication state",
+		// holds a single row while the mirror follows a leader
+		SQL: `
+		create table replication (id integer not null primary key check (id = 1), leader text not null, cursor integer not null, leader_head integer not null, last_pull timestamp, last_error text);
+		`,
+	},
+	{
+		Version: 14,
+		Name:    "blob uploads per author",
+		// a commit may only reference blobs its author already references or uploaded, rows expire with the gc grace period
+		SQL: `
+		create table blob_uploads (author text not null, checksum text not null, created timestamp, primary key (author, checksum));
+		create index blob_uploads_created on blob_uploads (created);
+		`,
+	},
+	{
+		Version: 15,
+		Name:    "seen signatures",
+		// signatures accepted while they are fresh enough to verify, so a captured message cannot be sent again
+		SQL: `
+		create table seen_signatures (signature blob not null primary key, expires integer not null);
+		create index seen_signatures_expires on seen_signatures (expires);
+		`,
+	},
+	{
+		Version: 16,
+		Name:    "key tokens",
+		// one-time tokens an administrator issues for the first key of an author who already has data
+		SQL: `
+		create table key_tokens (author text not null primary key, token_hash blob not null, expires timestamp not null);
+		`,
+	},
+	{
+		Version: 17,
+		Name:    "encrypted parcels",
+		// the parcel key of an encrypted parcel, wrapped by the client for each device key of the author
+		SQL: `
+		alter table parcels add column encrypted bool not null default false;
+		create table parcel_keys (author text not null, parcel text not null, device text not null, wrapped blob not null, created timestamp, primary key (author, parcel, device));
+		`,
+	},
+	{
+		Version: 18,
+		Name:    "open snapshots",
+		// a snapshot of the per-file sync of older clients, their next uploads update it instead of adding snapshots
+		SQL: `
+		alter table snapshots add column open bool not null default false;
+		`,
+	},
+	{
+		Version: 19,
+		Name:    "paged initial replication",
+		// the last parcel a new follower copied, so the first copy of a leader goes in pages and resumes after a restart
+		SQL: `
+		alter table replication add column initial_after text;
+		`,
+	},
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 if none have been recorded
+func SchemaVersion(db *sql.DB) (int, error) {
+	var tables int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+func PendingMigrations(db *sql.DB) ([]Migration, error) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > migrations[len(migrations)-1].Version {
+		return nil, fmt.Errorf("database schema version %d is newer than this dit-mirror supports (%d)", version, migrations[len(migrations)-1].Version)
+	}
+	pending := make([]Migration, 0)
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateDB brings the database up to the latest schema, taking a backup first if it holds any data
+func MigrateDB(db *sql.DB, db_path string, blobs BlobStore) error {
+	pending, err := PendingMigrations(db)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_version'").Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables > 0 { // nothing to back up in a new database
+		backup := fmt.Sprintf("%s.v%d-%s.bak", db_path, pending[0].Version-1, time.Now().UTC().Format("20060102-150405"))
+		_, err = db.Exec("VACUUM INTO ?", backup)
+		if err != nil {
+			return fmt.Errorf("failed to back up database before migrating: %w", err)
+		}
+		slog.Info("backed up database before migrating", "backup", backup)
+	}
+
+	_, err = db.Exec("create table if not exists schema_version (version integer not null primary key, name text, applied timestamp)")
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		slog.Info("migrating database", "version", m.Version, "name", m.Name)
+		err = applyMigration(db, blobs, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, blobs BlobStore, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.SQL != "" {
+		_, err = tx.Exec(m.SQL)
+		if err != nil {
+			return err
+		}
+	}
+	if m.Func != nil {
+		err = m.Func(tx, blobs)
+		if err != nil {
+			return err
+		}
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, applied) VALUES (?, ?, ?)", m.Version, m.Name, timestamp)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func PrintPendingMigrations(db *sql.DB) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	pending, err := PendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Schema version:", version)
+	if len(pending) == 0 {
+		fmt.Println("Database is up to date")
+		return nil
+	}
+	fmt.Println("Pending migrations:")
+	for _, m := range pending {
+		fmt.Println("\t"+color.YellowString("%03d", m.Version), m.Name)
+	}
+	return nil
+}
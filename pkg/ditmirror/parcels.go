@@ -0,0 +1,306 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+const (
+	VISIBILITY_PRIVATE = "private" // owner and shared authors only
+	VISIBILITY_PUBLIC  = "public"  // anyone can read, only the owner can write
+)
+
+var ErrParcelAccess = errors.New("parcel not found or access denied")
+
+var (
+	ErrEncryptedParcel   = errors.New("the parcel is encrypted, its files have to be encrypted by the client")
+	ErrUnencryptedParcel = errors.New("the parcel is not encrypted, run dit parcel encrypt before syncing encrypted files")
+	ErrParcelNotEmpty    = errors.New("only a parcel without files or history can be encrypted, its files are stored unencrypted")
+	ErrNoParcelKey       = errors.New("the parcel key is not wrapped for this device, run dit parcel rewrap from a device that can read the parcel")
+)
+
+// EnsureParcel registers a parcel on first sync, new parcels are private
+func EnsureParcel(db execer, author string, parcel string) error {
+	author = strings.TrimPrefix(author, "@")
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.Exec("INSERT OR IGNORE INTO parcels (author, parcel, created) VALUES (?, ?, ?)", author, parcel, timestamp)
+	return err
+}
+
+func GetVisibility(db *sql.DB, author string, parcel string) (string, error) {
+	var visibility string
+	err := db.QueryRow("SELECT visibility FROM parcels WHERE author = ? AND parcel = ?", author, parcel).Scan(&visibility)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VISIBILITY_PRIVATE, nil
+	}
+	return visibility, err
+}
+
+func SetVisibility(db *sql.DB, author string, parcel string, visibility string) error {
+	if visibility != VISIBILITY_PRIVATE && visibility != VISIBILITY_PUBLIC {
+		return fmt.Errorf("invalid visibility %q, use %s or %s", visibility, VISIBILITY_PRIVATE, VISIBILITY_PUBLIC)
+	}
+	err := EnsureParcel(db, author, parcel)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE parcels SET visibility = ? WHERE author = ? AND parcel = ?", visibility, author, parcel)
+	return err
+}
+
+func ShareParcel(db *sql.DB, author string, parcel string, grantee string) error {
+	grantee = strings.TrimPrefix(strings.TrimSpace(grantee), "@")
+	if grantee == "" || grantee == author {
+		return errors.New("invalid author to share with")
+	}
+	err := EnsureParcel(db, author, parcel)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err = db.Exec("INSERT OR IGNORE INTO shares (author, parcel, grantee, created) VALUES (?, ?, ?, ?)", author, parcel, grantee, timestamp)
+	return err
+}
+
+func UnshareParcel(db *sql.DB, author string, parcel string, grantee string) error {
+	grantee = strings.TrimPrefix(strings.TrimSpace(grantee), "@")
+	res, err := db.Exec("DELETE FROM shares WHERE author = ? AND parcel = ? AND grantee = ?", author, parcel, grantee)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("parcel is not shared with %s", grantee)
+	}
+	return nil
+}
+
+func IsEncrypted(db querier, author string, parcel string) (bool, error) {
+	var encrypted bool
+	err := db.QueryRow("SELECT encrypted FROM parcels WHERE author = ? AND parcel = ?", strings.TrimPrefix(author, "@"), parcel).Scan(&encrypted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return encrypted, err
+}
+
+// CheckParcelBlob checks that a blob fits the parcel it is synced to: an encrypted parcel only holds blobs
+// encrypted by the client and an unencrypted parcel none
+func CheckParcelBlob(db querier, author string, parcel string, checksum string) error {
+	encrypted, err := IsEncrypted(db, author, parcel)
+	if err != nil {
+		return err
+	}
+	if encrypted && !ditsync.IsEncryptedBlob(checksum) {
+		return ErrEncryptedParcel
+	}
+	if !encrypted && ditsync.IsEncryptedBlob(checksum) {
+		return ErrUnencryptedParcel
+	}
+	return nil
+}
+
+// SetParcelKeys replaces the wrapped parcel keys of a parcel, each one wrapped by the client for an active device key.
+// The first call encrypts the parcel, which is only possible while nothing unencrypted is stored for it.
+// The mirror never sees the parcel key itself, so authors a parcel is shared with cannot decrypt it.
+func SetParcelKeys(db *sql.DB, author string, parcel string, wrapped map[string][]byte) error {
+	author = strings.TrimPrefix(author, "@")
+	if len(wrapped) == 0 {
+		return errors.New("no wrapped parcel keys")
+	}
+	active := make(map[string]bool)
+	keys, err := ListKeys(db, author)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.Revoked == "" {
+			active[key.Device] = true
+		}
+	}
+	for device, key := range wrapped {
+		if !active[device] {
+			return fmt.Errorf("no active key for device %q", device)
+		}
+		if len(key) == 0 || len(key) > 1024 {
+			return fmt.Errorf("invalid wrapped parcel key for device %q", device)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	encrypted, err := IsEncrypted(tx, author, parcel)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		var stored int
+		err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM files WHERE author = ?1 AND parcel = ?2)
+			+ (SELECT COUNT(*) FROM file_versions WHERE author = ?1 AND parcel = ?2)
+			+ (SELECT COUNT(*) FROM trash WHERE author = ?1 AND parcel = ?2)`, author, parcel).Scan(&stored)
+		if err != nil {
+			return err
+		}
+		if stored > 0 {
+			return ErrParcelNotEmpty
+		}
+		err = EnsureParcel(tx, author, parcel)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE parcels SET encrypted = true WHERE author = ? AND parcel = ?", author, parcel)
+		if err != nil {
+			return err
+		}
+	}
+	err = replaceParcelKeys(tx, author, parcel, wrapped)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceParcelKeys(tx execer, author string, parcel string, wrapped map[string][]byte) error {
+	_, err := tx.Exec("DELETE FROM parcel_keys WHERE author = ? AND parcel = ?", author, parcel)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	for device, key := range wrapped {
+		_, err = tx.Exec("INSERT INTO parcel_keys (author, parcel, device, wrapped, created) VALUES (?, ?, ?, ?, ?)", author, parcel, device, key, timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetParcelKeys returns the wrapped parcel keys of a parcel by device
+func GetParcelKeys(db querier, author string, parcel string) (map[string][]byte, error) {
+	rows, err := db.Query("SELECT device, wrapped FROM parcel_keys WHERE author = ? AND parcel = ?", strings.TrimPrefix(author, "@"), parcel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	wrapped := make(map[string][]byte)
+	for rows.Next() {
+		var device string
+		var key []byte
+		err = rows.Scan(&device, &key)
+		if err != nil {
+			return nil, err
+		}
+		wrapped[device] = key
+	}
+	return wrapped, rows.Err()
+}
+
+// CanRead checks if requester may read a parcel: the owner, anyone for public parcels, or authors it is shared with.
+// Only an authenticated requester is the owner or a grantee, the private parcels of an author without keys are
+// unreadable until the author registers a device key.
+func CanRead(db *sql.DB, author string, parcel string, requester string) bool {
+	author = strings.TrimPrefix(author, "@")
+	if requester != "" && requester == author {
+		return true
+	}
+	visibility, err := GetVisibility(db, author, parcel)
+	if err != nil {
+		return false
+	}
+	if visibility == VISIBILITY_PUBLIC {
+		return true
+	}
+	if requester == "" {
+		return false
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM shares WHERE author = ? AND parcel = ? AND grantee = ?", author, parcel, requester).Scan(&count)
+	return err == nil && count > 0
+}
+
+func handleParcelMessage(c net.Conn, db *sql.DB, msg *ditnet.ClientMessage, requester string, remote string) {
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+	if requester == "" || requester != author { // who may read is only decided by an authenticated owner
+		err := ErrAuthRequired
+		if !HasKeys(db, author) {
+			err = ErrKeyRequired
+		}
+		AuditLog(db, AUDIT_AUTH_FAIL, author, remote, msg.ParcelPath, "", "manage parcel")
+		sendFailure(c, err.Error())
+		return
+	}
+
+	switch msg.MessageType {
+	case ditnet.MSG_SET_VISIBILITY:
+		logAttrs(c, "visibility", msg.Message)
+		err := SetVisibility(db, author, msg.ParcelPath, msg.Message)
+		if err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		AuditLog(db, AUDIT_VISIBILITY, author, remote, msg.ParcelPath, "", msg.Message)
+
+	case ditnet.MSG_SET_PARCEL_KEYS:
+		var wrapped map[string][]byte
+		err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(&wrapped)
+		if err != nil {
+			sendFailure(c, "invalid parcel keys")
+			return
+		}
+		devices := make([]string, 0, len(wrapped))
+		for device := range wrapped {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		logAttrs(c, "devices", len(devices))
+		err = SetParcelKeys(db, author, msg.ParcelPath, wrapped)
+		if err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		AuditLog(db, AUDIT_PARCEL_KEY, author, remote, msg.ParcelPath, "", strings.Join(devices, ", "))
+
+	case ditnet.MSG_GET_PARCEL_KEY:
+		wrapped, err := GetParcelKeys(db, author, msg.ParcelPath)
+		if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		if wrapped[msg.Device] == nil {
+			sendFailure(c, ErrNoParcelKey.Error())
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_PARCEL_KEY, Data: wrapped[msg.Device]})
+		return
+
+	case ditnet.MSG_SHARE_PARCEL:
+		logAttrs(c, "grantee", msg.Message, "action", msg.Message2)
+		var err error
+		event := AUDIT_SHARE
+		if msg.Message2 == "remove" {
+			event = AUDIT_UNSHARE
+			err = UnshareParcel(db, author, msg.ParcelPath, msg.Message)
+		} else {
+			err = ShareParcel(db, author, msg.ParcelPath, msg.Message)
+		}
+		if err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		AuditLog(db, event, author, remote, msg.ParcelPath, "", msg.Message)
+	}
+	sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: "OK"})
+}
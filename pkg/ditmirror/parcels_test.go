@@ -0,0 +1,161 @@
+package ditmirror
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"strings"
+	"testing"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+func TestCanRead(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, parcel := range []string{"/private", "/public", "/shared"} {
+		if err := EnsureParcel(db, "alice", parcel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetVisibility(db, "alice", "/public", VISIBILITY_PUBLIC); err != nil {
+		t.Fatal(err)
+	}
+	if err := ShareParcel(db, "alice", "/shared", "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		parcel    string
+		requester string
+		want      bool
+	}{
+		{"/private", "alice", true},
+		{"/private", "", false}, // alice has no keys, an unsigned request is not the owner
+		{"/private", "bob", false},
+		{"/public", "", true},
+		{"/shared", "bob", true},
+		{"/shared", "", false},
+		{"/shared", "carol", false},
+	}
+	for _, c := range cases {
+		if got := CanRead(db, "@alice", c.parcel, c.requester); got != c.want {
+			t.Errorf("CanRead(%s, %q) = %v, want %v", c.parcel, c.requester, got, c.want)
+		}
+	}
+}
+
+func TestParcelSettingsNeedAnAuthenticatedOwner(t *testing.T) {
+	_, addr := startTestServer(t, DefaultSettings())
+	alice := newTestDevice(t, addr, "alice", "laptop")
+	alice.syncUp(t, "/notes", map[string]string{"a.txt": "secret"})
+
+	for _, msg := range []ditnet.ClientMessage{
+		{OriginAuthor: "carol", ParcelPath: "/notes", MessageType: ditnet.MSG_SET_VISIBILITY, Message: VISIBILITY_PUBLIC},
+		{OriginAuthor: "carol", ParcelPath: "/notes", MessageType: ditnet.MSG_SHARE_PARCEL, Message: "mallory"},
+		{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_SET_VISIBILITY, Message: VISIBILITY_PUBLIC},
+		{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_GET_PARCEL},
+	} {
+		resp, err := ditnet.ExchangeMessage(msg, addr) // unsigned
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.MessageType != ditnet.MSG_FAILURE {
+			t.Errorf("unsigned %s for @%s was accepted", ditnet.MessageTypeName(msg.MessageType), msg.OriginAuthor)
+		}
+	}
+
+	alice.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_SET_VISIBILITY, Message: VISIBILITY_PUBLIC})
+	resp, err := ditnet.ExchangeMessage(ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_GET_PARCEL}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MessageType != ditnet.MSG_PARCEL {
+		t.Errorf("public parcel refused an unsigned read: %s", resp.Message)
+	}
+}
+
+func setParcelKeysMessage(t *testing.T, parcel string, wrapped map[string][]byte) ditnet.ClientMessage {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(wrapped); err != nil {
+		t.Fatal(err)
+	}
+	return ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: parcel, MessageType: ditnet.MSG_SET_PARCEL_KEYS, Data: buf.Bytes()}
+}
+
+func TestEncryptedParcels(t *testing.T) {
+	server, addr := startTestServer(t, DefaultSettings())
+	laptop := newTestDevice(t, addr, "alice", "laptop")
+	phone := laptop.addDevice(t, "phone")
+	laptop.syncUp(t, "/plain", map[string]string{"a.txt": "not encrypted"})
+
+	wrapped := map[string][]byte{"laptop": []byte("wrapped for laptop"), "phone": []byte("wrapped for phone")}
+	if resp := laptop.send(t, setParcelKeysMessage(t, "/plain", wrapped)); resp.Message != ErrParcelNotEmpty.Error() {
+		t.Fatalf("encrypted a parcel with unencrypted files: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	if resp := laptop.send(t, setParcelKeysMessage(t, "/secret", map[string][]byte{"tablet": []byte("wrapped")})); resp.MessageType != ditnet.MSG_FAILURE {
+		t.Fatal("wrapped a parcel key for a device without a key")
+	}
+	laptop.mustSucceed(t, setParcelKeysMessage(t, "/secret", wrapped))
+
+	key := make([]byte, ditsync.PARCEL_KEY_SIZE)
+	rand.Read(key)
+	content := []byte("encrypted content")
+	id := ditsync.EncryptedBlobID(key, ditsync.DataChecksum(content))
+	blob, err := ditsync.EncryptBlob(key, content, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, put := range []struct {
+		parcel, id string
+		data       []byte
+		want       string
+	}{
+		{"/secret", ditsync.DataChecksum(content), content, ErrEncryptedParcel.Error()},
+		{"/plain", id, blob, ErrUnencryptedParcel.Error()},
+		{"/secret", "x../../../etc/passwd", blob, "invalid encrypted data"},
+	} {
+		resp := laptop.send(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: put.parcel, MessageType: ditnet.MSG_PUT_BLOB,
+			Message: "a.txt", Message2: put.id, Data: put.data})
+		if resp.MessageType != ditnet.MSG_FAILURE || !strings.Contains(resp.Message, put.want) {
+			t.Fatalf("put %s to %s: %s %q, want %q", put.id, put.parcel, ditnet.MessageTypeName(resp.MessageType), resp.Message, put.want)
+		}
+	}
+
+	laptop.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/secret", MessageType: ditnet.MSG_PUT_BLOB,
+		Message: "a.txt", Message2: id, Data: blob})
+	var master bytes.Buffer
+	gob.NewEncoder(&master).Encode(ditnet.NetMaster{Master: map[string]string{"a.txt": id}})
+	laptop.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/secret", MessageType: ditnet.MSG_COMMIT, Data: master.Bytes()})
+	if !phone.getParcel(t, "alice", "/secret").Info.Encrypted {
+		t.Fatal("the parcel is not listed as encrypted")
+	}
+	data, err := ditsync.DecryptBlob(key, []byte(phone.getFile(t, "alice", "/secret", "a.txt")))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("decrypted %q: %v", data, err)
+	}
+
+	resp := phone.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/secret", MessageType: ditnet.MSG_GET_PARCEL_KEY})
+	if string(resp.Data) != "wrapped for phone" {
+		t.Fatalf("the phone got the wrapped key %q", resp.Data)
+	}
+	laptop.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", MessageType: ditnet.MSG_REVOKE_KEY, Message: "phone"})
+	keys, err := GetParcelKeys(server.db, "alice", "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys["laptop"] == nil {
+		t.Fatalf("the parcel key is wrapped for %d devices after revoking the phone", len(keys))
+	}
+	// rewrapping for the remaining devices replaces the wrapped keys
+	laptop.mustSucceed(t, setParcelKeysMessage(t, "/secret", map[string][]byte{"laptop": []byte("rewrapped for laptop")}))
+	resp = laptop.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/secret", MessageType: ditnet.MSG_GET_PARCEL_KEY})
+	if string(resp.Data) != "rewrapped for laptop" {
+		t.Fatalf("the laptop got the wrapped key %q", resp.Data)
+	}
+
+	if err := MoveParcel(server.db, "alice", "/secret", "bob", "/secret"); err == nil {
+		t.Fatal("moved an encrypted parcel to another author")
+	}
+}
@@ -0,0 +1,251 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/fatih/color"
+)
+
+type Quota struct {
+	MaxBytes int64 // 0 for unlimited
+	MaxFiles int64 // 0 for unlimited
+}
+
+type Usage struct {
+	Bytes int64 // stored bytes of the distinct blobs referenced by the author's files, versions and snapshots
+	Files int64
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+func GetQuota(db querier, cfg *Settings, author string) (Quota, error) {
+	var quota Quota
+	err := db.QueryRow("SELECT max_bytes, max_files FROM quotas WHERE author = ?", author).Scan(&quota.MaxBytes, &quota.MaxFiles)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cfg.DefaultQuota, nil
+	}
+	return quota, err
+}
+
+func SetQuota(db *sql.DB, author string, quota Quota) error {
+	_, err := db.Exec("INSERT INTO quotas (author, max_bytes, max_files) VALUES (?, ?, ?) ON CONFLICT (author) DO UPDATE SET max_bytes = excluded.max_bytes, max_files = excluded.max_files",
+		author, quota.MaxBytes, quota.MaxFiles)
+	return err
+}
+
+func GetUsage(db querier, author string) (Usage, error) {
+	var usage Usage
+	err := db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM blobs WHERE checksum IN
+		(SELECT checksum FROM files WHERE author = ? UNION SELECT checksum FROM file_versions WHERE author = ?
+		UNION SELECT f.checksum FROM snapshot_files f JOIN snapshots s ON s.id = f.snapshot_id WHERE s.author = ?
+		UNION SELECT checksum FROM trash WHERE author = ?)`, author, author, author, author).Scan(&usage.Bytes)
+	if err != nil {
+		return usage, err
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM files WHERE author = ?", author).Scan(&usage.Files)
+	return usage, err
+}
+
+// CheckQuota checks that storing checksum (size bytes) at path keeps the author within their quota
+func CheckQuota(db *sql.DB, cfg *Settings, author string, parcel string, path string, checksum string, size int64) error {
+	author = strings.TrimPrefix(author, "@")
+	quota, err := GetQuota(db, cfg, author)
+	if err != nil {
+		return err
+	}
+	if quota.MaxBytes == 0 && quota.MaxFiles == 0 {
+		return nil
+	}
+	usage, err := GetUsage(db, author)
+	if err != nil {
+		return err
+	}
+
+	var oldChecksum string
+	err = db.QueryRow("SELECT checksum FROM files WHERE author = ? AND parcel = ? AND path = ?", author, parcel, path).Scan(&oldChecksum)
+	isNewFile := errors.Is(err, sql.ErrNoRows)
+	if err != nil && !isNewFile {
+		return err
+	}
+	if isNewFile {
+		usage.Files++
+	}
+
+	if oldChecksum != checksum {
+		refs, err := countAuthorRefs(db, author, checksum)
+		if err != nil {
+			return err
+		}
+		if refs == 0 {
+			usage.Bytes += size
+		}
+		if oldChecksum != "" {
+			refs, err = countAuthorRefs(db, author, oldChecksum)
+			if err != nil {
+				return err
+			}
+			if refs == 1 { // the old data is only referenced by the file being replaced, and not kept as a version
+				var oldSize int64
+				db.QueryRow("SELECT size FROM blobs WHERE checksum = ?", oldChecksum).Scan(&oldSize)
+				usage.Bytes -= oldSize
+			}
+		}
+	}
+
+	if quota.MaxFiles > 0 && usage.Files > quota.MaxFiles {
+		return fmt.Errorf("%w: %d of %d files", ErrQuotaExceeded, usage.Files, quota.MaxFiles)
+	}
+	if quota.MaxBytes > 0 && usage.Bytes > quota.MaxBytes {
+		return fmt.Errorf("%w: %s of %s", ErrQuotaExceeded, FormatSize(usage.Bytes), FormatSize(quota.MaxBytes))
+	}
+	return nil
+}
+
+// addedBytes returns the stored size of the blobs in master the author is not charged for yet. A commit keeps
+// every blob the author references, replaced and removed files stay in the versions and the trash.
+func addedBytes(db querier, author string, master map[string]string) (int64, error) {
+	var added int64
+	counted := make(map[string]bool)
+	for _, checksum := range master {
+		if counted[checksum] {
+			continue
+		}
+		counted[checksum] = true
+		var size int64
+		err := db.QueryRow("SELECT COALESCE(size, 0) FROM blobs WHERE checksum = ? AND NOT "+referencedByAuthor,
+			checksum, author, checksum, author, checksum, author, checksum, author, checksum).Scan(&size)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		added += size
+	}
+	return added, nil
+}
+
+func countAuthorRefs(db *sql.DB, author string, checksum string) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM files WHERE author = ? AND checksum = ?) + (SELECT COUNT(*) FROM file_versions WHERE author = ? AND checksum = ?)
+		+ (SELECT COUNT(*) FROM trash WHERE author = ? AND checksum = ?)`,
+		author, checksum, author, checksum, author, checksum).Scan(&count)
+	return count, err
+}
+
+func GetBlobSize(db *sql.DB, checksum string) (int64, error) {
+	var size int64
+	err := db.QueryRow("SELECT size FROM blobs WHERE checksum = ?", checksum).Scan(&size)
+	return size, err
+}
+
+func handleQuotaMessage(c net.Conn, db *sql.DB, cfg *Settings, msg *ditnet.ClientMessage, requester string) {
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+	if err := AuthorizeAuthor(db, author, requester); err != nil {
+		sendFailure(c, err.Error())
+		return
+	}
+	quota, err := GetQuota(db, cfg, author)
+	if err != nil {
+		connLogger(c).Error("db error", "err", err)
+		sendFailure(c, "db error")
+		return
+	}
+	usage, err := GetUsage(db, author)
+	if err != nil {
+		connLogger(c).Error("db error", "err", err)
+		sendFailure(c, "db error")
+		return
+	}
+
+	var quotaBytes bytes.Buffer
+	err = gob.NewEncoder(&quotaBytes).Encode(ditnet.NetQuota{
+		UsedBytes: usage.Bytes,
+		UsedFiles: usage.Files,
+		MaxBytes:  quota.MaxBytes,
+		MaxFiles:  quota.MaxFiles,
+	})
+	if err != nil {
+		connLogger(c).Error("gob encode error", "err", err)
+		return
+	}
+	sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_QUOTA, Data: quotaBytes.Bytes()})
+}
+
+// ParseSize parses a byte count with an optional KB, MB, GB or TB suffix (powers of 1024)
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(s, suffix) {
+			multiplier = int64(1) << (10 * (i + 1))
+			s = strings.TrimSpace(strings.TrimSuffix(s, suffix))
+			break
+		}
+	}
+	s = strings.TrimSuffix(s, "B")
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+func FormatSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.2f %s", size, units[i])
+}
+
+func PrintQuotas(db *sql.DB, cfg *Settings) error {
+	rows, err := db.Query("SELECT DISTINCT author FROM files UNION SELECT author FROM quotas ORDER BY 1")
+	if err != nil {
+		return err
+	}
+	authors := make([]string, 0)
+	for rows.Next() {
+		var author string
+		if err := rows.Scan(&author); err != nil {
+			rows.Close()
+			return err
+		}
+		authors = append(authors, author)
+	}
+	rows.Close()
+
+	for _, author := range authors {
+		quota, err := GetQuota(db, cfg, author)
+		if err != nil {
+			return err
+		}
+		usage, err := GetUsage(db, author)
+		if err != nil {
+			return err
+		}
+		fmt.Println(color.YellowString("@"+author), formatUsage(usage.Bytes, quota.MaxBytes, FormatSize), "|",
+			formatUsage(usage.Files, quota.MaxFiles, func(n int64) string { return strconv.FormatInt(n, 10) + " files" }))
+	}
+	return nil
+}
+
+func formatUsage(used int64, max int64, format func(int64) string) string {
+	if max == 0 {
+		return format(used) + " (unlimited)"
+	}
+	return format(used) + " of " + format(max)
+}
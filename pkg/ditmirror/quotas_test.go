@@ -0,0 +1,103 @@
+package ditmirror
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+func TestCommitChecksTheByteQuota(t *testing.T) {
+	settings := DefaultSettings()
+	settings.DefaultQuota = Quota{MaxBytes: 200}
+	server, addr := startTestServer(t, settings)
+	alice := newTestDevice(t, addr, "alice", "laptop")
+
+	// each blob fits the quota on its own, so staging both is accepted
+	files := map[string]string{"a.txt": strings.Repeat("a", 150), "b.txt": strings.Repeat("b", 150)}
+	master := make(map[string]string)
+	for path, content := range files {
+		master[path] = ditsync.DataChecksum([]byte(content))
+		alice.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_PUT_BLOB,
+			Message: path, Message2: master[path], Data: []byte(content)})
+	}
+	var masterBytes bytes.Buffer
+	gob.NewEncoder(&masterBytes).Encode(ditnet.NetMaster{Master: master})
+	resp := alice.send(t, ditnet.ClientMessage{OriginAuthor: "alice", ParcelPath: "/p", MessageType: ditnet.MSG_COMMIT, Data: masterBytes.Bytes()})
+	if resp.MessageType != ditnet.MSG_QUOTA_EXCEEDED {
+		t.Fatalf("commit of 300 B against a quota of 200 B: %s %q", ditnet.MessageTypeName(resp.MessageType), resp.Message)
+	}
+	usage, err := GetUsage(server.db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 0 || usage.Files != 0 {
+		t.Fatalf("the refused commit left %d B in %d files", usage.Bytes, usage.Files)
+	}
+
+	// the same content twice is stored and charged once
+	alice.syncUp(t, "/p", map[string]string{"a.txt": files["a.txt"], "copy.txt": files["a.txt"]})
+	alice.syncUp(t, "/other", map[string]string{"a.txt": files["a.txt"]})
+	usage, err = GetUsage(server.db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 150 {
+		t.Fatalf("usage is %d B, want 150 B", usage.Bytes)
+	}
+}
+
+func TestConcurrentCommitsShareTheQuota(t *testing.T) {
+	db, blobs := newTestDB(t)
+	cfg := DefaultSettings()
+	cfg.DefaultQuota = Quota{MaxFiles: 3}
+	const parcels = 6
+	masters := make([]map[string]string, parcels)
+	for i := range masters {
+		masters[i] = make(map[string]string)
+		for _, path := range []string{"a.txt", "b.txt"} {
+			content := []byte(fmt.Sprintf("%s of parcel %d", path, i))
+			checksum := ditsync.DataChecksum(content)
+			if err := PutBlob(db, blobs, checksum, content, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := RecordUpload(db, "alice", checksum); err != nil {
+				t.Fatal(err)
+			}
+			masters[i][path] = checksum
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, parcels)
+	for i := range masters {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = CommitSnapshot(db, &cfg, "alice", fmt.Sprintf("/p%d", i), ditnet.NetMaster{Master: masters[i]}, "alice", "laptop", "test")
+		}(i)
+	}
+	wg.Wait()
+
+	committed := 0
+	for i, err := range errs {
+		if err == nil {
+			committed++
+		} else if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("commit %d: %v", i, err)
+		}
+	}
+	usage, err := GetUsage(db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed != 1 || usage.Files != 2 {
+		t.Fatalf("%d commits of 2 files passed a quota of 3 files, %d files stored", committed, usage.Files)
+	}
+}
@@ -0,0 +1,785 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/fatih/color"
+)
+
+// A mirror can follow another mirror, the leader. The follower pulls the leader's audit log as a change stream,
+// asks for the current state of every parcel and author the changes touch, copies the blobs it is missing and
+// applies the state locally. Parcels deleted or moved by an administrator are deleted or moved on the follower
+// first, in the order it happened on the leader. A follower is read-only for clients until it is promoted, and a promoted mirror
+// can in turn be followed by its old leader. Quotas are configured per mirror and are not replicated.
+//
+// Replication requests are signed with the replication secret like a client signs with its device key, the secret
+// itself is never sent. The parcel data is not encrypted in transit, run replication over a private network or a tunnel.
+//
+// A new follower first copies every parcel in pages ordered by author and parcel, then replays the changes made
+// since the copy started, which sends the parcels that changed during the copy again.
+
+const replicationBatchSize = 500 // changes per batch
+
+var replicationPageFiles = 20000 // snapshot files per page of the first copy, a larger parcel is sent alone
+
+// audit events that change the state of a parcel, every other event except key changes is ignored
+var replicatedParcelEvents = map[string]bool{
+	AUDIT_SYNC: true, AUDIT_DELETE: true, AUDIT_RESTORE: true, AUDIT_TAG: true, AUDIT_UNTAG: true,
+	AUDIT_VISIBILITY: true, AUDIT_SHARE: true, AUDIT_UNSHARE: true, AUDIT_REPLICATE: true, AUDIT_PARCEL_KEY: true,
+}
+
+type ReplicationState struct {
+	Leader     string
+	Cursor     int64  // last change of the leader applied here
+	LeaderHead int64  // last change on the leader when it was last asked
+	LastPull   string // time of the last successful pull
+	LastError  string
+	Initial    string // last parcel copied while the first copy of the leader runs, author/parcel
+}
+
+// GetReplicationState returns the state of this mirror as a follower, following is false for a leader
+func GetReplicationState(db *sql.DB) (ReplicationState, bool, error) {
+	var state ReplicationState
+	var lastPull sql.NullString
+	err := db.QueryRow("SELECT leader, cursor, leader_head, last_pull, COALESCE(last_error, ''), COALESCE(initial_after, '') FROM replication WHERE id = 1").
+		Scan(&state.Leader, &state.Cursor, &state.LeaderHead, &lastPull, &state.LastError, &state.Initial)
+	if errors.Is(err, sql.ErrNoRows) {
+		return state, false, nil
+	} else if err != nil {
+		return state, false, err
+	}
+	state.LastPull = lastPull.String
+	return state, true, nil
+}
+
+// FollowMirror makes this mirror a follower of leader, a new leader is replicated from its first change
+func FollowMirror(db *sql.DB, leader string) error {
+	leader = strings.TrimSpace(leader)
+	if leader == "" {
+		return errors.New("leader address cannot be empty")
+	}
+	_, err := db.Exec(`INSERT INTO replication (id, leader, cursor, leader_head) VALUES (1, ?, 0, 0)
+		ON CONFLICT (id) DO UPDATE SET leader = excluded.leader, cursor = 0, leader_head = 0, last_pull = NULL, last_error = NULL, initial_after = NULL
+		WHERE leader != excluded.leader`, leader)
+	return err
+}
+
+// PromoteMirror stops following the leader, the mirror accepts writes from clients again
+func PromoteMirror(db *sql.DB) (string, error) {
+	state, following, err := GetReplicationState(db)
+	if err != nil {
+		return "", err
+	}
+	if !following {
+		return "", errors.New("this mirror is not following another mirror")
+	}
+	_, err = db.Exec("DELETE FROM replication WHERE id = 1")
+	return state.Leader, err
+}
+
+func PrintReplicationStatus(db *sql.DB) error {
+	state, following, err := GetReplicationState(db)
+	if err != nil {
+		return err
+	}
+	var latest int64
+	err = db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM audit").Scan(&latest)
+	if err != nil {
+		return err
+	}
+	if !following {
+		fmt.Println("Role:\t\tleader (not following another mirror)")
+		fmt.Println("Changes:\t", latest)
+		return nil
+	}
+	fmt.Println("Role:\t\tfollower of", color.YellowString(state.Leader))
+	if state.LastPull == "" {
+		fmt.Println("Position:\t", color.HiYellowString("waiting for the first pull"))
+	} else if state.Initial != "" {
+		fmt.Println("Position:\t", color.HiYellowString("copying the parcels of the leader, at %s", state.Initial))
+	} else {
+		behind := state.LeaderHead - state.Cursor
+		position := fmt.Sprintf("change %d of %d", state.Cursor, state.LeaderHead)
+		if behind > 0 {
+			fmt.Println("Position:\t", position, color.HiYellowString("(%d behind)", behind))
+		} else {
+			fmt.Println("Position:\t", position, color.GreenString("(up to date)"))
+		}
+		pulled, _ := time.Parse(time.RFC3339, state.LastPull)
+		fmt.Println("Last pull:\t", state.LastPull, fmt.Sprintf("(%s ago)", time.Since(pulled).Round(time.Second)))
+	}
+	if state.LastError != "" {
+		fmt.Println("Last error:\t", color.HiRedString(state.LastError))
+	}
+	return nil
+}
+
+// isWriteMessage reports whether a client message changes the mirror, a follower refuses these
+func isWriteMessage(messageType int) bool {
+	switch messageType {
+	case ditnet.MSG_SYNC_FILE, ditnet.MSG_SYNC_MASTER, ditnet.MSG_PUT_BLOB, ditnet.MSG_COMMIT,
+		ditnet.MSG_CREATE_TAG, ditnet.MSG_DELETE_TAG, ditnet.MSG_RESTORE_TRASH,
+		ditnet.MSG_ADD_KEY, ditnet.MSG_REVOKE_KEY, ditnet.MSG_SET_VISIBILITY, ditnet.MSG_SHARE_PARCEL, ditnet.MSG_SET_PARCEL_KEYS:
+		return true
+	}
+	return false
+}
+
+/* Leader */
+
+// ReplicationBatch collects the state touched by the changes after cursor. A cursor of 0 starts the first copy of
+// every parcel, after is the last parcel of the previous page while it runs.
+func ReplicationBatch(db *sql.DB, cfg *Settings, cursor int64, after string) (ditnet.NetReplBatch, error) {
+	if cursor == 0 || after != "" {
+		return initialReplicationBatch(db, cfg, cursor, after)
+	}
+	batch := ditnet.NetReplBatch{Head: cursor}
+	err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM audit").Scan(&batch.Latest)
+	if err != nil {
+		return batch, err
+	}
+
+	type parcelKey struct{ author, parcel string }
+	since := make(map[parcelKey]string) // parcel -> time of its first change in the batch
+	order := make([]parcelKey, 0)
+	authors := make(map[string]bool)
+
+	rows, err := db.Query("SELECT id, time, event, author, parcel, detail FROM audit WHERE id > ? ORDER BY id LIMIT ?", cursor, replicationBatchSize)
+	if err != nil {
+		return batch, err
+	}
+	for rows.Next() {
+		var id int64
+		var changed string
+		var event string
+		var author, parcel, detail sql.NullString
+		if err := rows.Scan(&id, &changed, &event, &author, &parcel, &detail); err != nil {
+			rows.Close()
+			return batch, err
+		}
+		batch.Head = id
+		if event == AUDIT_KEY_ADD || event == AUDIT_KEY_REVOKE || event == AUDIT_KEY_RESET {
+			authors[author.String] = true
+			continue
+		}
+		if event == AUDIT_PARCEL_DELETE || event == AUDIT_PARCEL_MOVE {
+			op := ditnet.NetReplParcelOp{Author: author.String, Parcel: parcel.String}
+			if event == AUDIT_PARCEL_MOVE {
+				i := strings.Index(detail.String, "/")
+				if !strings.HasPrefix(detail.String, "@") || i < 2 {
+					continue
+				}
+				op.ToAuthor, op.ToParcel = detail.String[1:i], detail.String[i:]
+				// the moved parcel may have changed earlier in the batch, under its old path
+				key := parcelKey{op.ToAuthor, op.ToParcel}
+				if _, ok := since[key]; !ok {
+					since[key] = changed
+					order = append(order, key)
+				}
+			}
+			batch.ParcelOps = append(batch.ParcelOps, op)
+			continue
+		}
+		if !replicatedParcelEvents[event] || !parcel.Valid || parcel.String == "" {
+			continue
+		}
+		key := parcelKey{author.String, parcel.String}
+		if _, ok := since[key]; !ok {
+			since[key] = changed
+			order = append(order, key)
+		}
+	}
+	rows.Close()
+
+	for _, key := range order {
+		exists, err := parcelExists(db, key.author, key.parcel)
+		if err != nil {
+			return batch, err
+		}
+		if !exists { // deleted or moved since, the follower learns that from ParcelOps
+			continue
+		}
+		parcel, err := replParcelState(db, cfg, key.author, key.parcel, since[key])
+		if err != nil {
+			return batch, err
+		}
+		batch.Parcels = append(batch.Parcels, parcel)
+	}
+	for author := range authors {
+		keys, err := ListKeys(db, author)
+		if err != nil {
+			return batch, err
+		}
+		batch.Keys = append(batch.Keys, ditnet.NetReplKeys{Author: author, Keys: keys})
+	}
+	return batch, nil
+}
+
+// initialReplicationBatch copies the parcels after the parcel after, including those older than the audit log, up to
+// replicationPageFiles snapshot files. The first page fixes Head at the latest change and carries the keys of every author,
+// the follower replays the changes after Head once Next comes back empty.
+func initialReplicationBatch(db *sql.DB, cfg *Settings, head int64, after string) (ditnet.NetReplBatch, error) {
+	batch := ditnet.NetReplBatch{Head: head}
+	err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM audit").Scan(&batch.Latest)
+	if err != nil {
+		return batch, err
+	}
+	var afterAuthor, afterParcel string
+	if after == "" {
+		batch.Head = batch.Latest
+		authors, err := keyAuthors(db)
+		if err != nil {
+			return batch, err
+		}
+		for _, author := range authors {
+			keys, err := ListKeys(db, author)
+			if err != nil {
+				return batch, err
+			}
+			batch.Keys = append(batch.Keys, ditnet.NetReplKeys{Author: author, Keys: keys})
+		}
+	} else {
+		i := strings.Index(after, "/")
+		if i < 1 {
+			return batch, fmt.Errorf("invalid parcel %q", after)
+		}
+		afterAuthor, afterParcel = after[:i], after[i:]
+	}
+
+	rows, err := db.Query(`SELECT author, parcel FROM (SELECT author, parcel FROM parcels UNION SELECT author, parcel FROM files)
+		WHERE author > ?1 OR (author = ?1 AND parcel > ?2) ORDER BY author, parcel LIMIT ?3`, afterAuthor, afterParcel, replicationBatchSize)
+	if err != nil {
+		return batch, err
+	}
+	type parcelKey struct{ author, parcel string }
+	order := make([]parcelKey, 0)
+	for rows.Next() {
+		var key parcelKey
+		if err := rows.Scan(&key.author, &key.parcel); err != nil {
+			rows.Close()
+			return batch, err
+		}
+		order = append(order, key)
+	}
+	rows.Close()
+
+	files := 0
+	for i, key := range order {
+		parcel, err := replParcelState(db, cfg, key.author, key.parcel, "")
+		if err != nil {
+			return batch, err
+		}
+		batch.Parcels = append(batch.Parcels, parcel)
+		for _, snapshot := range parcel.Snapshots {
+			files += len(snapshot.Files)
+		}
+		if files >= replicationPageFiles && i < len(order)-1 || i == replicationBatchSize-1 {
+			batch.Next = key.author + key.parcel
+			break
+		}
+	}
+	return batch, nil
+}
+
+// keyAuthors returns every author with a device key
+func keyAuthors(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT author FROM keys ORDER BY author")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authors := make([]string, 0)
+	for rows.Next() {
+		var author string
+		if err := rows.Scan(&author); err != nil {
+			return nil, err
+		}
+		authors = append(authors, author)
+	}
+	return authors, rows.Err()
+}
+
+// replParcelState returns the settings, tags and the snapshots created since a time of a parcel, always including the latest
+func replParcelState(db *sql.DB, cfg *Settings, author string, parcel string, since string) (ditnet.NetReplParcel, error) {
+	state := ditnet.NetReplParcel{Author: author, Parcel: parcel}
+	var err error
+	state.Visibility, err = GetVisibility(db, author, parcel)
+	if err != nil {
+		return state, err
+	}
+	state.Encrypted, err = IsEncrypted(db, author, parcel)
+	if err != nil {
+		return state, err
+	}
+	state.Keys, err = GetParcelKeys(db, author, parcel)
+	if err != nil {
+		return state, err
+	}
+	rows, err := db.Query("SELECT grantee FROM shares WHERE author = ? AND parcel = ? ORDER BY grantee", author, parcel)
+	if err != nil {
+		return state, err
+	}
+	for rows.Next() {
+		var grantee string
+		if err := rows.Scan(&grantee); err != nil {
+			rows.Close()
+			return state, err
+		}
+		state.Shares = append(state.Shares, grantee)
+	}
+	rows.Close()
+
+	state.Tags, err = ListTags(db, author, parcel)
+	if err != nil {
+		return state, err
+	}
+	state.Trash, err = ListTrash(db, cfg, author, parcel)
+	if err != nil {
+		return state, err
+	}
+
+	rows, err = db.Query(`SELECT id, number, COALESCE(requester, ''), COALESCE(device, ''), created FROM snapshots
+		WHERE author = ? AND parcel = ? AND (created >= ? OR number = (SELECT MAX(number) FROM snapshots WHERE author = ? AND parcel = ?))
+		ORDER BY number`, author, parcel, since, author, parcel)
+	if err != nil {
+		return state, err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		var snapshot ditnet.NetReplSnapshot
+		var created sql.NullString
+		if err := rows.Scan(&id, &snapshot.Number, &snapshot.Requester, &snapshot.Device, &created); err != nil {
+			rows.Close()
+			return state, err
+		}
+		snapshot.Created = created.String
+		ids = append(ids, id)
+		state.Snapshots = append(state.Snapshots, snapshot)
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		files, err := parcelSnapshotFiles(db, id)
+		if err != nil {
+			return state, err
+		}
+		state.Snapshots[i].Files = files
+	}
+	return state, nil
+}
+
+func parcelSnapshotFiles(db *sql.DB, snapshotID int64) (map[string]string, error) {
+	rows, err := db.Query("SELECT path, checksum FROM snapshot_files WHERE snapshot_id = ?", snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]string)
+	for rows.Next() {
+		var path, checksum string
+		if err := rows.Scan(&path, &checksum); err != nil {
+			return nil, err
+		}
+		files[path] = checksum
+	}
+	return files, rows.Err()
+}
+
+func handleReplicationMessage(c net.Conn, db *sql.DB, blobs BlobStore, cfg *Settings, msg *ditnet.ClientMessage, remote string) {
+	secret := cfg.ReplicationSecret
+	if secret == "" {
+		sendFailure(c, "replication is not enabled on this mirror")
+		return
+	}
+	err := msg.VerifySecret(secret)
+	if err == nil {
+		err = markSignatureSeen(db, msg)
+	}
+	if err != nil {
+		AuditLog(db, AUDIT_AUTH_FAIL, "", remote, "", "", "replication: "+err.Error())
+		sendFailure(c, "replication refused: "+err.Error())
+		return
+	}
+
+	switch msg.MessageType {
+	case ditnet.MSG_REPL_CHANGES:
+		cursor, err := strconv.ParseInt(msg.Message, 10, 64)
+		if err != nil {
+			sendFailure(c, "invalid cursor")
+			return
+		}
+		batch, err := ReplicationBatch(db, cfg, cursor, msg.Message2)
+		if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		var batchBytes bytes.Buffer
+		err = gob.NewEncoder(&batchBytes).Encode(batch)
+		if err != nil {
+			connLogger(c).Error("gob encode error", "err", err)
+			return
+		}
+		if len(batch.ParcelOps) > 0 || len(batch.Parcels) > 0 || len(batch.Keys) > 0 {
+			logAttrs(c, "cursor", cursor, "head", batch.Head, "latest", batch.Latest, "next", batch.Next)
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_REPL_BATCH, Data: batchBytes.Bytes()})
+
+	case ditnet.MSG_REPL_BLOB:
+		data, gzip, err := GetBlob(db, blobs, msg.Message)
+		if errors.Is(err, ErrMissingBlob) {
+			sendFailure(c, err.Error())
+			return
+		} else if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_FILE, Message: msg.Message, Data: data, IsGZIP: gzip})
+	}
+}
+
+/* Follower */
+
+// runReplication keeps this mirror up to date with its leader while it is a follower, it checks for a
+// leader every interval so a mirror can be made a follower or promoted while it is running. It returns once
+// the server stops, after the batch being applied.
+func (s *Server) runReplication() {
+	for {
+		state, following, err := GetReplicationState(s.db)
+		if err != nil {
+			slog.Error("replication error", "err", err)
+		} else if following {
+			err = s.catchUp(state)
+			if err != nil {
+				slog.Error("replication error", "leader", state.Leader, "err", err)
+				s.db.Exec("UPDATE replication SET last_error = ? WHERE id = 1 AND leader = ?", err.Error(), state.Leader)
+			}
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.replicationInterval):
+		}
+	}
+}
+
+// catchUp pulls batches from the leader until this mirror has applied every change or the server stops
+func (s *Server) catchUp(state ReplicationState) error {
+	for {
+		cfg := s.Settings()
+		batch, err := pullBatch(cfg.ReplicationSecret, state.Leader, state.Cursor, state.Initial)
+		if err != nil {
+			return err
+		}
+		err = s.applyBatch(cfg, state.Leader, batch)
+		if err != nil {
+			return err
+		}
+		if batch.Next == "" && (batch.Head >= batch.Latest || batch.Head == state.Cursor) {
+			return nil
+		}
+		select {
+		case <-s.stop:
+			return nil
+		default:
+		}
+		state.Cursor = batch.Head
+		state.Initial = batch.Next
+	}
+}
+
+func pullBatch(secret string, leader string, cursor int64, after string) (ditnet.NetReplBatch, error) {
+	var batch ditnet.NetReplBatch
+	msg := ditnet.ClientMessage{
+		MessageType: ditnet.MSG_REPL_CHANGES,
+		Message:     strconv.FormatInt(cursor, 10),
+		Message2:    after,
+	}
+	msg.SignWithSecret(secret)
+	resp, err := ditnet.ExchangeMessage(msg, leader)
+	if err != nil {
+		return batch, err
+	}
+	if resp.MessageType != ditnet.MSG_REPL_BATCH {
+		return batch, fmt.Errorf("leader refused replication: %s", resp.Message)
+	}
+	err = gob.NewDecoder(bytes.NewReader(resp.Data)).Decode(&batch)
+	return batch, err
+}
+
+// fetchBlob copies a blob from the leader into the local blob store
+func fetchBlob(db *sql.DB, blobs BlobStore, secret string, leader string, checksum string) error {
+	msg := ditnet.ClientMessage{
+		MessageType: ditnet.MSG_REPL_BLOB,
+		Message:     checksum,
+	}
+	msg.SignWithSecret(secret)
+	resp, err := ditnet.ExchangeMessage(msg, leader)
+	if err != nil {
+		return err
+	}
+	if resp.MessageType != ditnet.MSG_FILE {
+		return fmt.Errorf("failed to copy blob %s: %s", checksum, resp.Message)
+	}
+	err = VerifyBlob(checksum, resp.Data, resp.IsGZIP)
+	if err != nil {
+		return err
+	}
+	return PutBlob(db, blobs, checksum, resp.Data, resp.IsGZIP)
+}
+
+// applyBatch copies the missing blobs of a batch, then applies its state and moves the cursor in one transaction
+func (s *Server) applyBatch(cfg *Settings, leader string, batch ditnet.NetReplBatch) error {
+	db, blobs := s.db, s.blobs
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	checksums := make(map[string]bool)
+	for _, parcel := range batch.Parcels {
+		for _, snapshot := range parcel.Snapshots {
+			for _, checksum := range snapshot.Files {
+				checksums[checksum] = true
+			}
+		}
+		for _, entry := range parcel.Trash {
+			checksums[entry.Checksum] = true
+		}
+	}
+	copied := 0
+	for checksum := range checksums {
+		has, err := HasBlob(db, checksum)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		err = fetchBlob(db, blobs, cfg.ReplicationSecret, leader, checksum)
+		if err != nil {
+			return err
+		}
+		copied++
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, op := range batch.ParcelOps {
+		err = applyReplParcelOp(tx, leader, op)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", op.Author, op.Parcel, err)
+		}
+	}
+	for _, parcel := range batch.Parcels {
+		number, err := applyReplParcel(tx, cfg, parcel)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", parcel.Author, parcel.Parcel, err)
+		}
+		AuditLog(tx, AUDIT_REPLICATE, parcel.Author, leader, parcel.Parcel, "", "snapshot "+strconv.FormatInt(number, 10))
+	}
+	for _, keys := range batch.Keys {
+		err = applyReplKeys(tx, keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	res, err := tx.Exec("UPDATE replication SET cursor = ?, leader_head = ?, last_pull = ?, last_error = NULL, initial_after = NULLIF(?, '') WHERE id = 1 AND leader = ?",
+		batch.Head, batch.Latest, timestamp, batch.Next, leader)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil // promoted or following another leader meanwhile, drop the batch
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if len(batch.ParcelOps) > 0 || len(batch.Parcels) > 0 || len(batch.Keys) > 0 {
+		slog.Info("replicated changes", "leader", leader, "head", batch.Head, "latest", batch.Latest, "next", batch.Next,
+			"parcel_ops", len(batch.ParcelOps), "parcels", len(batch.Parcels), "key_authors", len(batch.Keys), "blobs_copied", copied)
+	}
+	return nil
+}
+
+// applyReplParcelOp deletes or moves a parcel like the leader did. The leader is authoritative, so a parcel in
+// the way of a move is replaced, and a parcel the follower does not have is left alone. The follower logs the
+// same event, so its own followers apply it as well.
+func applyReplParcelOp(tx *sql.Tx, leader string, op ditnet.NetReplParcelOp) error {
+	exists, err := parcelExists(tx, op.Author, op.Parcel)
+	if err != nil || !exists {
+		return err
+	}
+	if op.ToAuthor == "" {
+		err = deleteParcelRows(tx, op.Author, op.Parcel)
+		if err != nil {
+			return err
+		}
+		AuditLog(tx, AUDIT_PARCEL_DELETE, op.Author, leader, op.Parcel, "", "")
+		return nil
+	}
+	err = deleteParcelRows(tx, op.ToAuthor, op.ToParcel)
+	if err != nil {
+		return err
+	}
+	err = moveParcelRows(tx, op.Author, op.Parcel, op.ToAuthor, op.ToParcel)
+	if err != nil {
+		return err
+	}
+	AuditLog(tx, AUDIT_PARCEL_MOVE, op.Author, leader, op.Parcel, "", "@"+op.ToAuthor+op.ToParcel)
+	return nil
+}
+
+// applyReplParcel makes a parcel match the leader and returns its latest snapshot number
+func applyReplParcel(tx *sql.Tx, cfg *Settings, state ditnet.NetReplParcel) (int64, error) {
+	author, parcel := state.Author, state.Parcel
+	err := EnsureParcel(tx, author, parcel)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE parcels SET visibility = ?, encrypted = ? WHERE author = ? AND parcel = ?", state.Visibility, state.Encrypted, author, parcel)
+	if err != nil {
+		return 0, err
+	}
+	err = replaceParcelKeys(tx, author, parcel, state.Keys)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("DELETE FROM shares WHERE author = ? AND parcel = ?", author, parcel)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	for _, grantee := range state.Shares {
+		_, err = tx.Exec("INSERT INTO shares (author, parcel, grantee, created) VALUES (?, ?, ?, ?)", author, parcel, grantee, timestamp)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var latest int64
+	err = tx.QueryRow("SELECT COALESCE(MAX(number), 0) FROM snapshots WHERE author = ? AND parcel = ?", author, parcel).Scan(&latest)
+	if err != nil {
+		return 0, err
+	}
+	for i, snapshot := range state.Snapshots {
+		newest := i == len(state.Snapshots)-1
+		if snapshot.Number <= latest && !newest {
+			continue
+		}
+		changed, err := applyReplFiles(tx, cfg, author, parcel, snapshot)
+		if err != nil {
+			return 0, err
+		}
+		number := snapshot.Number
+		if number <= latest { // the snapshot numbers diverged after a promotion, keep the content in sync
+			if !changed {
+				continue
+			}
+			number = latest + 1
+		}
+		err = insertSnapshot(tx, author, parcel, number, snapshot.Requester, snapshot.Device, snapshot.Created)
+		if err != nil {
+			return 0, err
+		}
+		latest = number
+	}
+
+	_, err = tx.Exec("DELETE FROM tags WHERE author = ? AND parcel = ?", author, parcel)
+	if err != nil {
+		return 0, err
+	}
+	for _, tag := range state.Tags {
+		_, err = tx.Exec(`INSERT INTO tags (author, parcel, name, snapshot_id, created)
+			SELECT ?, ?, ?, id, ? FROM snapshots WHERE author = ? AND parcel = ? AND number = ?`,
+			author, parcel, tag.Name, tag.Created, author, parcel, tag.SnapshotID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM trash WHERE author = ? AND parcel = ?", author, parcel)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(state.Trash) - 1; i >= 0; i-- { // listed most recently deleted first
+		entry := state.Trash[i]
+		_, err = tx.Exec("INSERT INTO trash (author, parcel, path, checksum, deleted) VALUES (?, ?, ?, ?, ?)",
+			author, parcel, entry.Path, entry.Checksum, entry.Deleted)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return latest, pruneSnapshots(tx, cfg, author, parcel, latest)
+}
+
+// applyReplFiles makes the files of a parcel match a snapshot, the trash is copied from the leader afterwards
+func applyReplFiles(tx *sql.Tx, cfg *Settings, author string, parcel string, snapshot ditnet.NetReplSnapshot) (bool, error) {
+	current, err := parcelFiles(tx, author, parcel)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for path, checksum := range snapshot.Files {
+		if current[path] == checksum {
+			continue
+		}
+		err = SyncFileToDB(tx, author, parcel, path, checksum)
+		if err != nil {
+			return false, err
+		}
+		err = RecordFileVersion(tx, cfg, author, parcel, path, checksum, snapshot.Requester, snapshot.Device)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	for path := range current {
+		if _, ok := snapshot.Files[path]; ok {
+			continue
+		}
+		_, err = tx.Exec("DELETE FROM files WHERE author = ? AND parcel = ? AND path = ?", author, parcel, path)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// applyReplKeys replaces the device keys of an author with the leader's
+func applyReplKeys(tx *sql.Tx, keys ditnet.NetReplKeys) error {
+	_, err := tx.Exec("DELETE FROM keys WHERE author = ?", keys.Author)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys.Keys {
+		_, err = tx.Exec("INSERT INTO keys (author, device, public_key, created, revoked) VALUES (?, ?, ?, ?, NULLIF(?, ''))",
+			keys.Author, key.Device, key.PublicKey, key.Created, key.Revoked)
+		if err != nil {
+			return err
+		}
+	}
+	// revoking or resetting keys drops the parcel keys wrapped for them on the leader without touching the parcels
+	_, err = tx.Exec("DELETE FROM parcel_keys WHERE author = ? AND device NOT IN (SELECT device FROM keys WHERE author = ? AND revoked IS NULL)", keys.Author, keys.Author)
+	return err
+}
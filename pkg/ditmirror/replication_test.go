@@ -0,0 +1,306 @@
+package ditmirror
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+	"github.com/TheVoxcraft/dit/pkg/ditsync"
+)
+
+// startTestPair starts a leader and a follower replicating from it
+func startTestPair(t *testing.T) (leader *Server, leaderAddr string, follower *Server, followerAddr string) {
+	t.Helper()
+	settings := DefaultSettings()
+	settings.ReplicationSecret = "replication secret"
+	leader, leaderAddr = startTestServer(t, settings)
+	follower, followerAddr = startTestServer(t, settings)
+	if err := FollowMirror(follower.db, leaderAddr); err != nil {
+		t.Fatal(err)
+	}
+	return leader, leaderAddr, follower, followerAddr
+}
+
+// waitForFollower waits until the follower has applied every change of the leader made so far
+func waitForFollower(t *testing.T, leader *Server, follower *Server) {
+	t.Helper()
+	var latest int64
+	if err := leader.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM audit").Scan(&latest); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, following, err := GetReplicationState(follower.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !following {
+			t.Fatal("the follower is not following")
+		}
+		if state.Cursor >= latest && state.Initial == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the follower is at change %d of %d, last error: %s", state.Cursor, latest, state.LastError)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplicateAdminCommands(t *testing.T) {
+	leader, leaderAddr, follower, _ := startTestPair(t)
+	alice := newTestDevice(t, leaderAddr, "alice", "laptop")
+	for _, parcel := range []string{"/deleted", "/renamed", "/moved", "/replaced", "/kept"} {
+		alice.syncUp(t, parcel, map[string]string{"a.txt": "content of " + parcel})
+	}
+	waitForFollower(t, leader, follower)
+
+	for _, cmd := range []AdminCommand{
+		{Name: "delete-parcel", Author: "alice", Parcel: "/deleted"},
+		{Name: "rename-parcel", Author: "alice", Parcel: "/renamed", Target: "/new-name"},
+		{Name: "move-parcel", Author: "alice", Parcel: "/moved", Target: "bob"},
+		{Name: "delete-parcel", Author: "alice", Parcel: "/replaced"},
+		{Name: "rename-parcel", Author: "alice", Parcel: "/kept", Target: "/replaced"},
+		{Name: "reset-keys", Author: "alice"},
+	} {
+		if err := RunAdmin(leader.db, io.Discard, cmd, "test"); err != nil {
+			t.Fatalf("%s: %v", cmd.Name, err)
+		}
+	}
+	waitForFollower(t, leader, follower)
+
+	for _, parcel := range []struct {
+		author, parcel string
+		content        string // empty if the parcel should be gone
+	}{
+		{"alice", "/deleted", ""},
+		{"alice", "/renamed", ""},
+		{"alice", "/new-name", "content of /renamed"},
+		{"alice", "/moved", ""},
+		{"bob", "/moved", "content of /moved"},
+		{"alice", "/kept", ""},
+		{"alice", "/replaced", "content of /kept"},
+	} {
+		exists, err := parcelExists(follower.db, parcel.author, parcel.parcel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != (parcel.content != "") {
+			t.Errorf("@%s%s exists on the follower: %v", parcel.author, parcel.parcel, exists)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		files, err := parcelFiles(follower.db, parcel.author, parcel.parcel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, err := GetBlob(follower.db, follower.blobs, files["a.txt"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != parcel.content {
+			t.Errorf("@%s%s on the follower holds %q, want %q", parcel.author, parcel.parcel, data, parcel.content)
+		}
+	}
+
+	keys, err := ListKeys(follower.db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("the follower still has %d keys of alice after the reset", len(keys))
+	}
+}
+
+func TestReplicateParcelKeys(t *testing.T) {
+	leader, leaderAddr, follower, _ := startTestPair(t)
+	laptop := newTestDevice(t, leaderAddr, "alice", "laptop")
+	laptop.addDevice(t, "phone")
+	laptop.mustSucceed(t, setParcelKeysMessage(t, "/secret", map[string][]byte{"laptop": []byte("for laptop"), "phone": []byte("for phone")}))
+	waitForFollower(t, leader, follower)
+
+	encrypted, err := IsEncrypted(follower.db, "alice", "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetParcelKeys(follower.db, "alice", "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted || len(keys) != 2 {
+		t.Fatalf("the follower has the parcel encrypted: %v, with %d wrapped keys", encrypted, len(keys))
+	}
+
+	laptop.mustSucceed(t, ditnet.ClientMessage{OriginAuthor: "alice", MessageType: ditnet.MSG_REVOKE_KEY, Message: "phone"})
+	waitForFollower(t, leader, follower)
+	keys, err = GetParcelKeys(follower.db, "alice", "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys["phone"] != nil {
+		t.Fatalf("the follower keeps %d wrapped keys after the phone was revoked", len(keys))
+	}
+}
+
+func TestInitialReplicationIsPaged(t *testing.T) {
+	pageFiles := replicationPageFiles
+	replicationPageFiles = 2
+	t.Cleanup(func() { replicationPageFiles = pageFiles })
+
+	settings := DefaultSettings()
+	settings.ReplicationSecret = "replication secret"
+	leader, leaderAddr := startTestServer(t, settings)
+	alice := newTestDevice(t, leaderAddr, "alice", "laptop")
+	for _, parcel := range []string{"/a", "/b", "/c"} {
+		alice.syncUp(t, parcel, map[string]string{"a.txt": "a of " + parcel, "b.txt": "b of " + parcel})
+	}
+
+	// each parcel fills a page, the head stays at the change the copy started from
+	batch, err := ReplicationBatch(leader.db, &settings, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := batch.Head
+	pages := []string{}
+	for {
+		if len(batch.Parcels) != 1 || batch.Head != head {
+			t.Fatalf("page after %v has %d parcels and head %d, want 1 parcel and head %d", pages, len(batch.Parcels), batch.Head, head)
+		}
+		pages = append(pages, batch.Parcels[0].Parcel)
+		if batch.Next == "" {
+			break
+		}
+		batch, err = ReplicationBatch(leader.db, &settings, head, batch.Next)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(pages, " ") != "/a /b /c" {
+		t.Fatalf("the copy sent %v", pages)
+	}
+
+	follower, followerAddr := startTestServer(t, settings)
+	if err := FollowMirror(follower.db, leaderAddr); err != nil {
+		t.Fatal(err)
+	}
+	waitForFollower(t, leader, follower)
+	onFollower := *alice
+	onFollower.mirror = followerAddr
+	for _, parcel := range []string{"/a", "/b", "/c"} {
+		if got := onFollower.getFile(t, "alice", parcel, "b.txt"); got != "b of "+parcel {
+			t.Fatalf("the follower returned %q for %s", got, parcel)
+		}
+	}
+}
+
+func TestFollowSyncAndPromote(t *testing.T) {
+	leader, leaderAddr, follower, followerAddr := startTestPair(t)
+	alice := newTestDevice(t, leaderAddr, "alice", "laptop")
+	alice.syncUp(t, "/notes", map[string]string{"a.txt": "first"})
+	waitForFollower(t, leader, follower)
+
+	// the same device reads from the follower, its key was replicated
+	onFollower := *alice
+	onFollower.mirror = followerAddr
+	if got := onFollower.getFile(t, "alice", "/notes", "a.txt"); got != "first" {
+		t.Fatalf("the follower returned %q", got)
+	}
+
+	// a sync on the leader shows up on the follower
+	alice.syncUp(t, "/notes", map[string]string{"a.txt": "second", "b.txt": "new"})
+	waitForFollower(t, leader, follower)
+	parcel := onFollower.getParcel(t, "alice", "/notes")
+	if len(parcel.FilePaths) != 2 {
+		t.Fatalf("the follower lists %d files, want 2", len(parcel.FilePaths))
+	}
+	if got := onFollower.getFile(t, "alice", "/notes", "a.txt"); got != "second" {
+		t.Fatalf("the follower returned %q after the second sync", got)
+	}
+
+	// clients cannot write to a follower
+	for _, msg := range []ditnet.ClientMessage{
+		{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_PUT_BLOB, Message: "c.txt",
+			Message2: ditsync.DataChecksum([]byte("c")), Data: []byte("c")},
+		{OriginAuthor: "alice", ParcelPath: "/notes", MessageType: ditnet.MSG_SET_VISIBILITY, Message: VISIBILITY_PUBLIC},
+	} {
+		if resp := onFollower.send(t, msg); resp.MessageType != ditnet.MSG_FAILURE {
+			t.Fatalf("the follower accepted %s", ditnet.MessageTypeName(msg.MessageType))
+		}
+	}
+
+	old, err := PromoteMirror(follower.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != leaderAddr {
+		t.Fatalf("promoted away from %s, want %s", old, leaderAddr)
+	}
+	onFollower.syncUp(t, "/notes", map[string]string{"a.txt": "third"})
+	if got := onFollower.getFile(t, "alice", "/notes", "a.txt"); got != "third" {
+		t.Fatalf("the promoted mirror returned %q", got)
+	}
+
+	// the promoted mirror stops pulling, a later sync on the old leader stays there
+	alice.syncUp(t, "/notes", map[string]string{"a.txt": "only on the old leader"})
+	time.Sleep(200 * time.Millisecond)
+	if got := onFollower.getFile(t, "alice", "/notes", "a.txt"); got != "third" {
+		t.Fatalf("the promoted mirror still replicates, it returned %q", got)
+	}
+}
+
+func TestReplicationRequestsAreSigned(t *testing.T) {
+	settings := DefaultSettings()
+	settings.ReplicationSecret = "replication secret"
+	_, leaderAddr := startTestServer(t, settings)
+
+	for _, c := range []struct {
+		name string
+		msg  func() ditnet.ClientMessage
+		ok   bool
+	}{
+		{"signed", func() ditnet.ClientMessage {
+			msg := ditnet.ClientMessage{MessageType: ditnet.MSG_REPL_CHANGES, Message: "0"}
+			msg.SignWithSecret("replication secret")
+			return msg
+		}, true},
+		{"wrong secret", func() ditnet.ClientMessage {
+			msg := ditnet.ClientMessage{MessageType: ditnet.MSG_REPL_CHANGES, Message: "0"}
+			msg.SignWithSecret("another secret")
+			return msg
+		}, false},
+		{"secret in the clear", func() ditnet.ClientMessage {
+			return ditnet.ClientMessage{MessageType: ditnet.MSG_REPL_CHANGES, Message: "0", Secret: "replication secret"}
+		}, false},
+		{"altered", func() ditnet.ClientMessage {
+			msg := ditnet.ClientMessage{MessageType: ditnet.MSG_REPL_CHANGES, Message: "0"}
+			msg.SignWithSecret("replication secret")
+			msg.Message = "1"
+			return msg
+		}, false},
+	} {
+		resp, err := ditnet.ExchangeMessage(c.msg(), leaderAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := resp.MessageType == ditnet.MSG_REPL_BATCH; ok != c.ok {
+			t.Errorf("%s: %s %q", c.name, ditnet.MessageTypeName(resp.MessageType), resp.Message)
+		}
+	}
+
+	// a signed request is accepted once
+	msg := ditnet.ClientMessage{MessageType: ditnet.MSG_REPL_CHANGES, Message: "0"}
+	msg.SignWithSecret("replication secret")
+	for i, want := range []int{ditnet.MSG_REPL_BATCH, ditnet.MSG_FAILURE} {
+		resp, err := ditnet.ExchangeMessage(msg, leaderAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.MessageType != want {
+			t.Fatalf("request %d: %s %q", i+1, ditnet.MessageTypeName(resp.MessageType), resp.Message)
+		}
+	}
+}
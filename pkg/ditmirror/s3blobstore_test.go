@@ -0,0 +1,308 @@
+package ditmirror
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a path-style S3 bucket that checks the Signature V4 of every request with its own implementation
+type fakeS3 struct {
+	t         *testing.T
+	base      string // path of the endpoint
+	bucket    string
+	accessKey string
+	secretKey string
+	region    string
+
+	mu       sync.Mutex
+	objects  map[string][]byte // unescaped path -> data
+	rawPaths []string          // escaped path of every request, as sent
+	listPage int               // objects per ListObjectsV2 response
+}
+
+func newFakeS3(t *testing.T, base string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, base: base, bucket: "dit", accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", region: "eu-north-1",
+		objects: make(map[string][]byte), listPage: 1000}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reason := f.checkSignature(r, body); reason != "" {
+		f.t.Logf("rejected %s %s: %s", r.Method, r.URL.EscapedPath(), reason)
+		http.Error(w, "SignatureDoesNotMatch: "+reason, http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rawPaths = append(f.rawPaths, r.URL.EscapedPath())
+	if r.URL.Path == f.base+"/"+f.bucket && r.Method == http.MethodHead {
+		return
+	}
+	if r.URL.Path == f.base+"/"+f.bucket && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, r.URL.Query())
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, f.base+"/"+f.bucket+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	data, exists := f.objects[r.URL.Path]
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[r.URL.Path] = body
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list answers a ListObjectsV2 request, the continuation token is the last key of the previous page
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	type object struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	keys := make([]string, 0)
+	for path := range f.objects {
+		key := strings.TrimPrefix(path, f.base+"/"+f.bucket+"/")
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(result.Contents) == f.listPage {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[len(result.Contents)-1].Key
+			break
+		}
+		result.Contents = append(result.Contents, object{Key: key, Size: len(f.objects[f.base+"/"+f.bucket+"/"+key]), LastModified: "2024-05-01T12:00:00.000Z"})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// checkSignature returns why the request is not signed correctly, or an empty string
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) string {
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(payloadHash[:]) {
+		return "payload hash does not match the body"
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	if _, err := time.Parse("20060102T150405Z", amzDate); err != nil {
+		return "invalid x-amz-date"
+	}
+	auth := r.Header.Get("Authorization")
+	const algorithm = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(auth, algorithm) {
+		return "missing authorization"
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, algorithm), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	scope := amzDate[:8] + "/" + f.region + "/s3/aws4_request"
+	if fields["Credential"] != f.accessKey+"/"+scope {
+		return "unexpected credential " + fields["Credential"]
+	}
+	if fields["SignedHeaders"] != "host;x-amz-content-sha256;x-amz-date" {
+		return "unexpected signed headers " + fields["SignedHeaders"]
+	}
+
+	names := make([]string, 0)
+	for name := range r.URL.Query() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := make([]string, 0)
+	for _, name := range names {
+		escape := func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "+", "%20") }
+		params = append(params, escape(name)+"="+escape(r.URL.Query().Get(name)))
+	}
+	canonical := r.Method + "\n" + r.URL.EscapedPath() + "\n" + strings.Join(params, "&") + "\n" +
+		"host:" + r.Host + "\nx-amz-content-sha256:" + r.Header.Get("x-amz-content-sha256") + "\nx-amz-date:" + amzDate + "\n\n" +
+		fields["SignedHeaders"] + "\n" + r.Header.Get("x-amz-content-sha256")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + f.secretKey)
+	for _, part := range []string{amzDate[:8], f.region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if fields["Signature"] != hex.EncodeToString(key) {
+		return "signature does not match"
+	}
+	return ""
+}
+
+func (f *fakeS3) config(endpoint string) S3Config {
+	return S3Config{Endpoint: endpoint, Bucket: f.bucket, Region: f.region, AccessKey: f.accessKey, SecretKey: f.secretKey, Prefix: "blobs/"}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	fake, server := newFakeS3(t, "")
+	store, err := NewS3BlobStore(fake.config(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// checksums are base32 and end in '=', which Signature V4 requires to be escaped in the path
+	key := "MFRGGZDFMZTWQ2LKNNWG23TPOBYXE43UOV3HO6DZPI======"
+	data := []byte("file data")
+	if err := store.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	stored := fake.objects["/dit/blobs/"+key]
+	lastPath := fake.rawPaths[len(fake.rawPaths)-1]
+	fake.mu.Unlock()
+	if !bytes.Equal(stored, data) {
+		t.Fatalf("the bucket holds %q under /dit/blobs/%s", stored, key)
+	}
+	if want := "/dit/blobs/" + strings.ReplaceAll(key, "=", "%3D"); lastPath != want {
+		t.Fatalf("requested %s, want %s", lastPath, want)
+	}
+
+	got, err := store.Get(key)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("get returned %q, %v", got, err)
+	}
+	info, err := store.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != key || info.Size != int64(len(data)) || !info.ModTime.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("stat returned %+v", info)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(key); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("get of a deleted blob returned %v, want ErrBlobNotFound", err)
+	}
+	if _, err := store.Stat(key); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("stat of a deleted blob returned %v, want ErrBlobNotFound", err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("deleting a missing blob: %v", err)
+	}
+}
+
+func TestS3BlobStoreEndpointPath(t *testing.T) {
+	// the bucket is below the path of the endpoint, which the signature covers as well
+	fake, server := newFakeS3(t, "/storage/s3")
+	store, err := NewS3BlobStore(fake.config(server.URL + "/storage/s3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("KEY=", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get("KEY="); err != nil || string(data) != "x" {
+		t.Fatalf("get returned %q, %v", data, err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, ok := fake.objects["/storage/s3/dit/blobs/KEY="]; !ok {
+		t.Fatalf("objects in the bucket: %v", fake.objects)
+	}
+}
+
+func TestS3BlobStoreRejectedCredentials(t *testing.T) {
+	fake, server := newFakeS3(t, "")
+	config := fake.config(server.URL)
+	config.SecretKey = "wrong"
+	if _, err := NewS3BlobStore(config); err == nil {
+		t.Fatal("the bucket check passed with a wrong secret key")
+	}
+	config = fake.config(server.URL)
+	config.Bucket = "other"
+	if _, err := NewS3BlobStore(config); err == nil {
+		t.Fatal("the bucket check passed for a bucket that does not exist")
+	}
+}
+
+func TestS3BlobStoreList(t *testing.T) {
+	fake, server := newFakeS3(t, "")
+	fake.listPage = 2
+	store, err := NewS3BlobStore(fake.config(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"A=", "B=", "C=", "D=", "E="}
+	for _, key := range keys {
+		if err := store.Put(key, []byte("data of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.mu.Lock()
+	fake.objects["/dit/other/F="] = []byte("outside the prefix")
+	fake.mu.Unlock()
+
+	listed := make([]string, 0)
+	err = store.List(func(info BlobInfo) error {
+		if info.Size != int64(len("data of "+info.Key)) || !info.ModTime.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("listed %+v", info)
+		}
+		listed = append(listed, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(listed, " ") != strings.Join(keys, " ") {
+		t.Fatalf("listed %v, want %v", listed, keys)
+	}
+
+	// an error from visit stops the listing
+	stop := errors.New("stop")
+	visited := 0
+	err = store.List(func(info BlobInfo) error {
+		visited++
+		return stop
+	})
+	if !errors.Is(err, stop) || visited != 1 {
+		t.Fatalf("list returned %v after %d blobs", err, visited)
+	}
+}
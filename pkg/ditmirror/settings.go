@@ -0,0 +1,32 @@
+package ditmirror
+
+// Settings belong to a Server, they are read deep in the storage code (retention when a version or snapshot is
+// recorded, quotas when a file is synced) and replaced as a whole with Server.SetSettings. A request reads them
+// once and passes them down, so a reload cannot mix old and new values.
+
+// Settings the mirror reads while serving
+type Settings struct {
+	DefaultQuota      Quota  // applies to authors without their own quota
+	VersionRetention  int    // versions kept per file, 0 keeps every version
+	SnapshotRetention int    // snapshots kept per parcel, 0 keeps every snapshot
+	TrashRetention    int    // days, 0 keeps the trash until restored
+	MaxDeletes        int    // files a sync without a confirmed preview may remove from a parcel, 0 for no limit
+	MaxDeletePercent  int    // percent of a parcel a sync without a confirmed preview may remove, 0 for no limit
+	ReplicationSecret string // shared by leader and followers, replication is refused while empty
+	AdminSecret       string // MSG_ADMIN is refused while empty
+}
+
+// DefaultSettings are used by a server created without settings
+func DefaultSettings() Settings {
+	return Settings{VersionRetention: 10, SnapshotRetention: 20, TrashRetention: 30, MaxDeletes: 20, MaxDeletePercent: 50}
+}
+
+// SetSettings puts new settings in effect, requests already running keep the ones they started with
+func (s *Server) SetSettings(settings Settings) {
+	s.settings.Store(&settings)
+}
+
+// Settings returns the settings in effect, the caller must not modify them
+func (s *Server) Settings() *Settings {
+	return s.settings.Load()
+}
@@ -0,0 +1,114 @@
+package ditmirror
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Shutdown stops a server from accepting connections and drains it: requests in flight and the background workers
+// get until the context ends to finish, then the remaining connections are closed, which rolls back their
+// transactions. The database stays open, it belongs to the caller.
+
+// connTracker keeps the connections being handled, so shutdown can wait for them and close the stragglers
+type connTracker struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+	closed bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// add tracks c, it reports false and closes c once the tracker is closed
+func (t *connTracker) add(c net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		c.Close()
+		return false
+	}
+	t.conns[c] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) done(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+	t.wg.Done()
+}
+
+// close refuses connections accepted from now on, so waiting for the tracked ones cannot race with new ones
+func (t *connTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+}
+
+// closeAll closes every tracked connection and returns how many there were
+func (t *connTracker) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.conns {
+		c.Close()
+	}
+	return len(t.conns)
+}
+
+// waitContext waits for wg and reports whether it finished before ctx ended
+func waitContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Shutdown closes the listeners, waits for the requests in flight and the background workers, and closes the
+// connections still open when ctx ends. It returns ctx.Err() if connections had to be closed. Serve returns
+// ErrServerClosed as soon as Shutdown is called, wait for Shutdown to return before closing the database.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.draining.Swap(true) {
+		close(s.stop)
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+	s.tracker.close()
+
+	var err error
+	if !waitContext(ctx, &s.tracker.wg) {
+		err = ctx.Err()
+		slog.Warn("closing connections before their requests finished", "connections", s.tracker.closeAll(), "reason", err)
+		s.tracker.wg.Wait()
+	}
+	if !waitContext(ctx, &s.workers) {
+		// a worker that just noticed stop needs a moment
+		grace, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if !waitContext(grace, &s.workers) {
+			slog.Warn("background workers did not stop in time")
+		}
+		err = ctx.Err()
+	}
+	return err
+}
+
+// Draining reports whether Shutdown was called
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
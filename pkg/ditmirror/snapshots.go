@@ -0,0 +1,427 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+// A sync up stages file data with MSG_PUT_BLOB and publishes it with MSG_COMMIT, which updates the files of the
+// parcel and records the result as a numbered snapshot in one transaction. Readers list and download a snapshot,
+// so they never see a parcel that is half way through a sync.
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found, it may have been pruned")
+	ErrParcelChanged    = errors.New("the parcel changed on the mirror since the sync was previewed, sync again")
+	ErrTooManyRemovals  = errors.New("refusing to remove that many files")
+)
+
+// legacySyncWindow is how long after an upload of an older client its next upload still belongs to the same sync
+const legacySyncWindow = time.Minute
+
+// snapshotParcel records the current files of a parcel as its next snapshot and prunes old snapshots
+func snapshotParcel(tx *sql.Tx, cfg *Settings, author string, parcel string, requester string, device string) (int64, error) {
+	author = strings.TrimPrefix(author, "@")
+	var number int64
+	err := tx.QueryRow("SELECT COALESCE(MAX(number), 0) + 1 FROM snapshots WHERE author = ? AND parcel = ?", author, parcel).Scan(&number)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	err = insertSnapshot(tx, author, parcel, number, requester, device, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return number, pruneSnapshots(tx, cfg, author, parcel, number)
+}
+
+// insertSnapshot records the current files of a parcel as the snapshot with the given number
+func insertSnapshot(tx *sql.Tx, author string, parcel string, number int64, requester string, device string, created string) error {
+	res, err := tx.Exec("INSERT INTO snapshots (author, parcel, number, requester, device, created) VALUES (?, ?, ?, ?, ?, ?)",
+		author, parcel, number, requester, device, created)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO snapshot_files (snapshot_id, path, checksum) SELECT ?, path, checksum FROM files WHERE author = ? AND parcel = ?", id, author, parcel)
+	return err
+}
+
+// pruneSnapshots deletes the snapshots of a parcel that fall outside retention, tagged snapshots are kept
+func pruneSnapshots(tx *sql.Tx, cfg *Settings, author string, parcel string, latest int64) error {
+	retention := cfg.SnapshotRetention
+	if retention <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(`DELETE FROM snapshot_files WHERE snapshot_id IN
+		(SELECT id FROM snapshots WHERE author = ? AND parcel = ? AND number <= ? AND id NOT IN (SELECT snapshot_id FROM tags))`,
+		author, parcel, latest-int64(retention))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM snapshots WHERE author = ? AND parcel = ? AND number <= ? AND id NOT IN (SELECT snapshot_id FROM tags)",
+		author, parcel, latest-int64(retention))
+	return err
+}
+
+// legacySnapshot publishes a file synced with MSG_SYNC_FILE by a client without MSG_COMMIT. Such a sync sends one
+// message per file, so the uploads of a device that follow each other within legacySyncWindow update one open
+// snapshot instead of adding a snapshot per file and pruning the history.
+func legacySnapshot(tx *sql.Tx, cfg *Settings, author string, parcel string, requester string, device string) error {
+	author = strings.TrimPrefix(author, "@")
+	var id int64
+	var created string
+	err := tx.QueryRow(`SELECT id, created FROM snapshots WHERE author = ?1 AND parcel = ?2 AND open AND requester = ?3 AND device = ?4
+		AND number = (SELECT MAX(number) FROM snapshots WHERE author = ?1 AND parcel = ?2) AND id NOT IN (SELECT snapshot_id FROM tags)`,
+		author, parcel, requester, device).Scan(&id, &created)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	last, _ := time.Parse(time.RFC3339, created)
+	if errors.Is(err, sql.ErrNoRows) || time.Since(last) > legacySyncWindow {
+		number, err := snapshotParcel(tx, cfg, author, parcel, requester, device)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE snapshots SET open = true WHERE author = ? AND parcel = ? AND number = ?", author, parcel, number)
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM snapshot_files WHERE snapshot_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO snapshot_files (snapshot_id, path, checksum) SELECT ?, path, checksum FROM files WHERE author = ? AND parcel = ?", id, author, parcel)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE snapshots SET created = ? WHERE id = ?", time.Now().UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// SnapshotParcel records the current files of a parcel as a new snapshot in its own transaction
+func SnapshotParcel(db *sql.DB, cfg *Settings, author string, parcel string, requester string, device string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	number, err := snapshotParcel(tx, cfg, author, parcel, requester, device)
+	if err != nil {
+		return 0, err
+	}
+	return number, tx.Commit()
+}
+
+// CommitSnapshot makes the files of a parcel match the master record and publishes them as a new snapshot.
+// All data must already be on the mirror, referenced or uploaded by the author, nothing is changed if any of it is missing.
+// The checks read the parcel and the usage in the transaction that writes the snapshot, so concurrent commits cannot
+// both pass the quota or count their changes against files the other one replaced.
+func CommitSnapshot(db *sql.DB, cfg *Settings, author string, parcel string, netmaster ditnet.NetMaster, requester string, device string, remote string) (ditnet.NetSnapshot, error) {
+	author = strings.TrimPrefix(author, "@")
+	master := netmaster.Master
+	snapshot := ditnet.NetSnapshot{Files: len(master)}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return snapshot, err
+	}
+	defer tx.Rollback()
+
+	// the first statement writes, so the transaction holds the write lock before it reads and other commits wait for it
+	err = EnsureParcel(tx, author, parcel)
+	if err != nil {
+		return snapshot, err
+	}
+	for path, checksum := range master {
+		err := CheckParcelBlob(tx, author, parcel, checksum)
+		if err != nil {
+			return snapshot, fmt.Errorf("%w: %s", err, path)
+		}
+		has, err := AuthorHasBlob(tx, author, checksum)
+		if err != nil {
+			return snapshot, err
+		}
+		if !has {
+			return snapshot, fmt.Errorf("%w: %s", ErrMissingBlob, path)
+		}
+	}
+
+	current, err := parcelFiles(tx, author, parcel)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Before = len(current)
+	removed := 0
+	for path := range current {
+		if _, ok := master[path]; !ok {
+			removed++
+		}
+	}
+	if netmaster.Guarded {
+		latest, err := LatestSnapshot(tx, author, parcel)
+		if err != nil {
+			return snapshot, err
+		}
+		if latest != netmaster.Base {
+			return snapshot, ErrParcelChanged
+		}
+		if removed > netmaster.MaxRemoved {
+			return snapshot, fmt.Errorf("%w: the sync removes %d files, %d were confirmed", ErrTooManyRemovals, removed, netmaster.MaxRemoved)
+		}
+	} else {
+		err = checkUnconfirmedRemovals(cfg, removed, len(current))
+		if err != nil {
+			return snapshot, err
+		}
+	}
+
+	quota, err := GetQuota(tx, cfg, author)
+	if err != nil {
+		return snapshot, err
+	}
+	if quota.MaxFiles > 0 || quota.MaxBytes > 0 {
+		usage, err := GetUsage(tx, author)
+		if err != nil {
+			return snapshot, err
+		}
+		files := usage.Files - int64(len(current)) + int64(len(master))
+		if quota.MaxFiles > 0 && files > quota.MaxFiles {
+			return snapshot, fmt.Errorf("%w: %d of %d files", ErrQuotaExceeded, files, quota.MaxFiles)
+		}
+		// staged blobs are not part of the usage until they are committed
+		added, err := addedBytes(tx, author, master)
+		if err != nil {
+			return snapshot, err
+		}
+		if quota.MaxBytes > 0 && usage.Bytes+added > quota.MaxBytes {
+			return snapshot, fmt.Errorf("%w: %s of %s", ErrQuotaExceeded, FormatSize(usage.Bytes+added), FormatSize(quota.MaxBytes))
+		}
+	}
+
+	for path, checksum := range master {
+		if current[path] == checksum {
+			continue
+		}
+		err = SyncFileToDB(tx, author, parcel, path, checksum)
+		if err != nil {
+			return snapshot, err
+		}
+		err = RecordFileVersion(tx, cfg, author, parcel, path, checksum, requester, device)
+		if err != nil {
+			return snapshot, err
+		}
+		AuditLog(tx, AUDIT_SYNC, author, remote, parcel, path, checksum)
+		snapshot.Changed++
+	}
+	for path, checksum := range current {
+		if _, ok := master[path]; ok {
+			continue
+		}
+		_, err = tx.Exec("DELETE FROM files WHERE author = ? AND parcel = ? AND path = ?", author, parcel, path)
+		if err != nil {
+			return snapshot, err
+		}
+		err = TrashFile(tx, author, parcel, path, checksum, requester, device)
+		if err != nil {
+			return snapshot, err
+		}
+		AuditLog(tx, AUDIT_DELETE, author, remote, parcel, path, checksum)
+		snapshot.Removed++
+	}
+
+	if snapshot.Changed == 0 && snapshot.Removed == 0 { // nothing to publish, keep the latest snapshot
+		err = tx.QueryRow("SELECT COALESCE(MAX(number), 0) FROM snapshots WHERE author = ? AND parcel = ?", author, parcel).Scan(&snapshot.ID)
+		if err != nil || snapshot.ID > 0 {
+			return snapshot, err
+		}
+	}
+	snapshot.ID, err = snapshotParcel(tx, cfg, author, parcel, requester, device)
+	if err != nil {
+		return snapshot, err
+	}
+	return snapshot, tx.Commit()
+}
+
+// checkUnconfirmedRemovals holds a sync that nobody confirmed, from an older or third party client, to the deletion limits
+// of the mirror. The dit client asks before it removes more than its own limits and sends what the user confirmed.
+func checkUnconfirmedRemovals(cfg *Settings, removed int, before int) error {
+	if cfg.MaxDeletes > 0 && removed > cfg.MaxDeletes || cfg.MaxDeletePercent > 0 && removed*100 > cfg.MaxDeletePercent*before {
+		return fmt.Errorf("%w: the sync removes %d of %d files without a confirmation, sync with an up to date client", ErrTooManyRemovals, removed, before)
+	}
+	return nil
+}
+
+// PreviewCommit counts what CommitSnapshot would change without applying it, ID is the current latest snapshot
+func PreviewCommit(db *sql.DB, author string, parcel string, master map[string]string) (ditnet.NetSnapshot, error) {
+	author = strings.TrimPrefix(author, "@")
+	snapshot := ditnet.NetSnapshot{Files: len(master)}
+	current, err := parcelFiles(db, author, parcel)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Before = len(current)
+	for path, checksum := range master {
+		if current[path] != checksum {
+			snapshot.Changed++
+		}
+	}
+	for path := range current {
+		if _, ok := master[path]; !ok {
+			snapshot.Removed++
+		}
+	}
+	snapshot.ID, err = LatestSnapshot(db, author, parcel)
+	return snapshot, err
+}
+
+// parcelFiles returns the current files of a parcel, path -> checksum
+func parcelFiles(db querier, author string, parcel string) (map[string]string, error) {
+	rows, err := db.Query("SELECT path, checksum FROM files WHERE author = ? AND parcel = ?", author, parcel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]string)
+	for rows.Next() {
+		var path, checksum string
+		if err := rows.Scan(&path, &checksum); err != nil {
+			return nil, err
+		}
+		files[path] = checksum
+	}
+	return files, rows.Err()
+}
+
+// LatestSnapshot returns the newest snapshot number of a parcel, 0 if it has none
+func LatestSnapshot(db querier, author string, parcel string) (int64, error) {
+	author = strings.TrimPrefix(author, "@")
+	var number int64
+	err := db.QueryRow("SELECT COALESCE(MAX(number), 0) FROM snapshots WHERE author = ? AND parcel = ?", author, parcel).Scan(&number)
+	return number, err
+}
+
+func GetSnapshotFiles(db *sql.DB, author string, parcel string, number int64) ([]string, error) {
+	author = strings.TrimPrefix(author, "@")
+	rows, err := db.Query(`SELECT f.path FROM snapshot_files f JOIN snapshots s ON s.id = f.snapshot_id
+		WHERE s.author = ? AND s.parcel = ? AND s.number = ?`, author, parcel, number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make([]string, 0)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+func GetSnapshotFile(db *sql.DB, blobs BlobStore, author string, parcel string, number int64, path string) ([]byte, bool, error) {
+	author = strings.TrimPrefix(author, "@")
+	var checksum string
+	err := db.QueryRow(`SELECT f.checksum FROM snapshot_files f JOIN snapshots s ON s.id = f.snapshot_id
+		WHERE s.author = ? AND s.parcel = ? AND s.number = ? AND f.path = ?`, author, parcel, number, path).Scan(&checksum)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrSnapshotNotFound
+	} else if err != nil {
+		return nil, false, err
+	}
+	return GetBlob(db, blobs, checksum)
+}
+
+func (s *Server) handleSnapshotMessage(c net.Conn, cfg *Settings, msg *ditnet.ClientMessage, requester string, remote string) {
+	db, blobs := s.db, s.blobs
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+	if err := AuthorizeAuthor(db, author, requester); err != nil {
+		AuditLog(db, AUDIT_AUTH_FAIL, author, remote, msg.ParcelPath, msg.Message, "sync")
+		sendFailure(c, err.Error())
+		return
+	}
+
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	switch msg.MessageType {
+	case ditnet.MSG_PUT_BLOB:
+		logAttrs(c, "file", msg.Message)
+		err := CheckParcelBlob(db, author, msg.ParcelPath, msg.Message2)
+		if err == nil {
+			err = VerifyBlob(msg.Message2, msg.Data, msg.IsGZIP)
+		}
+		if err != nil {
+			sendFailure(c, err.Error())
+			return
+		}
+		err = CheckQuota(db, cfg, author, msg.ParcelPath, msg.Message, msg.Message2, int64(len(msg.Data)))
+		if errors.Is(err, ErrQuotaExceeded) {
+			sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_QUOTA_EXCEEDED, Message: err.Error()})
+			return
+		} else if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		err = PutBlob(db, blobs, msg.Message2, msg.Data, msg.IsGZIP)
+		if err == nil {
+			err = RecordUpload(db, author, msg.Message2)
+		}
+		if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: "OK"})
+
+	case ditnet.MSG_COMMIT, ditnet.MSG_PREVIEW_COMMIT:
+		var netmaster ditnet.NetMaster
+		err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(&netmaster)
+		if err != nil {
+			connLogger(c).Warn("gob decode error", "err", err)
+			sendFailure(c, "invalid master")
+			return
+		}
+		var snapshot ditnet.NetSnapshot
+		if msg.MessageType == ditnet.MSG_PREVIEW_COMMIT {
+			snapshot, err = PreviewCommit(db, author, msg.ParcelPath, netmaster.Master)
+		} else {
+			snapshot, err = CommitSnapshot(db, cfg, author, msg.ParcelPath, netmaster, requester, msg.Device, remote)
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_QUOTA_EXCEEDED, Message: err.Error()})
+			return
+		} else if errors.Is(err, ErrMissingBlob) || errors.Is(err, ErrEncryptedParcel) || errors.Is(err, ErrUnencryptedParcel) ||
+			errors.Is(err, ErrParcelChanged) || errors.Is(err, ErrTooManyRemovals) {
+			sendFailure(c, err.Error())
+			return
+		} else if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		logAttrs(c, "snapshot", snapshot.ID, "changed", snapshot.Changed, "removed", snapshot.Removed)
+
+		var snapshotBytes bytes.Buffer
+		err = gob.NewEncoder(&snapshotBytes).Encode(snapshot)
+		if err != nil {
+			connLogger(c).Error("gob encode error", "err", err)
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SNAPSHOT, Data: snapshotBytes.Bytes()})
+	}
+}
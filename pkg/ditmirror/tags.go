@@ -0,0 +1,171 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+// Tags name a snapshot of a parcel. A tagged snapshot is never pruned by snapshot retention.
+
+var ErrTagNotFound = errors.New("tag not found")
+var ErrTagExists = errors.New("tag already exists")
+var ErrInvalidTag = errors.New("invalid tag name, use letters, digits, '.', '_' and '-'")
+
+var tagNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+// CreateTag points a new tag at a snapshot of the parcel, the latest one if number is 0
+func CreateTag(db *sql.DB, author string, parcel string, name string, number int64, requester string) (int64, error) {
+	author = strings.TrimPrefix(author, "@")
+	if !tagNamePattern.MatchString(name) {
+		return 0, ErrInvalidTag
+	}
+	if number == 0 {
+		var err error
+		number, err = LatestSnapshot(db, author, parcel)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var id int64
+	err := db.QueryRow("SELECT id FROM snapshots WHERE author = ? AND parcel = ? AND number = ?", author, parcel, number).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrSnapshotNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	res, err := db.Exec("INSERT OR IGNORE INTO tags (author, parcel, name, snapshot_id, requester, created) VALUES (?, ?, ?, ?, ?, ?)",
+		author, parcel, name, id, requester, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrTagExists
+	}
+	return number, nil
+}
+
+func DeleteTag(db *sql.DB, author string, parcel string, name string) error {
+	author = strings.TrimPrefix(author, "@")
+	res, err := db.Exec("DELETE FROM tags WHERE author = ? AND parcel = ? AND name = ?", author, parcel, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTagNotFound
+	}
+	return nil
+}
+
+func ListTags(db *sql.DB, author string, parcel string) ([]ditnet.NetTag, error) {
+	author = strings.TrimPrefix(author, "@")
+	rows, err := db.Query(`SELECT t.name, s.number, t.created FROM tags t JOIN snapshots s ON s.id = t.snapshot_id
+		WHERE t.author = ? AND t.parcel = ? ORDER BY s.number DESC, t.name`, author, parcel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]ditnet.NetTag, 0)
+	for rows.Next() {
+		var tag ditnet.NetTag
+		if err := rows.Scan(&tag.Name, &tag.SnapshotID, &tag.Created); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// ResolveTag returns the snapshot number a tag points at
+func ResolveTag(db *sql.DB, author string, parcel string, name string) (int64, error) {
+	author = strings.TrimPrefix(author, "@")
+	var number int64
+	err := db.QueryRow("SELECT s.number FROM tags t JOIN snapshots s ON s.id = t.snapshot_id WHERE t.author = ? AND t.parcel = ? AND t.name = ?",
+		author, parcel, name).Scan(&number)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrTagNotFound
+	}
+	return number, err
+}
+
+func handleTagMessage(c net.Conn, db *sql.DB, msg *ditnet.ClientMessage, requester string, remote string) {
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+
+	if msg.MessageType == ditnet.MSG_LIST_TAGS {
+		if !CanRead(db, author, msg.ParcelPath, requester) {
+			AuditLog(db, AUDIT_AUTH_FAIL, author, remote, msg.ParcelPath, "", "read by @"+requester)
+			sendFailure(c, ErrParcelAccess.Error())
+			return
+		}
+		tags, err := ListTags(db, author, msg.ParcelPath)
+		if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		var tagBytes bytes.Buffer
+		err = gob.NewEncoder(&tagBytes).Encode(tags)
+		if err != nil {
+			connLogger(c).Error("gob encode error", "err", err)
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_TAGS, Data: tagBytes.Bytes()})
+		return
+	}
+
+	if err := AuthorizeAuthor(db, author, requester); err != nil {
+		AuditLog(db, AUDIT_AUTH_FAIL, author, remote, msg.ParcelPath, "", "manage tags")
+		sendFailure(c, err.Error())
+		return
+	}
+
+	switch msg.MessageType {
+	case ditnet.MSG_CREATE_TAG:
+		var number int64
+		if msg.Message2 != "" {
+			var err error
+			number, err = strconv.ParseInt(msg.Message2, 10, 64)
+			if err != nil {
+				sendFailure(c, "invalid snapshot")
+				return
+			}
+		}
+		number, err := CreateTag(db, author, msg.ParcelPath, msg.Message, number, requester)
+		if errors.Is(err, ErrInvalidTag) || errors.Is(err, ErrTagExists) || errors.Is(err, ErrSnapshotNotFound) {
+			sendFailure(c, err.Error())
+			return
+		} else if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		logAttrs(c, "tag", msg.Message, "snapshot", number)
+		AuditLog(db, AUDIT_TAG, author, remote, msg.ParcelPath, "", msg.Message+" -> snapshot "+strconv.FormatInt(number, 10))
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: strconv.FormatInt(number, 10)})
+
+	case ditnet.MSG_DELETE_TAG:
+		err := DeleteTag(db, author, msg.ParcelPath, msg.Message)
+		if errors.Is(err, ErrTagNotFound) {
+			sendFailure(c, err.Error())
+			return
+		} else if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		logAttrs(c, "tag", msg.Message)
+		AuditLog(db, AUDIT_UNTAG, author, remote, msg.ParcelPath, "", msg.Message)
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_SUCCESS, Message: "OK"})
+	}
+}
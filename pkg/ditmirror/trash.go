@@ -0,0 +1,168 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+// A file removed by a sync is moved to the trash instead of being forgotten, so a master cleared by accident can
+// be undone with a restore. Entries older than Settings.TrashRetention days are purged by garbage collection.
+
+var ErrNotInTrash = errors.New("file not found in trash")
+var ErrFileExists = errors.New("a file already exists at this path, delete it first")
+
+// TrashFile records that a file was removed from a parcel, the caller deletes it from files
+func TrashFile(db execer, author string, parcel string, path string, checksum string, requester string, device string) error {
+	author = strings.TrimPrefix(author, "@")
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.Exec("INSERT INTO trash (author, parcel, path, checksum, requester, device, deleted) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		author, parcel, path, checksum, requester, device, timestamp)
+	return err
+}
+
+// ListTrash returns the deleted files of a parcel, most recently deleted first
+func ListTrash(db *sql.DB, cfg *Settings, author string, parcel string) ([]ditnet.NetTrashEntry, error) {
+	author = strings.TrimPrefix(author, "@")
+	rows, err := db.Query(`SELECT t.path, t.checksum, COALESCE(b.size, 0), t.deleted FROM trash t
+		LEFT JOIN blobs b ON b.checksum = t.checksum
+		WHERE t.author = ? AND t.parcel = ? ORDER BY t.id DESC`, author, parcel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retention := cfg.TrashRetention
+	entries := make([]ditnet.NetTrashEntry, 0)
+	for rows.Next() {
+		var entry ditnet.NetTrashEntry
+		var deleted time.Time
+		err = rows.Scan(&entry.Path, &entry.Checksum, &entry.Size, &deleted)
+		if err != nil {
+			return nil, err
+		}
+		entry.Deleted = deleted.Format(time.RFC3339)
+		if retention > 0 {
+			entry.Expires = deleted.AddDate(0, 0, retention).Format(time.RFC3339)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// RestoreFile puts the most recently deleted file at path back into the parcel and publishes a new snapshot
+func RestoreFile(db *sql.DB, cfg *Settings, author string, parcel string, path string, requester string, device string, remote string) (string, int64, error) {
+	author = strings.TrimPrefix(author, "@")
+	var id int64
+	var checksum string
+	err := db.QueryRow("SELECT id, checksum FROM trash WHERE author = ? AND parcel = ? AND path = ? ORDER BY id DESC LIMIT 1",
+		author, parcel, path).Scan(&id, &checksum)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, ErrNotInTrash
+	} else if err != nil {
+		return "", 0, err
+	}
+
+	var existing int
+	err = db.QueryRow("SELECT COUNT(*) FROM files WHERE author = ? AND parcel = ? AND path = ?", author, parcel, path).Scan(&existing)
+	if err != nil {
+		return "", 0, err
+	}
+	if existing > 0 {
+		return "", 0, ErrFileExists
+	}
+	size, err := GetBlobSize(db, checksum)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, ErrMissingBlob
+	} else if err != nil {
+		return "", 0, err
+	}
+	err = CheckQuota(db, cfg, author, parcel, path, checksum, size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	err = SyncFileToDB(tx, author, parcel, path, checksum)
+	if err != nil {
+		return "", 0, err
+	}
+	err = RecordFileVersion(tx, cfg, author, parcel, path, checksum, requester, device)
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = tx.Exec("DELETE FROM trash WHERE id = ?", id)
+	if err != nil {
+		return "", 0, err
+	}
+	AuditLog(tx, AUDIT_RESTORE, author, remote, parcel, path, checksum)
+	number, err := snapshotParcel(tx, cfg, author, parcel, requester, device)
+	if err != nil {
+		return "", 0, err
+	}
+	return checksum, number, tx.Commit()
+}
+
+func (s *Server) handleTrashMessage(c net.Conn, cfg *Settings, msg *ditnet.ClientMessage, requester string, remote string) {
+	db, blobs := s.db, s.blobs
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+	if err := AuthorizeAuthor(db, author, requester); err != nil {
+		AuditLog(db, AUDIT_AUTH_FAIL, author, remote, msg.ParcelPath, msg.Message, "trash")
+		sendFailure(c, err.Error())
+		return
+	}
+
+	switch msg.MessageType {
+	case ditnet.MSG_LIST_TRASH:
+		entries, err := ListTrash(db, cfg, author, msg.ParcelPath)
+		if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		var trashBytes bytes.Buffer
+		err = gob.NewEncoder(&trashBytes).Encode(entries)
+		if err != nil {
+			connLogger(c).Error("gob encode error", "err", err)
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_TRASH, Data: trashBytes.Bytes()})
+
+	case ditnet.MSG_RESTORE_TRASH:
+		s.gcLock.RLock()
+		defer s.gcLock.RUnlock()
+
+		checksum, number, err := RestoreFile(db, cfg, author, msg.ParcelPath, msg.Message, requester, msg.Device, remote)
+		if errors.Is(err, ErrQuotaExceeded) {
+			sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_QUOTA_EXCEEDED, Message: err.Error()})
+			return
+		} else if errors.Is(err, ErrNotInTrash) || errors.Is(err, ErrFileExists) || errors.Is(err, ErrMissingBlob) {
+			sendFailure(c, err.Error())
+			return
+		} else if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		logAttrs(c, "file", msg.Message, "snapshot", number)
+
+		data, gzip, err := GetBlob(db, blobs, checksum)
+		if err != nil {
+			connLogger(c).Error("blob error", "err", err)
+			sendFailure(c, "restored, but failed to read the file data")
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_FILE, Message: msg.Message, Data: data, IsGZIP: gzip})
+	}
+}
@@ -0,0 +1,126 @@
+package ditmirror
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheVoxcraft/dit/pkg/ditnet"
+)
+
+// Every upload of a path is recorded in file_versions, the files table only points at the current one.
+// The newest Settings.VersionRetention versions of each path are kept, older ones are pruned on upload.
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// RecordFileVersion adds an upload to the history of a path, unless it has the same content as the latest version
+func RecordFileVersion(db querier, cfg *Settings, author string, parcel string, path string, checksum string, requester string, device string) error {
+	author = strings.TrimPrefix(author, "@")
+	var latest string
+	err := db.QueryRow("SELECT checksum FROM file_versions WHERE author = ? AND parcel = ? AND path = ? ORDER BY id DESC LIMIT 1", author, parcel, path).Scan(&latest)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if latest == checksum {
+		return nil
+	}
+
+	retention := cfg.VersionRetention
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	_, err = db.Exec("INSERT INTO file_versions (author, parcel, path, checksum, requester, device, created) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		author, parcel, path, checksum, requester, device, timestamp)
+	if err != nil || retention <= 0 {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM file_versions WHERE author = ? AND parcel = ? AND path = ? AND id NOT IN
+		(SELECT id FROM file_versions WHERE author = ? AND parcel = ? AND path = ? ORDER BY id DESC LIMIT ?)`,
+		author, parcel, path, author, parcel, path, retention)
+	return err
+}
+
+// ListFileVersions returns the history of a path, newest first
+func ListFileVersions(db *sql.DB, author string, parcel string, path string) ([]ditnet.NetFileVersion, error) {
+	author = strings.TrimPrefix(author, "@")
+	rows, err := db.Query(`SELECT v.id, v.checksum, COALESCE(b.size, 0), v.device, v.created FROM file_versions v
+		LEFT JOIN blobs b ON b.checksum = v.checksum
+		WHERE v.author = ? AND v.parcel = ? AND v.path = ? ORDER BY v.id DESC`, author, parcel, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]ditnet.NetFileVersion, 0)
+	for rows.Next() {
+		var v ditnet.NetFileVersion
+		var device sql.NullString
+		err = rows.Scan(&v.ID, &v.Checksum, &v.Size, &device, &v.Created)
+		if err != nil {
+			return nil, err
+		}
+		v.Device = device.String
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func GetFileVersion(db *sql.DB, blobs BlobStore, author string, parcel string, path string, id int64) ([]byte, bool, error) {
+	author = strings.TrimPrefix(author, "@")
+	var checksum string
+	err := db.QueryRow("SELECT checksum FROM file_versions WHERE id = ? AND author = ? AND parcel = ? AND path = ?", id, author, parcel, path).Scan(&checksum)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, ErrVersionNotFound
+	} else if err != nil {
+		return nil, false, err
+	}
+	return GetBlob(db, blobs, checksum)
+}
+
+func handleVersionMessage(c net.Conn, db *sql.DB, blobs BlobStore, msg *ditnet.ClientMessage, requester string, remote string) {
+	author := strings.TrimPrefix(msg.OriginAuthor, "@")
+	if !CanRead(db, author, msg.ParcelPath, requester) {
+		AuditLog(db, AUDIT_AUTH_FAIL, author, remote, msg.ParcelPath, msg.Message, "read by @"+requester)
+		sendFailure(c, ErrParcelAccess.Error())
+		return
+	}
+
+	switch msg.MessageType {
+	case ditnet.MSG_LIST_VERSIONS:
+		logAttrs(c, "file", msg.Message)
+		versions, err := ListFileVersions(db, author, msg.ParcelPath, msg.Message)
+		if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		var versionBytes bytes.Buffer
+		err = gob.NewEncoder(&versionBytes).Encode(versions)
+		if err != nil {
+			connLogger(c).Error("gob encode error", "err", err)
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_VERSIONS, Message: msg.Message, Data: versionBytes.Bytes()})
+
+	case ditnet.MSG_GET_VERSION:
+		logAttrs(c, "file", msg.Message, "version", msg.Message2)
+		id, err := strconv.ParseInt(msg.Message2, 10, 64)
+		if err != nil {
+			sendFailure(c, "invalid version")
+			return
+		}
+		data, gzip, err := GetFileVersion(db, blobs, author, msg.ParcelPath, msg.Message, id)
+		if errors.Is(err, ErrVersionNotFound) || errors.Is(err, ErrMissingBlob) {
+			sendFailure(c, err.Error())
+			return
+		} else if err != nil {
+			connLogger(c).Error("db error", "err", err)
+			sendFailure(c, "db error")
+			return
+		}
+		sendServerMessage(c, ditnet.ServerMessage{MessageType: ditnet.MSG_FILE, Message: msg.Message, Data: data, IsGZIP: gzip})
+	}
+}
@@ -0,0 +1,102 @@
+package ditnet
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"time"
+)
+
+const (
+	SIGNATURE_MAX_AGE = 5 * time.Minute // signed messages older (or newer) than this are rejected
+)
+
+func (m *ClientMessage) IsSigned() bool {
+	return len(m.Signature) > 0
+}
+
+// Sign signs the message with a device key, the signature covers every field except Secret and the signature itself
+func (m *ClientMessage) Sign(requester string, device string, key ed25519.PrivateKey) {
+	m.Requester = requester
+	m.Device = device
+	m.Timestamp = time.Now().Unix()
+	m.Nonce = make([]byte, 16)
+	rand.Read(m.Nonce)
+	m.Signature = ed25519.Sign(key, m.digest())
+}
+
+func (m *ClientMessage) Verify(pub ed25519.PublicKey) error {
+	if !m.IsSigned() {
+		return errors.New("message is not signed")
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	age := time.Since(time.Unix(m.Timestamp, 0))
+	if age > SIGNATURE_MAX_AGE || age < -SIGNATURE_MAX_AGE {
+		return errors.New("signature expired, check the system clock")
+	}
+	if !ed25519.Verify(pub, m.digest(), m.Signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// SignWithSecret signs a message between mirrors with their shared secret, which is not sent. The signature is an
+// HMAC over the fields Sign covers, with the same timestamp and nonce.
+func (m *ClientMessage) SignWithSecret(secret string) {
+	m.Secret = ""
+	m.Timestamp = time.Now().Unix()
+	m.Nonce = make([]byte, 16)
+	rand.Read(m.Nonce)
+	m.Signature = secretMAC(secret, m.digest())
+}
+
+func (m *ClientMessage) VerifySecret(secret string) error {
+	if !m.IsSigned() || len(m.Nonce) == 0 {
+		return errors.New("message is not signed")
+	}
+	age := time.Since(time.Unix(m.Timestamp, 0))
+	if age > SIGNATURE_MAX_AGE || age < -SIGNATURE_MAX_AGE {
+		return errors.New("signature expired, check the system clock")
+	}
+	if !hmac.Equal(secretMAC(secret, m.digest()), m.Signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func secretMAC(secret string, digest []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(digest)
+	return mac.Sum(nil)
+}
+
+func (m *ClientMessage) digest() []byte {
+	h := sha256.New()
+	writeField(h, []byte(m.OriginAuthor))
+	writeField(h, []byte(m.ParcelPath))
+	binary.Write(h, binary.BigEndian, int64(m.MessageType))
+	writeField(h, []byte(m.Message))
+	writeField(h, []byte(m.Message2))
+	dataHash := sha256.Sum256(m.Data)
+	writeField(h, dataHash[:])
+	binary.Write(h, binary.BigEndian, m.IsGZIP)
+	binary.Write(h, binary.BigEndian, m.DataOmitted)
+	writeField(h, []byte(m.Requester))
+	writeField(h, []byte(m.Device))
+	binary.Write(h, binary.BigEndian, m.Timestamp)
+	if len(m.Nonce) > 0 { // older clients sign without one
+		writeField(h, m.Nonce)
+	}
+	return h.Sum(nil)
+}
+
+func writeField(h hash.Hash, b []byte) { // length prefixed so fields can't bleed into each other
+	binary.Write(h, binary.BigEndian, uint32(len(b)))
+	h.Write(b)
+}
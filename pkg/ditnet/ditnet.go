@@ -2,6 +2,7 @@ package ditnet
 
 import (
 	"encoding/gob"
+	"fmt"
 	"log"
 	"net"
 
@@ -21,11 +22,139 @@ const (
 	// Server -> Client
 	MSG_REGISTER = iota // unused
 	MSG_SUCCESS  = iota
-	MSG_FAILURE  = iota // unused
+	MSG_FAILURE  = iota
 	MSG_PARCEL   = iota
 	MSG_FILE     = iota
+
+	// Client -> Server (device keys)
+	MSG_ADD_KEY    = iota
+	MSG_LIST_KEYS  = iota
+	MSG_REVOKE_KEY = iota // Message holds the device, Message2 "force" also revokes the last active key
+
+	// Server -> Client
+	MSG_KEYS = iota
+
+	// Client -> Server (parcel settings)
+	MSG_SET_VISIBILITY = iota
+	MSG_SHARE_PARCEL   = iota
+
+	// Client -> Server (blobs)
+	MSG_HAS_BLOBS = iota
+
+	// Server -> Client
+	MSG_BLOBS = iota
+
+	// Client -> Server (quotas)
+	MSG_GET_QUOTA = iota
+
+	// Server -> Client
+	MSG_QUOTA          = iota
+	MSG_QUOTA_EXCEEDED = iota
+
+	// Client -> Server (file history)
+	MSG_LIST_VERSIONS = iota
+	MSG_GET_VERSION   = iota
+
+	// Server -> Client
+	MSG_VERSIONS = iota
+
+	// Client -> Server (snapshots)
+	MSG_PUT_BLOB = iota // Stages file data, nothing is visible to readers until MSG_COMMIT
+	MSG_COMMIT   = iota
+
+	// Server -> Client
+	MSG_SNAPSHOT = iota
+
+	// Client -> Server (tags)
+	MSG_CREATE_TAG = iota
+	MSG_LIST_TAGS  = iota
+	MSG_DELETE_TAG = iota
+
+	// Server -> Client
+	MSG_TAGS = iota
+
+	// Client -> Server (trash)
+	MSG_LIST_TRASH    = iota
+	MSG_RESTORE_TRASH = iota // Answered with MSG_FILE holding the restored data
+
+	// Server -> Client
+	MSG_TRASH = iota
+
+	// Client -> Server (snapshots)
+	MSG_PREVIEW_COMMIT = iota // Answered with MSG_SNAPSHOT counting what MSG_COMMIT would change, nothing is applied
+
+	// Mirror -> Mirror (replication), signed with the replication secret, see SignWithSecret
+	MSG_REPL_CHANGES = iota // Message holds the cursor, answered with MSG_REPL_BATCH
+	MSG_REPL_BLOB    = iota // Message holds the checksum, answered with MSG_FILE
+
+	// Server -> Mirror
+	MSG_REPL_BATCH = iota
+
+	// Admin -> Server, authenticated with the admin secret in Secret
+	MSG_ADMIN = iota // Data holds the gob encoded command, answered with MSG_SUCCESS holding the output in Message
+
+	// Client -> Server (encrypted parcels)
+	MSG_SET_PARCEL_KEYS = iota // Data holds the gob encoded map of device to wrapped parcel key, replacing the wrapped keys
+	MSG_GET_PARCEL_KEY  = iota // Answered with MSG_PARCEL_KEY holding the parcel key wrapped for the signing device
+
+	// Server -> Client
+	MSG_PARCEL_KEY = iota
 )
 
+var messageTypeNames = map[int]string{
+	MSG_NEW_PARCEL:     "NEW_PARCEL",
+	MSG_SYNC_FILE:      "SYNC_FILE",
+	MSG_SYNC_MASTER:    "SYNC_MASTER",
+	MSG_GET_PARCEL:     "GET_PARCEL",
+	MSG_GET_FILE:       "GET_FILE",
+	MSG_REGISTER:       "REGISTER",
+	MSG_SUCCESS:        "SUCCESS",
+	MSG_FAILURE:        "FAILURE",
+	MSG_PARCEL:         "PARCEL",
+	MSG_FILE:           "FILE",
+	MSG_ADD_KEY:        "ADD_KEY",
+	MSG_LIST_KEYS:      "LIST_KEYS",
+	MSG_REVOKE_KEY:     "REVOKE_KEY",
+	MSG_KEYS:           "KEYS",
+	MSG_SET_VISIBILITY: "SET_VISIBILITY",
+	MSG_SHARE_PARCEL:   "SHARE_PARCEL",
+	MSG_HAS_BLOBS:      "HAS_BLOBS",
+	MSG_BLOBS:          "BLOBS",
+	MSG_GET_QUOTA:      "GET_QUOTA",
+	MSG_QUOTA:          "QUOTA",
+	MSG_QUOTA_EXCEEDED: "QUOTA_EXCEEDED",
+	MSG_LIST_VERSIONS:  "LIST_VERSIONS",
+	MSG_GET_VERSION:    "GET_VERSION",
+	MSG_VERSIONS:       "VERSIONS",
+	MSG_PUT_BLOB:       "PUT_BLOB",
+	MSG_COMMIT:         "COMMIT",
+	MSG_SNAPSHOT:       "SNAPSHOT",
+	MSG_CREATE_TAG:     "CREATE_TAG",
+	MSG_LIST_TAGS:      "LIST_TAGS",
+	MSG_DELETE_TAG:     "DELETE_TAG",
+	MSG_TAGS:           "TAGS",
+	MSG_LIST_TRASH:     "LIST_TRASH",
+	MSG_RESTORE_TRASH:  "RESTORE_TRASH",
+	MSG_TRASH:          "TRASH",
+	MSG_PREVIEW_COMMIT: "PREVIEW_COMMIT",
+	MSG_REPL_CHANGES:   "REPL_CHANGES",
+	MSG_REPL_BLOB:      "REPL_BLOB",
+	MSG_REPL_BATCH:     "REPL_BATCH",
+	MSG_ADMIN:          "ADMIN",
+
+	MSG_SET_PARCEL_KEYS: "SET_PARCEL_KEYS",
+	MSG_GET_PARCEL_KEY:  "GET_PARCEL_KEY",
+	MSG_PARCEL_KEY:      "PARCEL_KEY",
+}
+
+// MessageTypeName returns the name of a message type for logs, e.g. SYNC_FILE
+func MessageTypeName(messageType int) string {
+	if name, ok := messageTypeNames[messageType]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", messageType)
+}
+
 type ClientMessage struct {
 	OriginAuthor string
 	ParcelPath   string
@@ -34,7 +163,13 @@ type ClientMessage struct {
 	Message2     string
 	Data         []byte
 	IsGZIP       bool
+	DataOmitted  bool // Data was left out because the author already has a blob with this checksum on the mirror (MSG_SYNC_FILE)
 	Secret       string
+	Requester    string // Author whose device key signed the message
+	Device       string // Device the signing key belongs to
+	Timestamp    int64  // Unix time of signing, limits replays
+	Nonce        []byte // Random per signature, so the mirror can reject a signature it has seen before
+	Signature    []byte
 }
 
 type ServerMessage struct {
@@ -45,25 +180,128 @@ type ServerMessage struct {
 }
 
 type NetParcel struct {
-	Info      ditmaster.ParcelInfo
-	FilePaths []string
+	Info       ditmaster.ParcelInfo
+	FilePaths  []string
+	SnapshotID int64 // Snapshot the file paths belong to, pass it with MSG_GET_FILE for a consistent download
+}
+
+type NetSnapshot struct {
+	ID      int64 // Numbered per parcel, increases with every commit
+	Files   int
+	Changed int
+	Removed int
+	Before  int // Files in the parcel before the commit
+}
+
+type NetKey struct {
+	Device    string
+	PublicKey []byte
+	Created   string
+	Revoked   string // Empty if the key is active
+}
+
+type NetFileVersion struct {
+	ID       int64 // Increases with every upload, used to fetch the version
+	Checksum string
+	Size     int64 // Stored size, compressed if the blob is gzipped
+	Device   string
+	Created  string
+}
+
+type NetTag struct {
+	Name       string
+	SnapshotID int64
+	Created    string
+}
+
+type NetTrashEntry struct {
+	Path     string
+	Checksum string
+	Size     int64 // Stored size, compressed if the blob is gzipped
+	Deleted  string
+	Expires  string // Empty if the trash is kept until restored
+}
+
+type NetQuota struct {
+	UsedBytes int64
+	UsedFiles int64
+	MaxBytes  int64 // 0 for unlimited
+	MaxFiles  int64 // 0 for unlimited
+}
+
+// NetReplBatch is the state a follower mirror needs to catch up on the changes after its cursor
+type NetReplBatch struct {
+	Head      int64             // Last change in the batch, the cursor for the next request
+	Latest    int64             // Last change on the leader, the follower is up to date once Head reaches it
+	Next      string            // While a new follower copies every parcel, the last one in the batch as author/parcel, ask for the parcels after it
+	ParcelOps []NetReplParcelOp // In the order they happened, applied before Parcels
+	Parcels   []NetReplParcel
+	Keys      []NetReplKeys
+}
+
+// NetReplParcelOp deletes a parcel, or moves it when ToAuthor and ToParcel are set
+type NetReplParcelOp struct {
+	Author   string
+	Parcel   string
+	ToAuthor string
+	ToParcel string
+}
+
+type NetReplParcel struct {
+	Author     string
+	Parcel     string
+	Visibility string
+	Shares     []string
+	Encrypted  bool
+	Keys       map[string][]byte // Wrapped parcel keys by device
+	Snapshots  []NetReplSnapshot // Oldest first, the newest is the current state of the parcel
+	Tags       []NetTag
+	Trash      []NetTrashEntry
+}
+
+type NetReplSnapshot struct {
+	Number    int64
+	Requester string
+	Device    string
+	Created   string
+	Files     map[string]string // path -> checksum
+}
+
+type NetReplKeys struct {
+	Author string
+	Keys   []NetKey // Every key of the author, including revoked ones
 }
 
 type NetMaster struct { // Used to sync local master with remote master (removing deleted files)
 	Master map[string]string
+
+	// Set by a client that previewed the commit: the mirror refuses it if the parcel moved past Base, the latest
+	// snapshot of the preview, or if it would remove more than the MaxRemoved files the user accepted
+	Guarded    bool
+	Base       int64
+	MaxRemoved int
 }
 
 func SendMessageToServer(msg ClientMessage, mirror_addr string) ServerMessage {
+	server_msg, err := ExchangeMessage(msg, mirror_addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return server_msg
+}
+
+// ExchangeMessage sends a message and reads the response, for callers that must survive an unreachable mirror
+func ExchangeMessage(msg ClientMessage, mirror_addr string) (ServerMessage, error) {
 	conn, err := net.Dial("tcp", mirror_addr)
 	if err != nil {
-		log.Fatal("Failed to connect to mirror: ", err)
+		return ServerMessage{}, fmt.Errorf("failed to connect to mirror: %w", err)
 	}
 	defer conn.Close()
 
 	enc := gob.NewEncoder(conn)
 	err = enc.Encode(msg)
 	if err != nil {
-		log.Fatal("Failed to send message to mirror: ", err)
+		return ServerMessage{}, fmt.Errorf("failed to send message to mirror: %w", err)
 	}
 
 	// Read RESPONSE from server
@@ -71,8 +309,8 @@ func SendMessageToServer(msg ClientMessage, mirror_addr string) ServerMessage {
 	server_msg := &ServerMessage{}
 	err = dec.Decode(server_msg)
 	if err != nil {
-		log.Fatal("Failed to read message from mirror: ", err)
+		return ServerMessage{}, fmt.Errorf("failed to read message from mirror: %w", err)
 	}
 
-	return *server_msg
+	return *server_msg, nil
 }
@@ -81,10 +81,14 @@ func GetFileChecksum(path string) (string, error) {
 		log.Fatal(err)
 		return "", err
 	}
+	return DataChecksum(data), nil
+}
+
+func DataChecksum(data []byte) string {
 	hash := sha256.Sum256(data)
 
 	friendly_string := base32.StdEncoding.EncodeToString(hash[:])
-	return friendly_string, nil
+	return friendly_string
 }
 
 /* SerializedFile: Unused for now
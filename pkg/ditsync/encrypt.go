@@ -0,0 +1,113 @@
+package ditsync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// Files of an encrypted parcel are encrypted by the client with the parcel key before they are sent.
+// Such a blob is stored under an ID derived from the key and the plaintext checksum, so the mirror
+// learns neither the content nor which files are equal across parcels, while equal files inside the
+// parcel still share one blob.
+//
+// Blob layout: version byte, flags byte, 12 byte nonce, AES-256-GCM ciphertext with tag.
+// The nonce is derived from the sealed payload, so equal payloads encrypt to equal blobs and
+// different payloads never share a nonce.
+
+const (
+	PARCEL_KEY_SIZE         = 32
+	ENCRYPTED_BLOB_PREFIX   = "x" // never part of a base32 checksum, which is upper case
+	ENCRYPTED_BLOB_OVERHEAD = 2 + 12 + 16
+
+	encryptedBlobVersion = 1
+	encryptedFlagGZIP    = 1
+)
+
+var ErrDecryptBlob = errors.New("failed to decrypt data, it was not encrypted with this parcel key or was altered")
+
+func IsEncryptedBlob(checksum string) bool {
+	return strings.HasPrefix(checksum, ENCRYPTED_BLOB_PREFIX)
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func keyedHash(key []byte, label string, data []byte) []byte {
+	mac := hmac.New(sha256.New, deriveKey(key, label))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// ValidEncryptedBlobID checks the form of an ID made by EncryptedBlobID, the mirror cannot check more than that
+func ValidEncryptedBlobID(id string) bool {
+	if !IsEncryptedBlob(id) {
+		return false
+	}
+	mac, err := base32.StdEncoding.DecodeString(id[len(ENCRYPTED_BLOB_PREFIX):])
+	return err == nil && len(mac) == sha256.Size && encryptedBlobIDFromMAC(mac) == id
+}
+
+// encryptedBlobIDFromMAC encodes the keyed hash of a checksum as a blob ID
+func encryptedBlobIDFromMAC(mac []byte) string {
+	return ENCRYPTED_BLOB_PREFIX + base32.StdEncoding.EncodeToString(mac)
+}
+
+// EncryptedBlobID returns the ID under which a file with the given plaintext checksum is stored
+func EncryptedBlobID(key []byte, checksum string) string {
+	return encryptedBlobIDFromMAC(keyedHash(key, "dit blob id", []byte(checksum)))
+}
+
+// EncryptBlob encrypts file data as returned by GetFileData, compressed if isGZIP
+func EncryptBlob(key []byte, data []byte, isGZIP bool) ([]byte, error) {
+	gcm, err := newBlobCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var flags byte
+	if isGZIP {
+		flags |= encryptedFlagGZIP
+	}
+	header := []byte{encryptedBlobVersion, flags}
+	nonce := keyedHash(key, "dit blob nonce", append(append([]byte{}, header...), data...))[:gcm.NonceSize()]
+	blob := append(header, nonce...)
+	return gcm.Seal(blob, nonce, data, header), nil
+}
+
+// DecryptBlob returns the plaintext of a blob made by EncryptBlob, decompressed if it was compressed
+func DecryptBlob(key []byte, blob []byte) ([]byte, error) {
+	gcm, err := newBlobCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < ENCRYPTED_BLOB_OVERHEAD || blob[0] != encryptedBlobVersion {
+		return nil, ErrDecryptBlob
+	}
+	header, nonce, sealed := blob[:2], blob[2:2+gcm.NonceSize()], blob[2+gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, ErrDecryptBlob
+	}
+	if header[1]&encryptedFlagGZIP != 0 {
+		return GZIPDecompress(data)
+	}
+	return data, nil
+}
+
+func newBlobCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != PARCEL_KEY_SIZE {
+		return nil, errors.New("invalid parcel key size")
+	}
+	block, err := aes.NewCipher(deriveKey(key, "dit blob data"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,107 @@
+package ditsync
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+const (
+	MAXIMUM_SCAN_SIZE = WARNING_SIZE // larger files are assumed to be assets and not scanned
+)
+
+type SecretFinding struct {
+	FilePath string
+	Rule     string
+	Line     int // 0 if the finding is about the file itself
+}
+
+type secretRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// files which hold secrets by convention, matched against the file name
+var secretFileRules = []secretRule{
+	{"dotenv file", regexp.MustCompile(`^\.env(\..+)?$`)},
+	{"ssh private key file", regexp.MustCompile(`^id_(rsa|dsa|ecdsa|ed25519)$`)},
+	{"private key file", regexp.MustCompile(`\.(key|p12|pfx)$`)},
+}
+
+// patterns for secrets in file contents
+var secretContentRules = []secretRule{
+	{"PEM private key", regexp.MustCompile(`-----BEGIN ([A-Z]+ )?PRIVATE KEY( BLOCK)?-----`)},
+	{"AWS access key id", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret access key", regexp.MustCompile(`(?i)aws_secret_access_key\s*[=:]\s*["']?[A-Za-z0-9/+=]{40}`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+}
+
+func ScanFileForSecrets(path string) ([]SecretFinding, error) {
+	findings := make([]SecretFinding, 0)
+	name := filepath.Base(path)
+	for _, rule := range secretFileRules {
+		if rule.pattern.MatchString(name) {
+			findings = append(findings, SecretFinding{FilePath: path, Rule: rule.name})
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MAXIMUM_SCAN_SIZE {
+		return findings, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary(data) {
+		return findings, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		for _, rule := range secretContentRules {
+			if rule.pattern.MatchString(text) {
+				findings = append(findings, SecretFinding{FilePath: path, Rule: rule.name, Line: line})
+			}
+		}
+	}
+	return findings, scanner.Err()
+}
+
+// ScanSyncFiles scans the files that are about to be uploaded, skipping paths matching an exception pattern
+func ScanSyncFiles(sync_files []SyncFile, exceptions []string) ([]SecretFinding, error) {
+	findings := make([]SecretFinding, 0)
+	for _, file := range sync_files {
+		if !file.IsDirty && !file.IsNew {
+			continue
+		}
+		if isIgnored(file.FilePath, exceptions) {
+			continue
+		}
+		found, err := ScanFileForSecrets(file.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+	return findings, nil
+}
+
+func isBinary(data []byte) bool {
+	sniff := data
+	if len(sniff) > 8000 {
+		sniff = sniff[:8000]
+	}
+	return bytes.IndexByte(sniff, 0) != -1
+}